@@ -0,0 +1,113 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the API, as loaded
+// from a certsd.conf file.
+type Config struct {
+	// Listen is the address the API listens on.
+	Listen string `yaml:"listen"`
+
+	// TLSCert and TLSKey are the certificate and key files
+	// the API is served with. If they are empty, the API is
+	// served over plain HTTP, which is only advisable on a
+	// loopback interface, since it hands out private keys.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+
+	// Users are the users that are authorized
+	// to use the API.
+	Users []UserConfig `yaml:"users"`
+}
+
+// UserConfig is a user of the API and its credentials.
+type UserConfig struct {
+	Username string `yaml:"username"`
+
+	// Password is the bcrypt hash of the user's password;
+	// run "certsd -hashpw" to make one.
+	Password string `yaml:"password"`
+}
+
+// LoadConfig loads and validates the configuration in file.
+func LoadConfig(file string) (Config, error) {
+	var cfg Config
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cfg, err
+	}
+	err = yaml.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("parsing %s: %v", file, err)
+	}
+
+	if cfg.Listen == "" {
+		cfg.Listen = DefaultListen
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return cfg, fmt.Errorf("%s: tls_cert and tls_key must be specified together", file)
+	}
+	if len(cfg.Users) == 0 {
+		return cfg, fmt.Errorf("%s: must authorize at least one user", file)
+	}
+	seen := make(map[string]struct{})
+	for i, user := range cfg.Users {
+		if user.Username == "" {
+			return cfg, fmt.Errorf("%s: user %d: missing username", file, i)
+		}
+		if _, ok := seen[user.Username]; ok {
+			return cfg, fmt.Errorf("%s: user '%s' is specified more than once", file, user.Username)
+		}
+		seen[user.Username] = struct{}{}
+		if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+			return cfg, fmt.Errorf("%s: user '%s': password must be a bcrypt hash: %v", file, user.Username, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// authenticate returns true if username and password
+// are the credentials of one of the users in cfg. It takes
+// about as long whether or not the user exists, so that
+// usernames can't be guessed by timing it.
+func (cfg Config) authenticate(username, password string) bool {
+	hash, found := []byte(dummyHash), false
+	for _, user := range cfg.Users {
+		if subtle.ConstantTimeCompare([]byte(user.Username), []byte(username)) == 1 {
+			hash, found = []byte(user.Password), true
+		}
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return found && err == nil
+}
+
+// dummyHash is a bcrypt hash, at the default cost, that
+// passwords are checked against when there is no such user.
+const dummyHash = "$2a$10$SXwB6JGdbF.bFFM6CUle/.SIUZTk64zn2l0V8rEjRNGemghka3ohq"
+
+// DefaultListen is the address the API listens
+// on if the config does not specify one.
+const DefaultListen = "127.0.0.1:8053"
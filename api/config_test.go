@@ -0,0 +1,70 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoadConfig(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		input     string
+		shouldErr bool
+	}{
+		{input: "users:\n  - username: admin\n    password: '" + string(hash) + "'\n"},
+		{input: "listen: ':9000'\nusers:\n  - username: admin\n    password: '" + string(hash) + "'\n"},
+		{input: "listen: ':9000'\n", shouldErr: true},
+		{input: "users:\n  - username: admin\n    password: secret\n", shouldErr: true},
+		{input: "users:\n  - password: '" + string(hash) + "'\n", shouldErr: true},
+		{input: "tls_cert: cert.pem\nusers:\n  - username: admin\n    password: '" + string(hash) + "'\n", shouldErr: true},
+		{input: "users: [", shouldErr: true},
+	} {
+		file := "certsd_test.conf"
+		if err := ioutil.WriteFile(file, []byte(test.input), 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := LoadConfig(file)
+		os.Remove(file)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+			continue
+		}
+		if cfg.Listen == "" {
+			t.Errorf("Test %d: Expected a listen address, but it was empty", i)
+		}
+		if !cfg.authenticate("admin", "secret") {
+			t.Errorf("Test %d: Expected admin to authenticate, but it did not", i)
+		}
+		if cfg.authenticate("admin", "wrong") || cfg.authenticate("nobody", "secret") || cfg.authenticate("", "not the password of any user") {
+			t.Errorf("Test %d: Expected bad credentials to fail authentication, but they did not", i)
+		}
+	}
+}
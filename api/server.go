@@ -0,0 +1,310 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api implements the authenticated REST API of certsd,
+// through which certificates in the workspace can be listed,
+// fetched, issued, renewed and revoked.
+//
+// All requests must be authenticated with HTTP basic auth as one
+// of the users in the config. The endpoints are:
+//
+//     GET  /sites                list the sites in the workspace
+//     POST /sites                issue a certificate: {"names": [...], "key_type": "..."}
+//     GET  /sites/{name}         get the metadata of a site
+//     GET  /sites/{name}/cert    get the certificate of a site (PEM)
+//     GET  /sites/{name}/key     get the private key of a site (PEM)
+//     POST /sites/{name}/renew   renew the certificate of a site now
+//     POST /sites/{name}/revoke  revoke a certificate: {"reason": "..."}
+//
+// Errors are returned as JSON objects with an "error" field.
+// Requests to issue, renew or revoke never wait: if the account
+// is rate limited, they fail with 429 Too Many Requests and a
+// Retry-After header, and if the site is already being worked
+// on, with 409 Conflict.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/certs/issuance"
+)
+
+// Server serves the API.
+type Server struct {
+	Config Config
+
+	// User is the account that certificates are issued,
+	// renewed and revoked with, and its Manager's Storage
+	// is the workspace that is served. It should be the
+	// same User that renews the certificates otherwise,
+	// so that they share the account's rate limit and
+	// never work on the same site at once.
+	User *issuance.User
+}
+
+// ListenAndServe serves the API on the address in the config
+// until ctx is done, after which it shuts down gracefully.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{Addr: s.Config.Listen, Handler: s}
+
+	errChan := make(chan error, 1)
+	go func() {
+		log.Printf("[INFO] Serving API on %s", s.Config.Listen)
+		if s.Config.TLSCert != "" {
+			errChan <- srv.ListenAndServeTLS(s.Config.TLSCert, s.Config.TLSKey)
+		} else {
+			errChan <- srv.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// ServeHTTP authenticates the request and routes it.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok || !s.Config.authenticate(username, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="certsd"`)
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "sites" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			s.listSites(w, r)
+		case http.MethodPost:
+			s.issue(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+		}
+		return
+	}
+
+	name := strings.ToLower(parts[1])
+	if !validSiteName(name) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid site name: %s", parts[1]))
+		return
+	}
+
+	var action string
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	switch {
+	case r.Method == http.MethodGet && action == "":
+		s.serveFile(w, issuance.SiteMetaFile(name), "application/json")
+	case r.Method == http.MethodGet && action == "cert":
+		s.serveFile(w, issuance.SiteCertFile(name), "application/x-pem-file")
+	case r.Method == http.MethodGet && action == "key":
+		s.serveFile(w, issuance.SiteKeyFile(name), "application/x-pem-file")
+	case r.Method == http.MethodPost && action == "renew":
+		s.renew(w, r, name)
+	case r.Method == http.MethodPost && action == "revoke":
+		s.revoke(w, r, name)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) listSites(w http.ResponseWriter, r *http.Request) {
+	names, err := issuance.SiteNames(s.storage())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if names == nil {
+		names = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"sites": names})
+}
+
+func (s *Server) issue(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Names   []string `json:"names"`
+		KeyType string   `json:"key_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+		return
+	}
+
+	var names []string
+	for _, name := range req.Names {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("no names to issue a certificate for"))
+		return
+	}
+	if !validSiteName(names[0]) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid site name: %s", names[0]))
+		return
+	}
+
+	var keyType issuance.KeyType
+	if req.KeyType != "" {
+		kt, err := issuance.ParseKeyType(req.KeyType)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		keyType = kt
+	}
+
+	outcome, err := s.User.TryObtain(issuance.Bundle{Names: names, KeyType: keyType})
+	if err != nil {
+		writeCAError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"site": names[0], "outcome": string(outcome)})
+}
+
+func (s *Server) renew(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.siteExists(name) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such site: %s", name))
+		return
+	}
+
+	err := s.User.TryRenewSite(name)
+	if err != nil {
+		writeCAError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"site": name})
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.siteExists(name) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such site: %s", name))
+		return
+	}
+
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+			return
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = issuance.Unspecified.String()
+	}
+	reason, err := issuance.ParseRevocationReason(req.Reason)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = s.User.RevokeSites([]string{name}, reason)
+	if err != nil {
+		writeCAError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"site": name, "reason": reason.String()})
+}
+
+// serveFile writes the contents of file in storage
+// with the given content type.
+func (s *Server) serveFile(w http.ResponseWriter, file, contentType string) {
+	data, err := s.storage().Load(file)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// siteExists returns true if the site named name
+// has a certificate in the workspace.
+func (s *Server) siteExists(name string) bool {
+	return s.storage().Exists(issuance.SiteCertFile(name))
+}
+
+// storage returns the workspace of s.
+func (s *Server) storage() issuance.Storage {
+	return s.User.Manager().Storage
+}
+
+// validSiteName returns true if name can safely be used
+// to form a path into the workspace.
+func validSiteName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeCAError writes err, which is from an operation at the
+// CA. If the account is rate limited, the client is told when
+// to retry; if the site is busy, the client is told so.
+func writeCAError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case issuance.RateLimitError:
+		seconds := int((e.RetryAfter + time.Second - 1) / time.Second)
+		if seconds < 1 {
+			seconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		writeError(w, http.StatusTooManyRequests, err)
+	case issuance.SiteBusyError:
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeError(w, http.StatusBadGateway, err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/mholt/certs/issuance/issuancetest"
+	"github.com/xenolf/lego/acme"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestServer returns an API server backed by a user of a
+// workspace in memory, which gets its certificates from ca.
+func newTestServer(t *testing.T, ca *issuancetest.Server) (*httptest.Server, *issuance.Manager) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &issuance.Manager{
+		ServerURL: ca.DirectoryURL(),
+		Agree:     true,
+		Storage:   new(issuance.MemoryStorage),
+		KeyType:   issuance.P256,
+		Solver:    issuance.Solver{Challenges: []acme.Challenge{acme.HTTP01}, HTTPAddress: "127.0.0.1:0"},
+	}
+	user, err := m.GetUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{
+		Config: Config{Users: []UserConfig{{Username: "admin", Password: string(hash)}}},
+		User:   user,
+	}
+	return httptest.NewServer(srv), m
+}
+
+// certFrom decodes the first certificate in pemBytes.
+func certFrom(t *testing.T, pemBytes string) *x509.Certificate {
+	block, _ := pem.Decode([]byte(pemBytes))
+	if block == nil {
+		t.Fatalf("Expected a PEM certificate, got: %s", pemBytes)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func do(t *testing.T, ts *httptest.Server, method, path, body string, auth bool) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth {
+		req.SetBasicAuth("admin", "secret")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(respBody)
+}
+
+func TestServerAuthentication(t *testing.T) {
+	ca := issuancetest.NewServer()
+	defer ca.Close()
+	ts, _ := newTestServer(t, ca)
+	defer ts.Close()
+
+	if status, _ := do(t, ts, "GET", "/sites", "", false); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without credentials, got %d", http.StatusUnauthorized, status)
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/sites", nil)
+	req.SetBasicAuth("admin", "wrong")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d with wrong password, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	if status, _ := do(t, ts, "GET", "/sites", "", true); status != http.StatusOK {
+		t.Errorf("Expected status %d with credentials, got %d", http.StatusOK, status)
+	}
+}
+
+func TestServerIssueRenewAndRevoke(t *testing.T) {
+	ca := issuancetest.NewServer()
+	defer ca.Close()
+	ts, m := newTestServer(t, ca)
+	defer ts.Close()
+
+	status, body := do(t, ts, "GET", "/sites", "", true)
+	if status != http.StatusOK || strings.TrimSpace(body) != `{"sites":[]}` {
+		t.Errorf("Expected empty site list, got %d: %s", status, body)
+	}
+
+	status, body = do(t, ts, "POST", "/sites", `{"names": ["Example.com", "www.example.com"], "key_type": "P256"}`, true)
+	if status != http.StatusOK || !strings.Contains(body, `"outcome":"obtained"`) {
+		t.Fatalf("Expected status %d issuing, got %d: %s", http.StatusOK, status, body)
+	}
+	if len(ca.Issued()) != 1 {
+		t.Fatalf("Expected the CA to issue 1 certificate, got %d", len(ca.Issued()))
+	}
+
+	status, body = do(t, ts, "GET", "/sites", "", true)
+	var list struct{ Sites []string }
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatalf("Decoding site list: %v", err)
+	}
+	if status != http.StatusOK || !reflect.DeepEqual(list.Sites, []string{"example.com"}) {
+		t.Errorf("Expected site list with example.com, got %d: %s", status, body)
+	}
+
+	status, body = do(t, ts, "GET", "/sites/example.com/cert", "", true)
+	if status != http.StatusOK {
+		t.Fatalf("Expected status %d getting certificate, got %d: %s", http.StatusOK, status, body)
+	}
+	cert := certFrom(t, body)
+	if !reflect.DeepEqual(cert.DNSNames, []string{"example.com", "www.example.com"}) || cert.SerialNumber.Cmp(ca.Issued()[0].SerialNumber) != 0 {
+		t.Errorf("Expected the certificate issued by the CA for both names, got %v", cert.DNSNames)
+	}
+	if status, body := do(t, ts, "GET", "/sites/example.com/key", "", true); status != http.StatusOK || !strings.Contains(body, "PRIVATE KEY") {
+		t.Errorf("Expected private key, got %d: %s", status, body)
+	}
+	if status, body := do(t, ts, "GET", "/sites/example.com", "", true); status != http.StatusOK || !strings.Contains(body, "me@example.com") {
+		t.Errorf("Expected metadata with the account, got %d: %s", status, body)
+	}
+
+	// issuing the same names again does nothing
+	status, body = do(t, ts, "POST", "/sites", `{"names": ["example.com", "www.example.com"]}`, true)
+	if status != http.StatusOK || !strings.Contains(body, `"outcome":"skipped"`) || len(ca.Issued()) != 1 {
+		t.Errorf("Expected existing certificate to be skipped, got %d: %s", status, body)
+	}
+
+	if status, body := do(t, ts, "POST", "/sites/example.com/renew", "", true); status != http.StatusOK {
+		t.Errorf("Expected status %d renewing, got %d: %s", http.StatusOK, status, body)
+	}
+	if len(ca.Issued()) != 2 {
+		t.Errorf("Expected the CA to issue a certificate for the renewal, got %d in all", len(ca.Issued()))
+	}
+	_, body = do(t, ts, "GET", "/sites/example.com/cert", "", true)
+	renewed := certFrom(t, body)
+	if renewed.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Error("Expected renewed certificate to be saved, but the old one is still there")
+	}
+
+	if status, body := do(t, ts, "POST", "/sites/example.com/revoke", `{"reason": "keyCompromise"}`, true); status != http.StatusOK {
+		t.Errorf("Expected status %d revoking, got %d: %s", http.StatusOK, status, body)
+	}
+	if reason, ok := ca.RevocationReason(renewed); !ok || reason != int(issuance.KeyCompromise) || ca.Revoked(cert) {
+		t.Errorf("Expected the CA to revoke the current certificate, and only that one, for key compromise; got reason %d (revoked: %v)", reason, ok)
+	}
+	if status, body := do(t, ts, "POST", "/sites/example.com/renew", "", true); status != http.StatusBadGateway {
+		t.Errorf("Expected status %d renewing a revoked certificate, got %d: %s", http.StatusBadGateway, status, body)
+	}
+
+	if status, _ := do(t, ts, "POST", "/sites/example.com/revoke", `{"reason": "bogus"}`, true); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d with invalid reason, got %d", http.StatusBadRequest, status)
+	}
+	if status, _ := do(t, ts, "POST", "/sites/nope.com/renew", "", true); status != http.StatusNotFound {
+		t.Errorf("Expected status %d renewing missing site, got %d", http.StatusNotFound, status)
+	}
+	if status, _ := do(t, ts, "GET", "/sites/nope.com/cert", "", true); status != http.StatusNotFound {
+		t.Errorf("Expected status %d for missing site, got %d", http.StatusNotFound, status)
+	}
+	if status, _ := do(t, ts, "GET", "/sites/..%2fusers/key", "", true); status == http.StatusOK {
+		t.Error("Expected request outside of the sites folder to fail, but it succeeded")
+	}
+	if status, _ := do(t, ts, "POST", "/sites", `{"names": ["example.com"], "key_type": "dsa"}`, true); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for unknown key type, got %d", http.StatusBadRequest, status)
+	}
+	if status, _ := do(t, ts, "POST", "/sites", `{"names": []}`, true); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d issuing without names, got %d", http.StatusBadRequest, status)
+	}
+	if !m.Storage.Exists(issuance.SiteCertFile("example.com")) {
+		t.Error("Expected the certificate to stay in the workspace after revoking")
+	}
+}
+
+func TestServerDoesNotWaitForRateLimit(t *testing.T) {
+	ca := issuancetest.NewServer()
+	defer ca.Close()
+	ts, _ := newTestServer(t, ca)
+	defer ts.Close()
+
+	ca.FailNext(issuancetest.NewCert, issuancetest.ServerError, 1)
+	if status, body := do(t, ts, "POST", "/sites", `{"names": ["example.com"]}`, true); status != http.StatusBadGateway {
+		t.Errorf("Expected status %d when the CA fails, got %d: %s", http.StatusBadGateway, status, body)
+	}
+
+	ca.FailNext(issuancetest.NewCert, issuancetest.RateLimited, 1)
+	req, err := http.NewRequest("POST", ts.URL+"/sites", strings.NewReader(`{"names": ["example.com"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("admin", "secret")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Expected a response right away when rate limited, got: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("Expected status %d with Retry-After, got %d and '%s'", http.StatusTooManyRequests, resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// while the account is paused, the CA isn't even asked
+	requests := ca.Requests(issuancetest.NewCert)
+	if status, body := do(t, ts, "POST", "/sites", `{"names": ["example.org"]}`, true); status != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d while paused, got %d: %s", http.StatusTooManyRequests, status, body)
+	}
+	if ca.Requests(issuancetest.NewCert) != requests {
+		t.Error("Expected no request to the CA while the account is paused")
+	}
+}
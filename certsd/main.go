@@ -0,0 +1,210 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command certsd is a long-running process that keeps the
+// certificates in a workspace renewed.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mholt/certs/api"
+	"github.com/mholt/certs/issuance"
+	"github.com/xenolf/lego/acme"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func main() {
+	acme.UserAgent = "certsd/0.1.0"
+
+	var (
+		ca          = flag.String("ca", "https://acme-staging.api.letsencrypt.org/directory", "URL of directory for ACME server")
+		email       = flag.String("email", "", "Email address of the account to renew certificates with")
+		out         = flag.String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+		agree       = flag.Bool("agree", false, "Indicate your agreement to CA's legal terms")
+		logFile     = flag.String("log", "", "File to write the log to (default stderr)")
+		days        = flag.Int("days", issuance.DefaultRenewDays, "Renew certificates expiring within this many days")
+		interval    = flag.Duration("interval", 12*time.Hour, "How often to scan for certificates to renew")
+		jitter      = flag.Duration("jitter", 5*time.Minute, "Maximum random delay before each renewal")
+		grace       = flag.Duration("grace", 30*time.Second, "How long to wait for a renewal in progress when shutting down")
+		conf        = flag.String("conf", "", "API config file (default certsd.conf, if it exists)")
+		keyType     = flag.String("key-type", string(issuance.DefaultKeyType), "Type of new private keys for accounts and certificates without a key")
+		keyFile     = flag.String("master-key-file", "", "File with the secret that encrypts private keys (default $"+issuance.PassphraseEnv+")")
+		challenges  = flag.String("challenges", "", "Comma-separated challenge types to allow: http-01, tls-sni-01, dns-01 (default all)")
+		httpAddress = flag.String("http-address", "", "Interface and port to bind to for the http-01 challenge (default :80)")
+		tlsAddress  = flag.String("tls-address", "", "Interface and port to bind to for the tls-sni-01 challenge (default :443)")
+		webroot     = flag.String("webroot", "", "Document root of a web server on port 80 to solve the http-01 challenge with, instead of binding a port")
+		dnsProvider = flag.String("dns-provider", "", "DNS provider to solve the dns-01 challenge with: exec or rfc2136")
+		dnsExec     = flag.String("dns-exec", "", "Script the exec DNS provider runs with present or cleanup, FQDN, value and TTL")
+		dnsServer   = flag.String("dns-nameserver", "", "Nameserver the rfc2136 DNS provider sends updates to")
+		dnsZone     = flag.String("dns-zone", "", "Zone the rfc2136 DNS provider updates (default the zone of each record)")
+		tsigKey     = flag.String("dns-tsig-key", "", "Name of the TSIG key to sign DNS updates with")
+		tsigAlg     = flag.String("dns-tsig-algorithm", "hmac-sha256", "Algorithm of the TSIG key: hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512")
+		tsigSecret  = flag.String("dns-tsig-secret-file", "", "File with the secret of the TSIG key (default $"+issuance.TSIGSecretEnv+")")
+		dnsWait     = flag.Duration("dns-propagation-wait", 0, "How long to wait after setting a DNS record before checking it")
+		dnsTimeout  = flag.Duration("dns-timeout", issuance.DefaultDNSTimeout, "How long to wait for a DNS record to propagate")
+		hashpw      = flag.Bool("hashpw", false, "Read a password from stdin, print its hash for the config file, and exit")
+	)
+	flag.Parse()
+
+	if *hashpw {
+		printPasswordHash()
+		return
+	}
+
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("[ERROR] Opening log file: %v", err)
+		}
+		defer f.Close()
+		log.SetOutput(f)
+	}
+
+	secret, err := issuance.ReadSecret(*keyFile)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	storage, err := issuance.OpenWorkspace(*out, secret)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	kt, err := issuance.ParseKeyType(*keyType)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	solver := issuance.Solver{HTTPAddress: *httpAddress, TLSAddress: *tlsAddress, Webroot: *webroot}
+	solver.Challenges, err = issuance.ParseChallenges(*challenges)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if *dnsProvider != "" {
+		solver.DNS = &issuance.DNSConfig{
+			Provider:        *dnsProvider,
+			Exec:            *dnsExec,
+			PropagationWait: *dnsWait,
+			Timeout:         *dnsTimeout,
+			Nameserver:      *dnsServer,
+			Zone:            *dnsZone,
+			TSIGKey:         *tsigKey,
+			TSIGSecretFile:  *tsigSecret,
+		}
+		if *tsigKey != "" {
+			solver.DNS.TSIGAlgorithm = *tsigAlg
+		}
+	}
+	if err := solver.Validate(); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	manager := &issuance.Manager{
+		ServerURL: *ca,
+		Agree:     *agree,
+		Storage:   storage,
+		KeyType:   kt,
+		Solver:    solver,
+	}
+
+	user, err := manager.GetUser(*email)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	var apiServer *api.Server
+	if *conf == "" {
+		if _, err := os.Stat(defaultConf); err == nil {
+			*conf = defaultConf
+		}
+	}
+	if *conf != "" {
+		cfg, err := api.LoadConfig(*conf)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		// the API shares the user with the maintainer, so that
+		// both pause when the account is rate limited, and they
+		// never work on the same site at once
+		apiServer = &api.Server{Config: cfg, User: user}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-sigchan
+		log.Printf("[INFO] Received %v; shutting down", sig)
+		cancel()
+	}()
+
+	m := &issuance.Maintainer{
+		User:            user,
+		Days:            *days,
+		Interval:        *interval,
+		Jitter:          *jitter,
+		ShutdownTimeout: *grace,
+	}
+
+	var wg sync.WaitGroup
+	if apiServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := apiServer.ListenAndServe(ctx); err != nil {
+				log.Printf("[ERROR] API: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	if err := m.Run(ctx); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	cancel()
+	wg.Wait()
+	log.Println("[INFO] Stopped")
+}
+
+// printPasswordHash reads a password from the first line of
+// stdin and prints its bcrypt hash, for use in the config file.
+func printPasswordHash() {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatalf("[ERROR] Reading password: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		log.Fatal("[ERROR] Password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	fmt.Println(string(hash))
+}
+
+// defaultConf is the API config file that is
+// loaded if it exists and --conf is not set.
+const defaultConf = "certsd.conf"
@@ -0,0 +1,156 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export <name>",
+	Short: "Export a certificate in other formats",
+	Long: `The export command writes the certificate of a site in the
+workspace (customized with --out) in the format given with
+--format, to the file given with --to or to stdout. The name
+may be the site itself or any other name on its certificate.
+
+The formats are:
+
+    pkcs12     key, certificate and chain in a password-protected
+               PKCS#12 file, for Java (keytool) and Windows
+    der        the certificate alone, DER-encoded
+    leaf       the certificate alone, PEM-encoded
+    chain      the chain without the certificate, PEM-encoded
+    fullchain  the certificate and the chain, PEM-encoded
+    combined   the key, certificate and chain, PEM-encoded,
+               as HAProxy expects
+
+The pkcs12 password is read from the file given with
+--password-file, or from $` + exportPasswordEnv + `.
+
+With --save, the export is also added to the site's settings,
+so the file is written again each time the certificate is
+renewed. Saved pkcs12 exports read their password from the
+--password-file each time; the password is never stored in
+the workspace.`,
+	Run: runExport,
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("[ERROR] give exactly one name to export")
+	}
+
+	formatName, err := cmd.Flags().GetString("format")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	format, err := issuance.ParseExportFormat(formatName)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	passwordFile, err := cmd.Flags().GetString("password-file")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	save, err := cmd.Flags().GetBool("save")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if save && to == "" {
+		log.Fatal("[ERROR] --save needs a file to export to; use --to")
+	}
+	if save && format == issuance.ExportPKCS12 && passwordFile == "" {
+		log.Fatal("[ERROR] saved pkcs12 exports need a --password-file to read the password from")
+	}
+
+	password := os.Getenv(exportPasswordEnv)
+	if passwordFile != "" {
+		password, err = issuance.ReadPassword(passwordFile)
+		if err != nil {
+			log.Fatalf("[ERROR] Reading password: %v", err)
+		}
+	}
+
+	storage, err := openWorkspace(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	m := &issuance.Manager{Storage: storage}
+
+	site, err := m.SiteFor(args[0])
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if to == "" {
+		data, err := m.ExportSite(site, format, password)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		os.Stdout.Write(data)
+		return
+	}
+	to, err = filepath.Abs(to)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	err = m.WriteExport(site, format, to, password)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	log.Printf("[INFO][%s] Exported %s as %s", site, to, format)
+
+	if save {
+		if passwordFile != "" {
+			passwordFile, err = filepath.Abs(passwordFile)
+			if err != nil {
+				log.Fatalf("[ERROR] %v", err)
+			}
+		}
+		err = m.AddExport(site, issuance.Export{Format: format, Path: to, PasswordFile: passwordFile})
+		if err != nil {
+			log.Fatalf("[ERROR] Saving export: %v", err)
+		}
+		log.Printf("[INFO][%s] %s will be exported again on each renewal", site, to)
+	}
+}
+
+// exportPasswordEnv is the environment variable that
+// holds the password of pkcs12 exports.
+const exportPasswordEnv = "CERTS_EXPORT_PASSWORD"
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+
+	exportCmd.Flags().String("format", string(issuance.ExportFullchain), "Format: pkcs12, der, leaf, chain, fullchain, or combined")
+	exportCmd.Flags().String("to", "", "File to export to (default stdout)")
+	exportCmd.Flags().String("password-file", "", "File with the password of pkcs12 exports (default $"+exportPasswordEnv+")")
+	exportCmd.Flags().Bool("save", false, "Export to the same file each time the certificate is renewed")
+	exportCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+	addWorkspaceFlags(exportCmd)
+}
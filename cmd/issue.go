@@ -18,6 +18,7 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strings"
@@ -28,7 +29,7 @@ import (
 
 // issueCmd represents the issue command
 var issueCmd = &cobra.Command{
-	Use:   "issue",
+	Use:   "issue [input file]",
 	Short: "Issue new certificates in bulk",
 	Long: `The issue command will obtain new certificates according to an
 input file. The input file may be in text or CSV format.
@@ -40,22 +41,120 @@ certificate, and all others will be SubjectAltName entries.
 
 Certificates are stored with the associated private key in a
 folder in the workspace (customized with --out) in a subfolder
-named after the Common Name on the certificate. If a cert with
-the same Common Name already exists in the workspace, that
-certificate will be skipped, even if its SAN entries differ.`,
+named after the Common Name on the certificate. If a cert for
+exactly the same names already exists in the workspace, that
+certificate will be skipped; if its SAN entries differ, it is
+issued again and replaces the old one. Use --force to issue
+certificates again regardless.
+
+To issue a single certificate instead, name its domains with -d
+(repeat it for each domain) or give a certificate signing request
+with -c, in which case the names are taken from the CSR. To use
+an existing private key rather than generate one, give it with -k.
+The certificate is stored in the workspace like any other, and the
+PEM bundle is also written to stdout. When it is renewed, the key
+or CSR you supplied is reused.
+
+For full control over each certificate, give a job file with
+--json or --yaml instead. Each entry in the file names one
+certificate and may choose its key type, key or CSR, account,
+CA, challenges, where copies of the certificate are written,
+and commands to run after it is issued. The whole file is
+checked before anything is issued, and every problem found
+is reported with its line.
+
+By default, any challenge type may be solved, with the http-01
+challenge on port 80 and tls-sni-01 on port 443. Limit the types
+with --challenges, like --challenges http-01,dns-01, and choose
+the interface and port to bind to with --http-address and
+--tls-address, for example when a load balancer forwards port
+80 to this machine's port 5002. If a web server already listens
+on port 80, give its document root with --webroot instead, and
+the http-01 challenge is solved by writing files into its
+.well-known/acme-challenge folder. The dns-01 challenge needs
+a DNS provider, chosen with --dns-provider: the exec provider
+runs the script given with --dns-exec with "present" or
+"cleanup", then the FQDN, value and TTL of the TXT record, and
+the rfc2136 provider sends dynamic updates to --dns-nameserver,
+signed with the TSIG key named by --dns-tsig-key.
+Entries of a job file may choose their own settings, including
+a webroot for each name, which take precedence.
+
+New private keys, for certificates as well as for a new account,
+are of the type chosen with --key-type: RSA with 2048, 3072, or
+4096 bits, or ECDSA with the P-256 or P-384 curve.
+
+Use --concurrency to obtain several certificates at once. All
+of them share the account's rate limit: if the CA says the
+account is rate limited, every worker pauses until it is time
+to try again. Workers solving http-01 or tls-sni-01 challenges
+by binding a port take turns at it, so concurrency is most
+useful with --webroot or dns-01.
+
+By default, no more certificates are started once one fails.
+With --keep-going, the failure is recorded and the rest are
+still attempted. Either way, a summary of the certificates that
+were obtained, skipped, and failed is printed at the end, and
+the exit status is non-zero only if any failed.
+
+With --drop-failed-names, a certificate whose SubjectAltNames
+fail validation is obtained without them instead, as long as
+its Common Name validates. The names that were dropped are
+listed in the summary and recorded with the certificate, and
+renew --drop-failed-names tries to add them back.
+
+Each run from an input file or job file is recorded as a job
+in the workspace, with the state of each certificate. If a job
+is interrupted, resume it with --resume and its ID, which is
+logged when it starts; the certificates that were not obtained
+or skipped yet, including those that failed, are tried again
+with the same settings. The key type, challenge and DNS flags,
+--drop-failed-names and --force are taken from the job, so they
+cannot be given with --resume. List past jobs with: certs jobs`,
 	Run: runIssue,
 }
 
 func runIssue(cmd *cobra.Command, args []string) {
-	if len(args) != 1 {
-		log.Fatal("missing argument: input file with list of domains")
+	jobFile, err := jobFileFlag(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	resume, err := cmd.Flags().GetString("resume")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if resume != "" {
+		if len(args) > 0 || jobFile != "" {
+			log.Fatal("[ERROR] an input file cannot be used with --resume")
+		}
+		resumeJob(cmd, resume)
+		return
+	}
+
+	if jobFile != "" {
+		if len(args) > 0 {
+			log.Fatal("[ERROR] an input file cannot be used with --json or --yaml")
+		}
+		issueJob(cmd, jobFile)
+		return
 	}
 
-	workspaceDir, err := cmd.Flags().GetString("out")
+	single, err := singleBundle(cmd)
 	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
-	issuance.Workspace = issuance.Storage(workspaceDir)
+	if single != nil {
+		if len(args) > 0 {
+			log.Fatal("[ERROR] an input file cannot be used with -d or -c")
+		}
+		issueSingle(cmd, *single)
+		return
+	}
+
+	if len(args) != 1 {
+		log.Fatal("missing argument: input file with list of domains")
+	}
 
 	delim, err := cmd.Flags().GetString("delim")
 	if err != nil {
@@ -83,31 +182,343 @@ func runIssue(cmd *cobra.Command, args []string) {
 
 	log.Printf("[INFO] Obtaining %d certificates for %d domains\n", len(domainList), len(domainMap))
 
-	ca, err := cmd.Flags().GetString("ca")
+	m, email, err := loadManager(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	err = setBulkOptions(cmd, m)
 	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
-	issuance.ServerURL = ca
 
-	agree, err := cmd.Flags().GetBool("agree")
+	var entries []issuance.JobEntry
+	for _, domains := range domainList {
+		entries = append(entries, issuance.JobEntry{
+			Email:  email,
+			CA:     m.ServerURL,
+			Bundle: issuance.Bundle{Names: domains},
+		})
+	}
+	startJob(m, args[0], entries)
+}
+
+// setBulkOptions configures m for a bulk run according
+// to the flags of the issue command, including how
+// challenges are solved.
+func setBulkOptions(cmd *cobra.Command, m *issuance.Manager) error {
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+	keepGoing, err := cmd.Flags().GetBool("keep-going")
+	if err != nil {
+		return err
+	}
+	dropFailedNames, err := cmd.Flags().GetBool("drop-failed-names")
+	if err != nil {
+		return err
+	}
+	force, err := cmd.Flags().GetBool("force")
+	if err != nil {
+		return err
+	}
+	m.Concurrency = concurrency
+	m.KeepGoing = keepGoing
+	m.DropFailedNames = dropFailedNames
+	m.Force = force
+	return setSolver(cmd, m)
+}
+
+// reportSummary prints summary, the outcome of a bulk run that
+// ended with err, and exits with an error status if anything
+// failed.
+func reportSummary(summary issuance.Summary, err error) {
+	fmt.Println(summary)
+	for _, result := range summary.Results {
+		if len(result.Dropped) > 0 {
+			fmt.Printf("dropped from %s: %s\n", strings.Join(result.Names, ","), strings.Join(result.Dropped, ","))
+		}
+	}
+	for _, result := range summary.Failures() {
+		fmt.Printf("failed %s: %s\n", strings.Join(result.Names, ","), result.Error)
+	}
 	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
-	issuance.Agree = agree
+	if summary.Count(issuance.Failed) > 0 {
+		os.Exit(1)
+	}
+}
 
-	email, err := cmd.Flags().GetString("email")
+// singleBundle returns the bundle described by the -d, -k, and
+// -c flags, or nil if neither -d nor -c was used.
+func singleBundle(cmd *cobra.Command) (*issuance.Bundle, error) {
+	domains, err := cmd.Flags().GetStringArray("domain")
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := cmd.Flags().GetString("key")
+	if err != nil {
+		return nil, err
+	}
+	csrFile, err := cmd.Flags().GetString("csr")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(domains) == 0 && csrFile == "" {
+		if keyFile != "" {
+			return nil, fmt.Errorf("-k requires domains to be given with -d")
+		}
+		return nil, nil
+	}
+
+	var bundle issuance.Bundle
+	for _, domain := range domains {
+		domain = strings.TrimSpace(strings.ToLower(domain))
+		if domain != "" {
+			bundle.Names = append(bundle.Names, domain)
+		}
+	}
+
+	if csrFile != "" {
+		if len(bundle.Names) > 0 || keyFile != "" {
+			return nil, fmt.Errorf("-c cannot be used with -d or -k; the names and key come from the CSR")
+		}
+		csrBytes, err := ioutil.ReadFile(csrFile)
+		if err != nil {
+			return nil, err
+		}
+		bundle.CSR, err = issuance.ParseCSR(csrBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", csrFile, err)
+		}
+		return &bundle, nil
+	}
+
+	if len(bundle.Names) == 0 {
+		return nil, fmt.Errorf("no domains given with -d")
+	}
+	if keyFile != "" {
+		keyBytes, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		bundle.Key, err = issuance.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", keyFile, err)
+		}
+	}
+	return &bundle, nil
+}
+
+// issueSingle obtains a certificate for bundle and writes
+// its PEM bundle (with the private key, if it is in the
+// workspace) to stdout.
+func issueSingle(cmd *cobra.Command, bundle issuance.Bundle) {
+	user, err := loadUser(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	err = setBulkOptions(cmd, user.Manager())
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	if err := user.ObtainBundles([]issuance.Bundle{bundle}); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	site := bundle.Site()
+	if site == "" {
+		log.Fatal("[ERROR] no names to issue a certificate for")
+	}
+
+	storage := user.Manager().Storage
+	certBytes, err := storage.Load(issuance.SiteCertFile(site))
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	os.Stdout.Write(certBytes)
+	if keyBytes, err := storage.Load(issuance.SiteKeyFile(site)); err == nil {
+		os.Stdout.Write(keyBytes)
+	}
+}
+
+// jobFileFlag returns the job file given with
+// --json or --yaml, or "" if there is none.
+func jobFileFlag(cmd *cobra.Command) (string, error) {
+	jsonFile, err := cmd.Flags().GetString("json")
+	if err != nil {
+		return "", err
+	}
+	yamlFile, err := cmd.Flags().GetString("yaml")
+	if err != nil {
+		return "", err
+	}
+	if jsonFile != "" && yamlFile != "" {
+		return "", fmt.Errorf("--json and --yaml cannot be used together")
+	}
+	if jsonFile != "" {
+		return jsonFile, nil
+	}
+	return yamlFile, nil
+}
+
+// issueJob obtains the certificates described by the
+// job file filename. The whole file is validated first;
+// if it has any errors, they are all reported and nothing
+// is issued. Entries that don't name an account or CA use
+// the ones chosen with the flags.
+func issueJob(cmd *cobra.Command, filename string) {
+	entries, err := issuance.LoadJobFile(filename)
+	if errs, ok := err.(issuance.JobFileErrors); ok {
+		for _, e := range errs {
+			log.Printf("[ERROR] %v", e)
+		}
+		log.Fatalf("[ERROR] %s: %d problem(s); no certificates were issued", filename, len(errs))
+	}
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if cmd.Flags().Changed("domain") || cmd.Flags().Changed("key") || cmd.Flags().Changed("csr") {
+		log.Fatal("[ERROR] -d, -k, and -c cannot be used with a job file")
+	}
+
+	defaults, defaultEmail, err := loadManager(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	err = setBulkOptions(cmd, defaults)
 	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
 
-	user, err := issuance.GetUser(email)
+	// entries that don't choose an account or CA use the
+	// defaults, which are recorded in case it is resumed
+	for i := range entries {
+		if entries[i].CA == "" {
+			entries[i].CA = defaults.ServerURL
+		}
+		if entries[i].Email == "" {
+			entries[i].Email = defaultEmail
+		}
+	}
+	startJob(defaults, filename, entries)
+}
+
+// resumeJob resumes the job with the given id, obtaining
+// the certificates that it did not obtain or skip before.
+func resumeJob(cmd *cobra.Command, id string) {
+	if cmd.Flags().Changed("domain") || cmd.Flags().Changed("key") || cmd.Flags().Changed("csr") {
+		log.Fatal("[ERROR] -d, -k, and -c cannot be used with --resume")
+	}
+
+	m, _, err := loadManager(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	err = setBulkOptions(cmd, m)
 	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
 
-	if err := user.ObtainCerts(domainList); err != nil {
+	job, err := m.LoadJob(id)
+	if os.IsNotExist(err) {
+		log.Fatalf("[ERROR] No job %s in the workspace; see: certs jobs", id)
+	}
+	if err != nil {
 		log.Fatalf("[ERROR] %v", err)
 	}
+	if job.Options != nil {
+		for _, flag := range jobOptionFlags {
+			if cmd.Flags().Changed(flag) {
+				log.Fatalf("[ERROR] --%s cannot be used with --resume; job %s is resumed with the options it was started with", flag, job.ID)
+			}
+		}
+		job.Restore(m)
+	}
+
+	indexes := job.Unfinished()
+	if len(indexes) == 0 {
+		log.Printf("[INFO] Job %s is already finished", job.ID)
+		return
+	}
+	log.Printf("[INFO] Resuming job %s: %d of %d certificates left", job.ID, len(indexes), len(job.Bundles))
+	runJob(m, job, indexes)
+}
+
+// jobOptionFlags are the flags that set the options recorded
+// with a job, which can't be changed when it is resumed.
+var jobOptionFlags = []string{
+	"key-type", "drop-failed-names", "force",
+	"challenges", "http-address", "tls-address", "webroot",
+	"dns-provider", "dns-exec", "dns-nameserver", "dns-zone",
+	"dns-tsig-key", "dns-tsig-algorithm", "dns-tsig-secret-file",
+	"dns-propagation-wait", "dns-timeout",
+}
+
+// startJob creates a job for entries in the workspace of m,
+// which came from input, and runs it.
+func startJob(m *issuance.Manager, input string, entries []issuance.JobEntry) {
+	job, err := m.NewJob(input, entries)
+	if err != nil {
+		log.Fatalf("[ERROR] Creating job: %v", err)
+	}
+	log.Printf("[INFO] Started job %s; if it is interrupted, resume it with: certs issue --resume %s", job.ID, job.ID)
+	runJob(m, job, job.Unfinished())
+}
+
+// runJob obtains the certificates of job at indexes, with
+// the account and CA of each, then reports the summary and
+// exits with an error status if any failed. defaults is the
+// Manager for the workspace and the bulk options.
+func runJob(defaults *issuance.Manager, job *issuance.Job, indexes []int) {
+	// group the bundles by account, keeping the order
+	// in which each account first appears in the job
+	type account struct{ ca, email string }
+	var accounts []account
+	byAccount := make(map[account][]int)
+	for _, i := range indexes {
+		acct := account{ca: job.Bundles[i].CA, email: job.Bundles[i].Email}
+		if acct.ca == "" {
+			acct.ca = defaults.ServerURL
+		}
+		if _, ok := byAccount[acct]; !ok {
+			accounts = append(accounts, acct)
+		}
+		byAccount[acct] = append(byAccount[acct], i)
+	}
+
+	log.Printf("[INFO] Obtaining %d certificates with %d account(s)", len(indexes), len(accounts))
+
+	var summary issuance.Summary
+	for _, acct := range accounts {
+		m := *defaults
+		m.ServerURL = acct.ca
+		user, err := m.GetUser(acct.email)
+		if err != nil {
+			err = fmt.Errorf("%s at %s: %v", acct.email, acct.ca, err)
+			if !m.KeepGoing {
+				reportSummary(summary, err)
+			}
+			log.Printf("[ERROR] %v", err)
+			for _, i := range byAccount[acct] {
+				summary.Results = append(summary.Results, issuance.BundleResult{
+					Names:   job.Bundles[i].Names,
+					Outcome: issuance.Failed,
+					Error:   err.Error(),
+				})
+			}
+			continue
+		}
+		s, err := user.ObtainJob(job, byAccount[acct])
+		summary.Results = append(summary.Results, s.Results...)
+		if err != nil {
+			reportSummary(summary, err)
+		}
+	}
+	reportSummary(summary, nil)
 }
 
 // loadDomains loads a list of domain names from filename, separated
@@ -200,11 +611,19 @@ func init() {
 	// is called directly, e.g.:
 	//issueCmd.Flags().String("addwww", "", "Ensure www variant is added for every domain")
 	issueCmd.Flags().String("delim", defaultDelimiter, "Delimiter")
-	issueCmd.Flags().String("ca", "https://acme-staging.api.letsencrypt.org/directory", "URL of directory for ACME server")
-	issueCmd.Flags().String("email", "", "Email address to register with CA for account recovery")
-	issueCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which to store assets")
-	issueCmd.Flags().Bool("agree", false, "Indicate your agreement to CA's legal terms")
+	issueCmd.Flags().StringArrayP("domain", "d", nil, "Domain to issue a single certificate for (repeatable)")
+	issueCmd.Flags().StringP("key", "k", "", "Existing private key to use for the certificate (PEM)")
+	issueCmd.Flags().StringP("csr", "c", "", "Certificate signing request to issue a certificate for (PEM or DER)")
+	issueCmd.Flags().String("json", "", "Job file describing each certificate to issue (JSON)")
+	issueCmd.Flags().String("yaml", "", "Job file describing each certificate to issue (YAML)")
+	addAccountFlags(issueCmd)
+	addSolverFlags(issueCmd)
 	issueCmd.Flags().Bool("skip-duplicates", false, "Ignore repeated appearances of a domain name")
+	issueCmd.Flags().Int("concurrency", 1, "How many certificates to obtain at once")
+	issueCmd.Flags().Bool("keep-going", false, "Go on to the other certificates when one fails")
+	issueCmd.Flags().Bool("drop-failed-names", false, "Retry certificates without the SANs that fail validation")
+	issueCmd.Flags().BoolP("force", "f", false, "Issue certificates even if the workspace has them already")
+	issueCmd.Flags().String("resume", "", "ID of an interrupted job to resume (see: certs jobs)")
 }
 
 const defaultDelimiter = ","
@@ -0,0 +1,98 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// jobsCmd represents the jobs command
+var jobsCmd = &cobra.Command{
+	Use:   "jobs [job ID]",
+	Short: "List bulk issuance jobs",
+	Long: `The jobs command lists the jobs that were run by the issue
+command in the workspace (customized with --out), with how
+many of their certificates are in each state.
+
+Given the ID of a job, it lists the certificates of that job
+instead, with the state of each and the error of those that
+failed. A job that did not finish can be resumed with:
+
+    certs issue --resume <job ID>`,
+	Run: runJobs,
+}
+
+func runJobs(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		log.Fatal("[ERROR] too many arguments; give at most one job ID")
+	}
+
+	storage, err := openWorkspace(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	m := &issuance.Manager{Storage: storage}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if len(args) == 1 {
+		job, err := m.LoadJob(args[0])
+		if os.IsNotExist(err) {
+			log.Fatalf("[ERROR] No job %s in the workspace", args[0])
+		}
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		fmt.Fprintln(w, "#\tNAMES\tSTATE\tERROR")
+		for i, b := range job.Bundles {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i, strings.Join(b.Names, ","), b.State, b.Error)
+		}
+		return
+	}
+
+	jobs, err := m.Jobs()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	fmt.Fprintln(w, "ID\tSTARTED\tUPDATED\tINPUT\tTOTAL\tSUCCEEDED\tSKIPPED\tFAILED\tUNFINISHED")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n",
+			job.ID,
+			job.Started.Local().Format(time.RFC822),
+			job.Updated.Local().Format(time.RFC822),
+			job.Input,
+			len(job.Bundles),
+			job.Count(issuance.JobSucceeded),
+			job.Count(issuance.JobSkipped),
+			job.Count(issuance.JobFailed),
+			len(job.Unfinished())-job.Count(issuance.JobFailed))
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(jobsCmd)
+
+	jobsCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+	addWorkspaceFlags(jobsCmd)
+}
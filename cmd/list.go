@@ -0,0 +1,162 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List certificates in the workspace",
+	Long: `The list command lists the certificates in the workspace
+(customized with --out), read from the certificate and
+metadata files of each site.
+
+The list can be narrowed down with filters, which must all
+match: --expiring lists certificates that expire within that
+many days (or have expired), --account those obtained by an
+account, --issuer those whose issuer's name contains a string,
+--name those with a name that matches a glob like *.example.com,
+and --revoked only those that were revoked.
+
+The --format flag chooses the output: a table (the default),
+json, or csv for spreadsheets.`,
+	Run: runList,
+}
+
+func runList(cmd *cobra.Command, args []string) {
+	var filter issuance.ListFilter
+	var err error
+	filter.ExpiringDays, err = cmd.Flags().GetInt("expiring")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	filter.Account, err = cmd.Flags().GetString("account")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	filter.Issuer, err = cmd.Flags().GetString("issuer")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	filter.Name, err = cmd.Flags().GetString("name")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	filter.Revoked, err = cmd.Flags().GetBool("revoked")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if format != "table" && format != "json" && format != "csv" {
+		log.Fatalf("[ERROR] Unknown format '%s'; use table, json, or csv", format)
+	}
+
+	storage, err := openWorkspace(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	m := &issuance.Manager{Storage: storage}
+
+	sites, err := m.ListSites(filter)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	switch format {
+	case "json":
+		if sites == nil {
+			sites = []issuance.SiteInfo{}
+		}
+		jsonBytes, err := json.MarshalIndent(sites, "", "\t")
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		fmt.Println(string(jsonBytes))
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"site", "names", "dropped", "serial", "issuer", "not_before", "not_after", "account", "status"})
+		for _, s := range sites {
+			w.Write([]string{
+				s.Site,
+				strings.Join(s.Names, " "),
+				strings.Join(s.Dropped, " "),
+				s.Serial,
+				s.Issuer,
+				formatTime(s.NotBefore, time.RFC3339),
+				formatTime(s.NotAfter, time.RFC3339),
+				s.Account,
+				string(s.Status),
+			})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SITE\tNAMES\tISSUER\tEXPIRES\tSTATUS\tACCOUNT")
+		for _, s := range sites {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.Site,
+				strings.Join(s.Names, ","),
+				s.Issuer,
+				formatTime(s.NotAfter.Local(), "2006-01-02 15:04"),
+				s.Status,
+				s.Account)
+		}
+		w.Flush()
+	}
+}
+
+// formatTime formats t with layout, or returns
+// an empty string if t is the zero time.
+func formatTime(t time.Time, layout string) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(layout)
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().Int("expiring", 0, "List only certificates that expire within this many days")
+	listCmd.Flags().String("account", "", "List only certificates obtained by the account with this email address")
+	listCmd.Flags().String("issuer", "", "List only certificates whose issuer's name contains this")
+	listCmd.Flags().String("name", "", "List only certificates with a name that matches this glob")
+	listCmd.Flags().Bool("revoked", false, "List only revoked certificates")
+	listCmd.Flags().String("format", "table", "Output format: table, json, or csv")
+	listCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+	addWorkspaceFlags(listCmd)
+}
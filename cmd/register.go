@@ -0,0 +1,85 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+// registerCmd represents the register command
+var registerCmd = &cobra.Command{
+	Use:   "register",
+	Short: "Register an account with the CA",
+	Long: `The register command creates an account with the CA and
+saves it in the workspace (customized with --out) without
+obtaining any certificates. You must agree to the CA's terms
+with --agree.
+
+If the account is already registered, nothing changes. With
+--show, the stored registration of the account is printed,
+along with the terms of service it agreed to.`,
+	Run: runRegister,
+}
+
+func runRegister(cmd *cobra.Command, args []string) {
+	show, err := cmd.Flags().GetBool("show")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	user, err := loadUser(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	if show {
+		reg := user.GetRegistration()
+		if reg == nil {
+			log.Fatalf("[ERROR] No registration stored for '%s'", user.GetEmail())
+		}
+		jsonBytes, err := json.MarshalIndent(reg, "", "\t")
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		fmt.Println(string(jsonBytes))
+		terms := reg.Body.Agreement
+		if terms == "" {
+			terms = reg.TosURL
+		}
+		fmt.Println("Terms of service:", terms)
+		return
+	}
+
+	if user.GetRegistration() != nil {
+		log.Printf("[INFO] Account '%s' is already registered", user.GetEmail())
+		return
+	}
+
+	if err := user.Register(); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	log.Printf("[INFO] Registered account '%s'", user.GetEmail())
+}
+
+func init() {
+	RootCmd.AddCommand(registerCmd)
+
+	registerCmd.Flags().Bool("show", false, "Print the stored registration instead of registering")
+	addAccountFlags(registerCmd)
+}
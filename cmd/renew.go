@@ -0,0 +1,137 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// renewCmd represents the renew command
+var renewCmd = &cobra.Command{
+	Use:   "renew [-]",
+	Short: "Renew certificates in bulk or from stdin",
+	Long: `The renew command renews certificates that are close to
+expiring.
+
+With - as the argument, a PEM bundle is read from stdin, the
+certificate in it is renewed and the new bundle is written
+to stdout. If the bundle contains a private key, that key
+is reused.
+
+Otherwise, every certificate in the workspace (customized
+with --out) that expires within --days days is renewed
+with a new private key, and the new assets replace the old
+ones in the workspace.
+
+Names that were dropped from a certificate because they failed
+validation (see the --drop-failed-names flag of issue) are only
+tried again when --drop-failed-names is given here too, so that
+renewing cannot fail because of them.
+
+Challenges are solved as with the issue command, including the
+--challenges, --http-address, --tls-address, --webroot and
+--dns-* flags; the ones
+a certificate was issued with in a job file take precedence.`,
+	Run: runRenew,
+}
+
+func runRenew(cmd *cobra.Command, args []string) {
+	fromStdin, err := stdinArg(args)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if len(args) > 0 && !fromStdin {
+		log.Fatalf("[ERROR] Unexpected arguments: %v (use - to renew a bundle from stdin)", args)
+	}
+
+	days, err := cmd.Flags().GetInt("days")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	user, err := loadUser(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	user.Manager().DropFailedNames, err = cmd.Flags().GetBool("drop-failed-names")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	err = setSolver(cmd, user.Manager())
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	if fromStdin {
+		bundle, err := readStdin()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		certRes, err := user.RenewBundle(bundle)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		os.Stdout.Write(certRes.Certificate)
+		os.Stdout.Write(certRes.PrivateKey)
+		return
+	}
+
+	if err := user.RenewCerts(days); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+}
+
+// stdinArg returns true if args ask for input from stdin,
+// which is when the only argument is -. Mixing - with other
+// arguments is an error.
+func stdinArg(args []string) (bool, error) {
+	for _, arg := range args {
+		if arg == "-" {
+			if len(args) > 1 {
+				return false, fmt.Errorf("- reads from stdin and can't be combined with other arguments")
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readStdin reads all of stdin, which must not be empty.
+func readStdin() ([]byte, error) {
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("reading stdin: %v", err)
+	}
+	if len(bytes.TrimSpace(input)) == 0 {
+		return nil, fmt.Errorf("nothing on stdin; expected a PEM bundle")
+	}
+	return input, nil
+}
+
+func init() {
+	RootCmd.AddCommand(renewCmd)
+
+	renewCmd.Flags().Int("days", issuance.DefaultRenewDays, "Renew certificates expiring within this many days")
+	renewCmd.Flags().Bool("drop-failed-names", false, "Retry certificates without the SANs that fail validation, and try to add back names dropped before")
+	addAccountFlags(renewCmd)
+	addSolverFlags(renewCmd)
+}
@@ -0,0 +1,116 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// revokeCmd represents the revoke command
+var revokeCmd = &cobra.Command{
+	Use:   "revoke [site...|-]",
+	Short: "Revoke certificates",
+	Long: `The revoke command revokes certificates at the CA.
+
+With - as the argument, a PEM bundle is read from stdin and
+the certificate in it is revoked. Otherwise, the certificates of the sites named
+as arguments are revoked, along with those in the list file
+given with --list. The list file has the same format as the
+input file of the issue command; the first name on each line
+is the site to revoke.
+
+Revoked sites in the workspace are marked as such in their
+metadata, so they will not be renewed.
+
+The --reason flag takes an RFC 5280 reason code, either by
+name (e.g. keyCompromise, superseded) or by number. It is
+sent to the CA with each certificate.`,
+	Run: runRevoke,
+}
+
+func runRevoke(cmd *cobra.Command, args []string) {
+	reasonStr, err := cmd.Flags().GetString("reason")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	reason, err := issuance.ParseRevocationReason(reasonStr)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	listFile, err := cmd.Flags().GetString("list")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	delim, err := cmd.Flags().GetString("delim")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	user, err := loadUser(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	fromStdin, err := stdinArg(args)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	if len(args) == 0 && listFile == "" {
+		log.Fatal("nothing to revoke: specify sites or --list, or - to read a PEM bundle from stdin")
+	}
+
+	if fromStdin {
+		if listFile != "" {
+			log.Fatal("[ERROR] - reads from stdin and can't be combined with --list")
+		}
+		bundle, err := readStdin()
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		if err := user.RevokeBundle(bundle, reason); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		return
+	}
+
+	sites := args
+	if listFile != "" {
+		domainList, _, err := loadDomains(listFile, delim, false)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		for _, domains := range domainList {
+			sites = append(sites, domains[0])
+		}
+	}
+
+	if err := user.RevokeSites(sites, reason); err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(revokeCmd)
+
+	revokeCmd.Flags().String("reason", issuance.Unspecified.String(), "RFC 5280 revocation reason")
+	revokeCmd.Flags().String("list", "", "File listing the sites to revoke")
+	revokeCmd.Flags().String("delim", defaultDelimiter, "Delimiter of the list file")
+	addAccountFlags(revokeCmd)
+}
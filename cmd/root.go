@@ -17,7 +17,9 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
+	"github.com/mholt/certs/issuance"
 	"github.com/spf13/cobra"
 )
 
@@ -42,6 +44,209 @@ func Execute() {
 	}
 }
 
+// addAccountFlags adds the flags that choose the workspace,
+// the CA, and the account at the CA to cmd.
+func addAccountFlags(cmd *cobra.Command) {
+	cmd.Flags().String("ca", defaultCA, "URL of directory for ACME server")
+	cmd.Flags().StringP("email", "u", "", "Email address to register with CA for account recovery")
+	cmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which to store assets")
+	cmd.Flags().Bool("agree", false, "Indicate your agreement to CA's legal terms")
+	cmd.Flags().String("key-type", string(issuance.DefaultKeyType), "Type of new private keys: rsa2048, rsa3072, rsa4096, p256, or p384")
+	addWorkspaceFlags(cmd)
+}
+
+// addWorkspaceFlags adds the flag that unlocks
+// an encrypted workspace to cmd.
+func addWorkspaceFlags(cmd *cobra.Command) {
+	cmd.Flags().String("master-key-file", "", "File with the secret that encrypts private keys (default $"+issuance.PassphraseEnv+")")
+}
+
+// addSolverFlags adds the flags that configure
+// how challenges are solved to cmd.
+func addSolverFlags(cmd *cobra.Command) {
+	cmd.Flags().String("challenges", "", "Comma-separated challenge types to allow: http-01, tls-sni-01, dns-01 (default all)")
+	cmd.Flags().String("http-address", "", "Interface and port to bind to for the http-01 challenge (default :80)")
+	cmd.Flags().String("tls-address", "", "Interface and port to bind to for the tls-sni-01 challenge (default :443)")
+	cmd.Flags().String("webroot", "", "Document root of a web server on port 80 to solve the http-01 challenge with, instead of binding a port")
+	cmd.Flags().String("dns-provider", "", "DNS provider to solve the dns-01 challenge with: exec or rfc2136")
+	cmd.Flags().String("dns-exec", "", "Script the exec DNS provider runs with present or cleanup, FQDN, value and TTL")
+	cmd.Flags().String("dns-nameserver", "", "Nameserver the rfc2136 DNS provider sends updates to")
+	cmd.Flags().String("dns-zone", "", "Zone the rfc2136 DNS provider updates (default the zone of each record)")
+	cmd.Flags().String("dns-tsig-key", "", "Name of the TSIG key to sign DNS updates with")
+	cmd.Flags().String("dns-tsig-algorithm", "hmac-sha256", "Algorithm of the TSIG key: hmac-md5, hmac-sha1, hmac-sha256 or hmac-sha512")
+	cmd.Flags().String("dns-tsig-secret-file", "", "File with the secret of the TSIG key (default $"+issuance.TSIGSecretEnv+")")
+	cmd.Flags().Duration("dns-propagation-wait", 0, "How long to wait after setting a DNS record before checking it")
+	cmd.Flags().Duration("dns-timeout", issuance.DefaultDNSTimeout, "How long to wait for a DNS record to propagate")
+}
+
+// setSolver sets the Solver of m according to the
+// flags added by addSolverFlags.
+func setSolver(cmd *cobra.Command, m *issuance.Manager) error {
+	challenges, err := cmd.Flags().GetString("challenges")
+	if err != nil {
+		return err
+	}
+	httpAddress, err := cmd.Flags().GetString("http-address")
+	if err != nil {
+		return err
+	}
+	tlsAddress, err := cmd.Flags().GetString("tls-address")
+	if err != nil {
+		return err
+	}
+	webroot, err := cmd.Flags().GetString("webroot")
+	if err != nil {
+		return err
+	}
+	if webroot != "" {
+		webroot, err = filepath.Abs(webroot)
+		if err != nil {
+			return err
+		}
+	}
+
+	solver := issuance.Solver{HTTPAddress: httpAddress, TLSAddress: tlsAddress, Webroot: webroot}
+	solver.Challenges, err = issuance.ParseChallenges(challenges)
+	if err != nil {
+		return err
+	}
+	solver.DNS, err = dnsConfig(cmd)
+	if err != nil {
+		return err
+	}
+	if err := solver.Validate(); err != nil {
+		return err
+	}
+	m.Solver = solver
+	return nil
+}
+
+// dnsConfig returns the DNS provider settings chosen with
+// the flags added by addSolverFlags, or nil if there are none.
+func dnsConfig(cmd *cobra.Command) (*issuance.DNSConfig, error) {
+	provider, err := cmd.Flags().GetString("dns-provider")
+	if err != nil || provider == "" {
+		return nil, err
+	}
+	script, err := cmd.Flags().GetString("dns-exec")
+	if err != nil {
+		return nil, err
+	}
+	wait, err := cmd.Flags().GetDuration("dns-propagation-wait")
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := cmd.Flags().GetDuration("dns-timeout")
+	if err != nil {
+		return nil, err
+	}
+	config := &issuance.DNSConfig{
+		Provider:        provider,
+		Exec:            script,
+		PropagationWait: wait,
+		Timeout:         timeout,
+	}
+	for flag, value := range map[string]*string{
+		"dns-nameserver":       &config.Nameserver,
+		"dns-zone":             &config.Zone,
+		"dns-tsig-key":         &config.TSIGKey,
+		"dns-tsig-secret-file": &config.TSIGSecretFile,
+	} {
+		*value, err = cmd.Flags().GetString(flag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TSIGKey != "" {
+		config.TSIGAlgorithm, err = cmd.Flags().GetString("dns-tsig-algorithm")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TSIGSecretFile != "" {
+		config.TSIGSecretFile, err = filepath.Abs(config.TSIGSecretFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// openWorkspace opens the workspace chosen with --out,
+// unlocking it with the flag added by addWorkspaceFlags.
+func openWorkspace(cmd *cobra.Command) (issuance.Storage, error) {
+	workspaceDir, err := cmd.Flags().GetString("out")
+	if err != nil {
+		return nil, err
+	}
+
+	keyFile, err := cmd.Flags().GetString("master-key-file")
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := issuance.ReadSecret(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return issuance.OpenWorkspace(workspaceDir, secret)
+}
+
+// loadUser makes a Manager according to the flags added
+// by addAccountFlags and returns the user that was chosen
+// with them.
+func loadUser(cmd *cobra.Command) (*issuance.User, error) {
+	m, email, err := loadManager(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return m.GetUser(email)
+}
+
+// loadManager makes a Manager according to the flags added
+// by addAccountFlags. It also returns the email address that
+// was chosen with them.
+func loadManager(cmd *cobra.Command) (*issuance.Manager, string, error) {
+	storage, err := openWorkspace(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ca, err := cmd.Flags().GetString("ca")
+	if err != nil {
+		return nil, "", err
+	}
+
+	agree, err := cmd.Flags().GetBool("agree")
+	if err != nil {
+		return nil, "", err
+	}
+
+	email, err := cmd.Flags().GetString("email")
+	if err != nil {
+		return nil, "", err
+	}
+
+	keyTypeName, err := cmd.Flags().GetString("key-type")
+	if err != nil {
+		return nil, "", err
+	}
+	keyType, err := issuance.ParseKeyType(keyTypeName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m := &issuance.Manager{
+		ServerURL: ca,
+		Agree:     agree,
+		Storage:   storage,
+		KeyType:   keyType,
+	}
+	return m, email, nil
+}
+
+const defaultCA = "https://acme-staging.api.letsencrypt.org/directory"
+
 // func init() {
 // 	cobra.OnInitialize(initConfig)
 
@@ -0,0 +1,118 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// showCmd represents the show command
+var showCmd = &cobra.Command{
+	Use:   "show <name>",
+	Short: "Show the details of a certificate",
+	Long: `The show command prints the details of the certificate of
+a site in the workspace (customized with --out): its subject,
+names, serial number, issuer chain, key type and size,
+validity period, fingerprints, SPKI pin, OCSP and issuer URLs,
+and the account that obtained it.
+
+The name may be the site itself or any other name on its
+certificate. If the site's private key does not belong to
+its certificate, show says so and exits with status 1.`,
+	Run: runShow,
+}
+
+func runShow(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatal("[ERROR] give exactly one name to show")
+	}
+
+	storage, err := openWorkspace(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	m := &issuance.Manager{Storage: storage}
+
+	details, err := m.ShowSite(args[0])
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	cert := details.Certificate
+	meta := details.Meta
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Site:\t%s\n", details.Site)
+	fmt.Fprintf(w, "Subject:\t%s\n", cert.Subject)
+	fmt.Fprintf(w, "Names:\t%s\n", strings.Join(cert.DNSNames, ", "))
+	if len(meta.Dropped) > 0 {
+		fmt.Fprintf(w, "Dropped names:\t%s\n", strings.Join(meta.Dropped, ", "))
+	}
+	fmt.Fprintf(w, "Serial:\t%x\n", cert.SerialNumber)
+	fmt.Fprintf(w, "Issuer:\t%s\n", cert.Issuer)
+	for _, issuer := range details.Chain {
+		fmt.Fprintf(w, "\t  issued by %s\n", issuer.Issuer)
+	}
+	keySource := meta.KeySource
+	if keySource == issuance.KeyGenerated {
+		keySource = "generated"
+	}
+	fmt.Fprintf(w, "Key:\t%s (%s)\n", issuance.PublicKeyDescription(cert), keySource)
+	fmt.Fprintf(w, "Not before:\t%s\n", cert.NotBefore.Local().Format(time.RFC1123))
+	fmt.Fprintf(w, "Not after:\t%s (%s)\n", cert.NotAfter.Local().Format(time.RFC1123), expiresIn(cert.NotAfter))
+	sha1Hex, sha256Hex := issuance.Fingerprint(cert)
+	fmt.Fprintf(w, "SHA-1:\t%s\n", sha1Hex)
+	fmt.Fprintf(w, "SHA-256:\t%s\n", sha256Hex)
+	fmt.Fprintf(w, "SPKI pin:\tsha256/%s\n", issuance.SPKIPin(cert))
+	fmt.Fprintf(w, "OCSP:\t%s\n", strings.Join(cert.OCSPServer, ", "))
+	fmt.Fprintf(w, "Issuer URL:\t%s\n", strings.Join(cert.IssuingCertificateURL, ", "))
+	account := meta.Account
+	if account == "" {
+		account = "(default)"
+	}
+	fmt.Fprintf(w, "Account:\t%s\n", account)
+	if meta.Revoked != nil {
+		fmt.Fprintf(w, "Revoked:\t%s (%s)\n", meta.Revoked.Time.Local().Format(time.RFC1123), meta.Revoked.Reason)
+	}
+	w.Flush()
+
+	if details.HasKey && !details.KeyMatches {
+		log.Printf("[ERROR] The private key of %s does not belong to its certificate", details.Site)
+		os.Exit(1)
+	}
+}
+
+// expiresIn describes how long until notAfter, in days.
+func expiresIn(notAfter time.Time) string {
+	days := int(notAfter.Sub(time.Now()).Hours() / 24)
+	if notAfter.Before(time.Now()) {
+		return fmt.Sprintf("expired %d days ago", -days)
+	}
+	return fmt.Sprintf("expires in %d days", days)
+}
+
+func init() {
+	RootCmd.AddCommand(showCmd)
+
+	showCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+	addWorkspaceFlags(showCmd)
+}
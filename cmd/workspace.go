@@ -0,0 +1,139 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/mholt/certs/issuance"
+	"github.com/spf13/cobra"
+)
+
+// workspaceCmd represents the workspace command
+var workspaceCmd = &cobra.Command{
+	Use:   "workspace",
+	Short: "Maintain the workspace",
+	Long: `The workspace command groups commands that maintain
+the workspace itself rather than its certificates.`,
+}
+
+// rekeyCmd represents the workspace rekey command
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Encrypt private keys with a new master key",
+	Long: `The rekey command re-encrypts all private keys in the
+workspace (customized with --out) with a master key derived
+from a new secret. The new secret is read from the file given
+with --new-master-key-file, or from $` + newPassphraseEnv + `.
+
+The current secret is given as for any other command. If the
+workspace is not encrypted yet, rekey enables encryption and
+encrypts all the private keys in it.
+
+If rekey is interrupted, run it again with the same secrets.`,
+	Run: runRekey,
+}
+
+func runRekey(cmd *cobra.Command, args []string) {
+	workspaceDir, err := cmd.Flags().GetString("out")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	newKeyFile, err := cmd.Flags().GetString("new-master-key-file")
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	var newSecret []byte
+	if newKeyFile != "" {
+		newSecret, err = issuance.ReadSecret(newKeyFile)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	} else {
+		newSecret = []byte(os.Getenv(newPassphraseEnv))
+	}
+	if len(newSecret) == 0 {
+		log.Fatalf("[ERROR] No new secret; use --new-master-key-file or set %s", newPassphraseEnv)
+	}
+
+	var storage *issuance.EncryptedStorage
+	if issuance.IsEncrypted(issuance.FileStorage(workspaceDir)) {
+		s, err := openWorkspace(cmd)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		storage = s.(*issuance.EncryptedStorage)
+	} else {
+		storage, err = issuance.OpenEncryptedStorage(issuance.FileStorage(workspaceDir), newSecret)
+		if err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+	}
+
+	err = storage.Rekey(newSecret)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+}
+
+// reindexCmd represents the workspace reindex command
+var reindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild the index of the workspace",
+	Long: `The reindex command rebuilds the index of the workspace
+(customized with --out) from the certificates and metadata
+of its sites. The index keeps track of which site has the
+certificate for each name, along with each certificate's
+serial number, issuer, validity period, account and status.
+
+The index is kept up to date as certificates are saved, so
+reindex is only needed if the sites were changed by hand,
+or if the index file was lost.`,
+	Run: runReindex,
+}
+
+func runReindex(cmd *cobra.Command, args []string) {
+	storage, err := openWorkspace(cmd)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+
+	m := &issuance.Manager{Storage: storage}
+	idx, err := m.Reindex()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	log.Printf("[INFO] Indexed %d names of %d sites", len(idx.Names), len(idx.Sites))
+}
+
+// newPassphraseEnv is the environment variable that holds
+// the new passphrase for workspace rekey.
+const newPassphraseEnv = "CERTS_NEW_PASSPHRASE"
+
+func init() {
+	RootCmd.AddCommand(workspaceCmd)
+	workspaceCmd.AddCommand(rekeyCmd)
+	workspaceCmd.AddCommand(reindexCmd)
+
+	rekeyCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+	rekeyCmd.Flags().String("new-master-key-file", "", "File with the new secret (default $"+newPassphraseEnv+")")
+	addWorkspaceFlags(rekeyCmd)
+
+	reindexCmd.Flags().String("out", issuance.DefaultWorkspace, "Path to folder in which assets are stored")
+	addWorkspaceFlags(reindexCmd)
+}
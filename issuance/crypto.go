@@ -15,87 +15,230 @@
 package issuance
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/json"
 	"encoding/pem"
-	"io/ioutil"
-	"os"
+	"fmt"
+	"log"
+	"strings"
 
 	"github.com/xenolf/lego/acme"
 )
 
-// loadRSAPrivateKey loads a PEM-encoded RSA private key from file.
-func loadRSAPrivateKey(file string) (*rsa.PrivateKey, error) {
-	keyBytes, err := ioutil.ReadFile(file)
+// loadPrivateKey loads a PEM-encoded private key
+// from the file in storage.
+func loadPrivateKey(storage Storage, file string) (crypto.PrivateKey, error) {
+	keyBytes, err := storage.Load(file)
 	if err != nil {
 		return nil, err
 	}
 	keyBlock, _ := pem.Decode(keyBytes)
-	return x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if keyBlock == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", file)
+	}
+	return parsePrivateKey(keyBlock)
 }
 
-// saveRSAPrivateKey saves a PEM-encoded RSA private key to file.
-func saveRSAPrivateKey(key *rsa.PrivateKey, file string) error {
-	pemKey := pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
-	keyOut, err := os.Create(file)
+// savePrivateKey saves a PEM-encoded private key
+// to the file in storage.
+func savePrivateKey(storage Storage, key crypto.PrivateKey, file string) error {
+	pemKey, err := encodePrivateKey(key)
 	if err != nil {
 		return err
 	}
-	defer keyOut.Close()
-	keyOut.Chmod(0600)
-	return pem.Encode(keyOut, &pemKey)
+	return storage.Store(file, pemKey)
+}
+
+// parsePrivateKey parses the RSA or ECDSA private key in
+// keyBlock, which may be in PKCS#1, SEC 1, or PKCS#8 form.
+func parsePrivateKey(keyBlock *pem.Block) (crypto.PrivateKey, error) {
+	switch keyBlock.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(keyBlock.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key.(type) {
+		case *rsa.PrivateKey, *ecdsa.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported type of private key: %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block type: %s", keyBlock.Type)
+}
+
+// encodePrivateKey PEM-encodes key, in PKCS#1
+// form for RSA and SEC 1 form for ECDSA.
+func encodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	var pemKey *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		pemKey = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		keyBytes, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		pemKey = &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyBytes}
+	default:
+		return nil, fmt.Errorf("unsupported type of private key: %T", key)
+	}
+	return pem.EncodeToMemory(pemKey), nil
+}
+
+// loadCertificate loads the first PEM-encoded certificate
+// from the file in storage.
+func loadCertificate(storage Storage, file string) (*x509.Certificate, error) {
+	certBytes, err := storage.Load(file)
+	if err != nil {
+		return nil, err
+	}
+	cert, _, err := parseBundle(certBytes)
+	return cert, err
+}
+
+// parseBundle parses a PEM bundle and returns the first certificate
+// in it and, if there is one, the private key. A bundle without
+// a certificate is an error, but a bundle without a key is not; in
+// that case the returned key will be nil.
+func parseBundle(pemBundle []byte) (*x509.Certificate, crypto.PrivateKey, error) {
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+
+	for block, rest := pem.Decode(pemBundle); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert != nil {
+				continue // the rest of the chain
+			}
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing certificate: %v", err)
+			}
+			cert = c
+		case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY":
+			k, err := parsePrivateKey(block)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing private key: %v", err)
+			}
+			key = k
+		}
+	}
+
+	if cert == nil {
+		return nil, nil, fmt.Errorf("no certificate found in PEM data")
+	}
+
+	return cert, key, nil
 }
 
-// saveCertResource saves the certificate resource to disk. This
-// includes the certificate file itself, the private key, and the
-// metadata file.
-func saveCertResource(cert acme.CertificateResource) error {
-	err := os.MkdirAll(Workspace.Site(cert.Domain), 0700)
+// saveCertResource saves the certificate resource that was
+// obtained for bundle to storage. This includes the certificate
+// file itself, the private key, the CSR if there is one, and the
+// metadata file, which records the source of the key and the
+// settings of bundle, so that renewals can use them.
+func (m *Manager) saveCertResource(cert acme.CertificateResource, bundle Bundle, source KeySource) error {
+	err := m.Storage.Lock(SiteDir(cert.Domain))
 	if err != nil {
 		return err
 	}
+	defer m.Storage.Unlock(SiteDir(cert.Domain))
 
 	// Save cert
-	err = ioutil.WriteFile(Workspace.SiteCertFile(cert.Domain), cert.Certificate, 0600)
+	err = m.Storage.Store(SiteCertFile(cert.Domain), cert.Certificate)
 	if err != nil {
 		return err
 	}
 
-	// Save private key
-	err = ioutil.WriteFile(Workspace.SiteKeyFile(cert.Domain), cert.PrivateKey, 0600)
+	// Save private key, or the CSR if we don't have the key
+	if bundle.CSR != nil {
+		err = m.Storage.Store(SiteCSRFile(cert.Domain), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: bundle.CSR.Raw}))
+		if err == nil {
+			err = m.Storage.Delete(SiteKeyFile(cert.Domain))
+		}
+	} else {
+		err = m.Storage.Store(SiteKeyFile(cert.Domain), cert.PrivateKey)
+		if err == nil {
+			err = m.Storage.Delete(SiteCSRFile(cert.Domain))
+		}
+	}
 	if err != nil {
 		return err
 	}
 
 	// Save cert metadata
-	jsonBytes, err := json.MarshalIndent(&cert, "", "\t")
+	meta := SiteMeta{
+		CertificateResource: cert,
+		KeySource:           source,
+		PostIssue:           bundle.PostIssue,
+		Dropped:             bundle.dropped,
+		Account:             bundle.account,
+	}
+	if !bundle.Solver.isZero() {
+		meta.Solver = &bundle.Solver
+	}
+	if !bundle.Output.isZero() {
+		meta.Output = &bundle.Output
+	}
+	return m.saveSiteMeta(meta)
+}
+
+// saveObtained saves the certificate resource that was obtained
+// for bundle, then writes its outputs and runs its hooks. Failing
+// to save is an error, but since the certificate is safe in the
+// workspace by then, failures after that are only logged.
+func (m *Manager) saveObtained(cert acme.CertificateResource, bundle Bundle, source KeySource) error {
+	err := m.saveCertResource(cert, bundle, source)
 	if err != nil {
-		return err
+		return fmt.Errorf("error saving assets for %v: %v", bundle.Names, err)
 	}
-	err = ioutil.WriteFile(Workspace.SiteMetaFile(cert.Domain), jsonBytes, 0600)
+	err = m.deploy(cert.Domain, bundle)
 	if err != nil {
-		return err
+		log.Printf("[ERROR][%s] Deploying certificate: %v", cert.Domain, err)
 	}
-
 	return nil
 }
 
 // existingCertAndKey returns true if the host has a certificate
-// and private key in storage already, false otherwise.
-func existingCertAndKey(host string) bool {
-	_, err := os.Stat(Workspace.SiteCertFile(host))
-	if err != nil {
-		return false
+// and private key (or, failing that, a CSR) in storage already,
+// false otherwise.
+func (m *Manager) existingCertAndKey(host string) bool {
+	return m.Storage.Exists(SiteCertFile(host)) &&
+		(m.Storage.Exists(SiteKeyFile(host)) || m.Storage.Exists(SiteCSRFile(host)))
+}
+
+// ParsePrivateKey parses the first PEM-encoded private key in
+// pemBytes. The key may be in PKCS#1, SEC 1, or PKCS#8 form.
+func ParsePrivateKey(pemBytes []byte) (crypto.PrivateKey, error) {
+	for block, rest := pem.Decode(pemBytes); block != nil; block, rest = pem.Decode(rest) {
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return parsePrivateKey(block)
+		}
 	}
-	_, err = os.Stat(Workspace.SiteKeyFile(host))
+	return nil, fmt.Errorf("no private key found in PEM data")
+}
+
+// ParseCSR parses a certificate signing request,
+// which may be PEM-encoded or DER-encoded.
+func ParseCSR(csrBytes []byte) (*x509.CertificateRequest, error) {
+	for block, rest := pem.Decode(csrBytes); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE REQUEST" || block.Type == "NEW CERTIFICATE REQUEST" {
+			csrBytes = block.Bytes
+			break
+		}
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
 	if err != nil {
-		return false
+		return nil, fmt.Errorf("parsing CSR: %v", err)
 	}
-	return true
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("checking CSR signature: %v", err)
+	}
+	return csr, nil
 }
-
-// rsaKeySize is the size in bits to use for new RSA keys.
-// This shouldn't need to change except for in tests; the
-// size can be drastically reduced for speed.
-var rsaKeySize = 2048
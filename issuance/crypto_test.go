@@ -16,10 +16,13 @@ package issuance
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
-	"io/ioutil"
+	"encoding/pem"
 	"os"
 	"runtime"
 	"testing"
@@ -28,20 +31,22 @@ import (
 )
 
 func init() {
-	rsaKeySize = 128 // make tests faster; small key size OK for testing
+	// make tests faster; small key sizes OK for testing
+	rsaKeyBits = map[KeyType]int{RSA2048: 128, RSA3072: 136, RSA4096: 144}
 }
 
-func TestSaveAndLoadRSAPrivateKey(t *testing.T) {
+func TestSaveAndLoadPrivateKey(t *testing.T) {
+	storage := FileStorage(".")
 	keyFile := "test.key"
 	defer os.Remove(keyFile)
 
-	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 128)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// test save
-	err = saveRSAPrivateKey(privateKey, keyFile)
+	err = savePrivateKey(storage, privateKey, keyFile)
 	if err != nil {
 		t.Fatal("error saving private key:", err)
 	}
@@ -60,33 +65,90 @@ func TestSaveAndLoadRSAPrivateKey(t *testing.T) {
 	}
 
 	// test load
-	loadedKey, err := loadRSAPrivateKey(keyFile)
+	loadedKey, err := loadPrivateKey(storage, keyFile)
 	if err != nil {
 		t.Error("error loading private key:", err)
 	}
 
 	// verify loaded key is correct
-	if !rsaPrivateKeysSame(privateKey, loadedKey) {
+	if !privateKeysSame(privateKey, loadedKey) {
 		t.Error("Expected key bytes to be the same, but they weren't")
 	}
 }
 
-// rsaPrivateKeysSame compares the bytes of a and b and returns true if they are the same.
-func rsaPrivateKeysSame(a, b *rsa.PrivateKey) bool {
-	return bytes.Equal(rsaPrivateKeyBytes(a), rsaPrivateKeyBytes(b))
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		block    *pem.Block
+		expected crypto.PrivateKey
+	}{
+		{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, rsaKey},
+		{&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}, ecKey},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: rsaPKCS8}, rsaKey},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: ecPKCS8}, ecKey},
+	} {
+		key, err := parsePrivateKey(test.block)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error parsing %s, got: %v", i, test.block.Type, err)
+			continue
+		}
+		if !privateKeysSame(key, test.expected) {
+			t.Errorf("Test %d: Expected parsed %s to be the same key, but it wasn't", i, test.block.Type)
+		}
+	}
+
+	if _, err := parsePrivateKey(&pem.Block{Type: "CERTIFICATE"}); err == nil {
+		t.Error("Expected error parsing a certificate as a key, got none")
+	}
+
+	// ECDSA keys are saved in SEC 1 form
+	ecPEM, err := encodePrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("Expected no error encoding ECDSA key, got: %v", err)
+	}
+	if block, _ := pem.Decode(ecPEM); block == nil || block.Type != "EC PRIVATE KEY" {
+		t.Errorf("Expected EC PRIVATE KEY block, got:\n%s", ecPEM)
+	}
+}
+
+// privateKeysSame compares the bytes of a and b and returns true if they are the same.
+func privateKeysSame(a, b crypto.PrivateKey) bool {
+	return bytes.Equal(privateKeyBytes(a), privateKeyBytes(b))
 }
 
-// rsaPrivateKeyBytes returns the bytes of DER-encoded key.
-func rsaPrivateKeyBytes(key *rsa.PrivateKey) []byte {
-	return x509.MarshalPKCS1PrivateKey(key)
+// privateKeyBytes returns the bytes of DER-encoded key.
+func privateKeyBytes(key crypto.PrivateKey) []byte {
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	return der
 }
 
 func TestSaveCertResource(t *testing.T) {
-	Workspace = Storage("./certs_test_save")
+	storage := FileStorage("./certs_test_save")
+	m := &Manager{Storage: storage}
 	defer func() {
-		err := os.RemoveAll(string(Workspace))
+		err := os.RemoveAll(string(storage))
 		if err != nil {
-			t.Fatalf("Could not remove temporary storage directory (%s): %v", Workspace, err)
+			t.Fatalf("Could not remove temporary storage directory (%s): %v", storage, err)
 		}
 	}()
 
@@ -107,12 +169,12 @@ func TestSaveCertResource(t *testing.T) {
 		Certificate:   []byte(certContents),
 	}
 
-	err := saveCertResource(cert)
+	err := m.saveCertResource(cert, Bundle{}, KeyGenerated)
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
 
-	certFile, err := ioutil.ReadFile(Workspace.SiteCertFile(domain))
+	certFile, err := m.Storage.Load(SiteCertFile(domain))
 	if err != nil {
 		t.Errorf("Expected no error reading certificate file, got: %v", err)
 	}
@@ -120,7 +182,7 @@ func TestSaveCertResource(t *testing.T) {
 		t.Errorf("Expected certificate file to contain '%s', got '%s'", certContents, string(certFile))
 	}
 
-	keyFile, err := ioutil.ReadFile(Workspace.SiteKeyFile(domain))
+	keyFile, err := m.Storage.Load(SiteKeyFile(domain))
 	if err != nil {
 		t.Errorf("Expected no error reading private key file, got: %v", err)
 	}
@@ -128,7 +190,7 @@ func TestSaveCertResource(t *testing.T) {
 		t.Errorf("Expected private key file to contain '%s', got '%s'", keyContents, string(keyFile))
 	}
 
-	metaFile, err := ioutil.ReadFile(Workspace.SiteMetaFile(domain))
+	metaFile, err := m.Storage.Load(SiteMetaFile(domain))
 	if err != nil {
 		t.Errorf("Expected no error reading meta file, got: %v", err)
 	}
@@ -138,30 +200,73 @@ func TestSaveCertResource(t *testing.T) {
 }
 
 func TestExistingCertAndKey(t *testing.T) {
-	Workspace = Storage("./le_test_existing")
-	defer func() {
-		err := os.RemoveAll(string(Workspace))
-		if err != nil {
-			t.Fatalf("Could not remove temporary storage directory (%s): %v", Workspace, err)
-		}
-	}()
+	m := &Manager{Storage: new(MemoryStorage)}
 
 	domain := "example.com"
 
-	if existingCertAndKey(domain) {
+	if m.existingCertAndKey(domain) {
 		t.Errorf("Did NOT expect %v to have existing cert or key, but it did", domain)
 	}
 
-	err := saveCertResource(acme.CertificateResource{
+	err := m.saveCertResource(acme.CertificateResource{
 		Domain:      domain,
 		PrivateKey:  []byte("key"),
 		Certificate: []byte("cert"),
-	})
+	}, Bundle{}, KeyGenerated)
 	if err != nil {
 		t.Fatalf("Expected no error, got: %v", err)
 	}
 
-	if !existingCertAndKey(domain) {
+	if !m.existingCertAndKey(domain) {
 		t.Errorf("Expected %v to have existing cert and key, but it did NOT", domain)
 	}
 }
+
+func TestSiteMeta(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+
+	domain := "example.com"
+
+	meta, err := m.loadSiteMeta(domain)
+	if err != nil {
+		t.Fatalf("Expected no error loading missing metadata, got: %v", err)
+	}
+	if meta.Domain != domain {
+		t.Errorf("Expected domain '%s' in empty metadata, got '%s'", domain, meta.Domain)
+	}
+
+	err = m.saveCertResource(acme.CertificateResource{
+		Domain:      domain,
+		CertURL:     "https://example.com/cert",
+		PrivateKey:  []byte("key"),
+		Certificate: []byte("cert"),
+	}, Bundle{}, KeyGenerated)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	meta, err = m.loadSiteMeta(domain)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if meta.Revoked != nil {
+		t.Error("Expected new certificate to not be revoked, but it was")
+	}
+
+	meta.Revoked = &Revocation{Reason: KeyCompromise}
+	err = m.saveSiteMeta(meta)
+	if err != nil {
+		t.Fatalf("Expected no error saving metadata, got: %v", err)
+	}
+
+	meta, err = m.loadSiteMeta(domain)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if meta.Revoked == nil || meta.Revoked.Reason != KeyCompromise {
+		t.Errorf("Expected certificate to be revoked for key compromise, got %+v", meta.Revoked)
+	}
+	if meta.CertURL != "https://example.com/cert" {
+		t.Errorf("Expected cert URL to be preserved, got '%s'", meta.CertURL)
+	}
+}
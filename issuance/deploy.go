@@ -0,0 +1,171 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Output is where copies of a certificate's assets are written,
+// outside of the workspace, each time it is issued or renewed.
+// Paths that are empty are not written.
+type Output struct {
+	// Cert is the file for the PEM-encoded certificate chain.
+	Cert string `json:"cert,omitempty"`
+
+	// Key is the file for the PEM-encoded private key.
+	Key string `json:"key,omitempty"`
+
+	// Bundle is the file for the certificate chain
+	// followed by the private key.
+	Bundle string `json:"bundle,omitempty"`
+
+	// Exports are more files the certificate is
+	// written to, in other formats.
+	Exports []Export `json:"exports,omitempty"`
+}
+
+// isZero returns true if o has nothing to write.
+func (o Output) isZero() bool {
+	return o.Cert == "" && o.Key == "" && o.Bundle == "" && len(o.Exports) == 0
+}
+
+// deploy writes the assets of the site named site to the
+// outputs of bundle, then runs the post-issue hooks of bundle.
+// Each hook is run with a shell, with the site, its names and
+// the output files in the environment. deploy stops at the
+// first failure.
+func (m *Manager) deploy(site string, bundle Bundle) error {
+	out := bundle.Output
+	if out.isZero() && len(bundle.PostIssue) == 0 {
+		return nil
+	}
+
+	certBytes, err := m.Storage.Load(SiteCertFile(site))
+	if err != nil {
+		return err
+	}
+	var keyBytes []byte
+	if out.Key != "" || out.Bundle != "" {
+		keyBytes, err = m.Storage.Load(SiteKeyFile(site))
+		if err != nil {
+			return fmt.Errorf("loading private key: %v", err)
+		}
+	}
+
+	for _, file := range []struct {
+		path     string
+		contents []byte
+		perm     os.FileMode
+	}{
+		{out.Cert, certBytes, 0644},
+		{out.Key, keyBytes, 0600},
+		{out.Bundle, append(append([]byte(nil), certBytes...), keyBytes...), 0600},
+	} {
+		if file.path == "" {
+			continue
+		}
+		err := writeFile(file.path, file.contents, file.perm)
+		if err != nil {
+			return err
+		}
+		log.Printf("[INFO][%s] Wrote %s", site, file.path)
+	}
+	for _, e := range out.Exports {
+		err := m.writeExport(site, e)
+		if err != nil {
+			return fmt.Errorf("exporting %s: %v", e.Path, err)
+		}
+		log.Printf("[INFO][%s] Exported %s as %s", site, e.Path, e.Format)
+	}
+
+	env := append(os.Environ(),
+		"CERTS_SITE="+site,
+		"CERTS_NAMES="+strings.Join(bundle.Names, ","),
+		"CERTS_CERT_FILE="+out.Cert,
+		"CERTS_KEY_FILE="+out.Key,
+		"CERTS_BUNDLE_FILE="+out.Bundle,
+	)
+	for _, hook := range bundle.PostIssue {
+		cmd := shellCommand(hook)
+		cmd.Env = env
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("post-issue hook '%s': %v: %s", hook, err, strings.TrimSpace(string(output)))
+		}
+		log.Printf("[INFO][%s] Ran post-issue hook: %s", site, hook)
+	}
+
+	return nil
+}
+
+// exportsKey returns true if any of the exports
+// of o include the private key.
+func (o Output) exportsKey() bool {
+	for _, e := range o.Exports {
+		if e.Format.needsKey() {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFile writes contents to the file at path with perm,
+// creating its folder if needed. Like FileStorage.Store, it
+// replaces the file atomically, so that readers never see a
+// partially written file, and the file ends up with perm even
+// if it already existed with other permissions.
+func writeFile(path string, contents []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op if renamed
+
+	err = tmp.Chmod(perm)
+	if err == nil {
+		_, err = tmp.Write(contents)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// shellCommand returns a command that runs
+// command with the system's shell.
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeploy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook uses a POSIX shell")
+	}
+
+	dir, err := ioutil.TempDir("", "certs_deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Manager{Storage: new(MemoryStorage)}
+	certPEM, keyPEM := selfSignedPEM(t, []string{"example.com"}, time.Now().Add(24*time.Hour))
+	m.Storage.Store(SiteCertFile("example.com"), certPEM)
+	m.Storage.Store(SiteKeyFile("example.com"), keyPEM)
+
+	bundle := Bundle{
+		Names: []string{"example.com", "www.example.com"},
+		Output: Output{
+			Cert:   filepath.Join(dir, "certs", "example.com.crt"),
+			Bundle: filepath.Join(dir, "example.com.pem"),
+		},
+		PostIssue: []string{`echo "$CERTS_SITE $CERTS_NAMES" > "` + filepath.Join(dir, "hook") + `"`},
+	}
+	err = m.deploy("example.com", bundle)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, test := range []struct {
+		file     string
+		expected string
+	}{
+		{bundle.Output.Cert, string(certPEM)},
+		{bundle.Output.Bundle, string(certPEM) + string(keyPEM)},
+		{filepath.Join(dir, "hook"), "example.com example.com,www.example.com\n"},
+	} {
+		actual, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Errorf("Expected %s to be written, got: %v", test.file, err)
+			continue
+		}
+		if string(actual) != test.expected {
+			t.Errorf("Expected %s to contain %q, got %q", test.file, test.expected, actual)
+		}
+	}
+
+	// files that are already there get the right permissions
+	keyFile := filepath.Join(dir, "example.com.key")
+	err = ioutil.WriteFile(keyFile, []byte("old key"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(bundle.Output.Bundle, 0644)
+	bundle.Output.Key = keyFile
+	err = m.deploy("example.com", bundle)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	for _, file := range []string{bundle.Output.Key, bundle.Output.Bundle} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0600 {
+			t.Errorf("Expected %s to be replaced with permissions 0600, got %#o", file, perm)
+		}
+	}
+	if actual, _ := ioutil.ReadFile(keyFile); string(actual) != string(keyPEM) {
+		t.Errorf("Expected %s to contain the private key, got %q", keyFile, actual)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, tempFilePrefix+"*")); len(leftovers) > 0 {
+		t.Errorf("Expected no temporary files to be left behind, got %v", leftovers)
+	}
+
+	bundle.PostIssue = []string{"echo oops; exit 3"}
+	err = m.deploy("example.com", bundle)
+	if err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("Expected failing hook to return its output as an error, got: %v", err)
+	}
+}
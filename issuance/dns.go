@@ -0,0 +1,129 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// DNSConfig configures the provider that solves the dns-01
+// challenge by setting a TXT record in the zone of each name.
+type DNSConfig struct {
+	// Provider is the name of the DNS provider; see
+	// DNSProviders.
+	Provider string `json:"provider"`
+
+	// Exec is the script that the "exec" provider runs to
+	// change records. It is run with the action ("present"
+	// or "cleanup"), the FQDN of the record, the value of
+	// the record and its TTL as arguments.
+	Exec string `json:"exec,omitempty"`
+
+	// Nameserver is the address of the server that the
+	// "rfc2136" provider sends dynamic updates to, like
+	// "ns1.example.com"; the port defaults to 53.
+	Nameserver string `json:"nameserver,omitempty"`
+
+	// Zone is the zone that the "rfc2136" provider updates.
+	// If empty, it is the zone that the nameserver says the
+	// record belongs to.
+	Zone string `json:"zone,omitempty"`
+
+	// TSIGKey is the name of the TSIG key that the "rfc2136"
+	// provider signs updates with, if any, and TSIGAlgorithm
+	// is its algorithm, hmac-sha256 by default. The secret of
+	// the key is read from TSIGSecretFile, or if that is
+	// empty, from the TSIGSecretEnv environment variable, so
+	// that it is not stored with the certificates.
+	TSIGKey        string `json:"tsig_key,omitempty"`
+	TSIGAlgorithm  string `json:"tsig_algorithm,omitempty"`
+	TSIGSecretFile string `json:"tsig_secret_file,omitempty"`
+
+	// PropagationWait is how long to wait after the record
+	// is set before checking that it has propagated, for
+	// DNS backends that are slow to publish changes.
+	PropagationWait time.Duration `json:"propagation_wait,omitempty"`
+
+	// Timeout is how long to wait for the record to appear
+	// on the zone's authoritative nameservers before giving
+	// up. If 0, DefaultDNSTimeout is used.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// DNSProviders are the names of the DNS providers
+// that can solve the dns-01 challenge.
+var DNSProviders = []string{"exec", "rfc2136"}
+
+// DefaultDNSTimeout is how long to wait for DNS records
+// to propagate if the DNSConfig does not say.
+const DefaultDNSTimeout = 60 * time.Second
+
+// dnsPollInterval is how often to check whether
+// DNS records have propagated.
+const dnsPollInterval = 2 * time.Second
+
+// Validate returns an error if c is not a valid configuration.
+func (c DNSConfig) Validate() error {
+	switch c.Provider {
+	case "exec":
+		if c.Exec == "" {
+			return fmt.Errorf("the exec DNS provider needs a script to run")
+		}
+	case "rfc2136":
+		if c.Nameserver == "" {
+			return fmt.Errorf("the rfc2136 DNS provider needs a nameserver to update")
+		}
+		if c.TSIGKey == "" && (c.TSIGAlgorithm != "" || c.TSIGSecretFile != "") {
+			return fmt.Errorf("TSIG algorithm and secret need the name of the TSIG key")
+		}
+		if _, err := c.tsigAlgorithm(); err != nil {
+			return err
+		}
+	case "":
+		return fmt.Errorf("no DNS provider given; must be one of %v", DNSProviders)
+	default:
+		return fmt.Errorf("unknown DNS provider '%s'; must be one of %v", c.Provider, DNSProviders)
+	}
+	if c.PropagationWait < 0 || c.Timeout < 0 {
+		return fmt.Errorf("DNS propagation wait and timeout must not be negative")
+	}
+	return nil
+}
+
+// provider returns the challenge provider configured by c.
+func (c DNSConfig) provider() (acme.ChallengeProvider, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	switch c.Provider {
+	case "exec":
+		return execProvider{config: c}, nil
+	case "rfc2136":
+		return newRFC2136Provider(c)
+	}
+	return nil, fmt.Errorf("unknown DNS provider '%s'", c.Provider)
+}
+
+// timeout returns how long to wait for records to
+// propagate, and how often to check in the meantime.
+func (c DNSConfig) timeout() (timeout, interval time.Duration) {
+	if c.Timeout == 0 {
+		return DefaultDNSTimeout, dnsPollInterval
+	}
+	return c.Timeout, dnsPollInterval
+}
@@ -0,0 +1,65 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// execProvider solves the dns-01 challenge by running a script,
+// which lets certs use any DNS backend that can be scripted.
+type execProvider struct {
+	config DNSConfig
+}
+
+// Present runs the script to set the TXT record for domain,
+// then waits for the configured propagation wait.
+func (p execProvider) Present(domain, token, keyAuth string) error {
+	fqdn, value, ttl := acme.DNS01Record(domain, keyAuth)
+	err := p.run("present", fqdn, value, ttl)
+	if err != nil {
+		return err
+	}
+	time.Sleep(p.config.PropagationWait)
+	return nil
+}
+
+// CleanUp runs the script to remove the TXT record for domain.
+func (p execProvider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, value, ttl := acme.DNS01Record(domain, keyAuth)
+	return p.run("cleanup", fqdn, value, ttl)
+}
+
+// Timeout returns how long to wait for the record to propagate.
+func (p execProvider) Timeout() (timeout, interval time.Duration) {
+	return p.config.timeout()
+}
+
+// run runs the script with action and the record's
+// FQDN, value and TTL as arguments.
+func (p execProvider) run(action, fqdn, value string, ttl int) error {
+	cmd := exec.Command(p.config.Exec, action, fqdn, value, strconv.Itoa(ttl))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("DNS script %s %s %s: %v: %s", p.config.Exec, action, fqdn, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
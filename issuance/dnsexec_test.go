@@ -0,0 +1,114 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// dnsScript writes a script into dir that appends its
+// arguments to a log file, and fails for names in fail.
+// It returns the paths of the script and the log.
+func dnsScript(t *testing.T, dir string, fail string) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("DNS scripts in tests need sh")
+	}
+	logFile := filepath.Join(dir, "dns.log")
+	script := filepath.Join(dir, "dns.sh")
+	contents := "#!/bin/sh\n" +
+		"case \"$2\" in _acme-challenge." + fail + ".) echo \"zone not found\"; exit 1;; esac\n" +
+		"echo \"$@\" >> " + logFile + "\n"
+	err := ioutil.WriteFile(script, []byte(contents), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script, logFile
+}
+
+func TestExecProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs_dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script, logFile := dnsScript(t, dir, "bad.example.com")
+
+	p := execProvider{config: DNSConfig{Provider: "exec", Exec: script, PropagationWait: 50 * time.Millisecond}}
+	start := time.Now()
+	err = p.Present("example.com", "token", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if time.Since(start) < p.config.PropagationWait {
+		t.Error("Expected Present to wait for the propagation wait")
+	}
+	err = p.CleanUp("example.com", "token", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("Expected no error cleaning up, got: %v", err)
+	}
+
+	fqdn, value, ttl := acme.DNS01Record("example.com", "token.thumbprint")
+	logged, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "present " + fqdn + " " + value + " 120\ncleanup " + fqdn + " " + value + " 120\n"
+	if ttl != 120 || string(logged) != expected {
+		t.Errorf("Expected script to be run with:\n%s\ngot:\n%s", expected, logged)
+	}
+
+	err = p.Present("bad.example.com", "token", "token.thumbprint")
+	if err == nil || !strings.Contains(err.Error(), "zone not found") {
+		t.Errorf("Expected error with the script's output, got: %v", err)
+	}
+
+	if timeout, _ := p.Timeout(); timeout != DefaultDNSTimeout {
+		t.Errorf("Expected default timeout %v, got %v", DefaultDNSTimeout, timeout)
+	}
+	p.config.Timeout = 5 * time.Minute
+	if timeout, _ := p.Timeout(); timeout != 5*time.Minute {
+		t.Errorf("Expected configured timeout, got %v", timeout)
+	}
+}
+
+func TestDNSConfigValidate(t *testing.T) {
+	for i, test := range []struct {
+		config    DNSConfig
+		shouldErr bool
+	}{
+		{DNSConfig{Provider: "exec", Exec: "update-dns"}, false},
+		{DNSConfig{Provider: "exec", Exec: "update-dns", PropagationWait: time.Minute, Timeout: 5 * time.Minute}, false},
+		{DNSConfig{Provider: "exec"}, true},
+		{DNSConfig{Provider: "exec", Exec: "update-dns", Timeout: -time.Second}, true},
+		{DNSConfig{Provider: "route53"}, true},
+		{DNSConfig{}, true},
+	} {
+		err := test.config.Validate()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+	}
+}
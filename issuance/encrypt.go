@@ -0,0 +1,410 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// EncryptedStorage is a Storage that encrypts private key files
+// before they are stored in the underlying Storage and decrypts
+// them when they are loaded. All other files pass through as-is.
+//
+// Files are encrypted with AES-256-GCM using a master key that
+// is derived from a secret (a passphrase or the contents of a key
+// file) with scrypt. The KDF parameters are kept in the workspace,
+// so the same secret always yields the same master key.
+//
+// Private key files that are not encrypted, for example because
+// they were stored before encryption was enabled, are loaded
+// as-is; use Rekey to encrypt them.
+type EncryptedStorage struct {
+	Storage
+	params kdfParams
+	key    []byte
+}
+
+// kdfParams are the parameters used to derive
+// the master key from the secret.
+type kdfParams struct {
+	KDF  string `json:"kdf"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+
+	// Check is a known value encrypted with the master
+	// key, so that a wrong secret can be detected early.
+	Check []byte `json:"check"`
+}
+
+// validate returns an error if p cannot have been written by
+// newEncryptedStorage: the salt must be at least 16 bytes, and
+// N, R and P must be within bounds that scrypt can compute in
+// a reasonable amount of memory.
+func (p kdfParams) validate() error {
+	if p.KDF != "scrypt" {
+		return fmt.Errorf("unsupported KDF: %s", p.KDF)
+	}
+	if len(p.Salt) < 16 {
+		return fmt.Errorf("salt must be at least 16 bytes, got %d", len(p.Salt))
+	}
+	if p.N < 2 || p.N > 1<<20 || p.N&(p.N-1) != 0 {
+		return fmt.Errorf("scrypt N must be a power of 2 up to %d, got %d", 1<<20, p.N)
+	}
+	if p.R < 1 || p.R > 32 || p.P < 1 || p.P > 16 {
+		return fmt.Errorf("scrypt r and p must be within 1-32 and 1-16, got %d and %d", p.R, p.P)
+	}
+	return nil
+}
+
+// IsEncrypted returns true if encryption
+// has been enabled for the workspace in s.
+func IsEncrypted(s Storage) bool {
+	return s.Exists(encryptionFile)
+}
+
+// OpenWorkspace returns the Storage for the workspace in the
+// folder dir. If secret is not empty, private keys in it are
+// encrypted with a master key derived from secret; otherwise,
+// the workspace must not be encrypted.
+func OpenWorkspace(dir string, secret []byte) (Storage, error) {
+	storage := FileStorage(dir)
+	if len(secret) > 0 {
+		return OpenEncryptedStorage(storage, secret)
+	}
+	if IsEncrypted(storage) {
+		return nil, fmt.Errorf("workspace %s is encrypted; set %s or use a master key file", dir, PassphraseEnv)
+	}
+	return storage, nil
+}
+
+// ReadSecret returns the secret for workspace encryption: the
+// contents of keyFile if it is not empty, otherwise the value of
+// the PassphraseEnv environment variable. It returns nil if there
+// is neither. A trailing newline in keyFile is ignored.
+func ReadSecret(keyFile string) ([]byte, error) {
+	if keyFile == "" {
+		if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+			return []byte(passphrase), nil
+		}
+		return nil, nil
+	}
+	secret, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	secret = bytes.TrimRight(secret, "\r\n")
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("master key file %s is empty", keyFile)
+	}
+	return secret, nil
+}
+
+// PassphraseEnv is the environment variable that
+// holds the passphrase for workspace encryption.
+const PassphraseEnv = "CERTS_PASSPHRASE"
+
+// OpenEncryptedStorage wraps s in an EncryptedStorage with the
+// master key derived from secret. If encryption has not been
+// enabled for the workspace in s yet, it is enabled now.
+func OpenEncryptedStorage(s Storage, secret []byte) (*EncryptedStorage, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret for workspace encryption must not be empty")
+	}
+
+	paramsBytes, err := s.Load(encryptionFile)
+	if os.IsNotExist(err) {
+		e, err := newEncryptedStorage(s, secret)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("[INFO] Enabling encryption of private keys in workspace")
+		return e, e.saveParams()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EncryptedStorage{Storage: s}
+	err = json.Unmarshal(paramsBytes, &e.params)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", encryptionFile, err)
+	}
+	err = e.params.validate()
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", encryptionFile, err)
+	}
+	e.key, err = scrypt.Key(secret, e.params.Salt, e.params.N, e.params.R, e.params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	check, err := e.open(encryptionFile, e.params.Check)
+	if err != nil || string(check) != checkValue {
+		return nil, fmt.Errorf("wrong secret for workspace encryption")
+	}
+
+	return e, nil
+}
+
+// newEncryptedStorage makes an EncryptedStorage for s with
+// a master key derived from secret with a new salt.
+func newEncryptedStorage(s Storage, secret []byte) (*EncryptedStorage, error) {
+	e := &EncryptedStorage{
+		Storage: s,
+		params:  kdfParams{KDF: "scrypt", Salt: make([]byte, 16), N: 1 << 15, R: 8, P: 1},
+	}
+	_, err := io.ReadFull(rand.Reader, e.params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	e.key, err = scrypt.Key(secret, e.params.Salt, e.params.N, e.params.R, e.params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	e.params.Check, err = e.seal(encryptionFile, []byte(checkValue))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// saveParams stores the KDF parameters of e in the workspace.
+func (e *EncryptedStorage) saveParams() error {
+	jsonBytes, err := json.MarshalIndent(e.params, "", "\t")
+	if err != nil {
+		return err
+	}
+	return e.Storage.Store(encryptionFile, jsonBytes)
+}
+
+// Load loads the file of key, decrypting it if it is
+// an encrypted private key.
+func (e *EncryptedStorage) Load(key string) ([]byte, error) {
+	value, err := e.Storage.Load(key)
+	if err != nil || !encrypts(key) {
+		return value, err
+	}
+	block, _ := pem.Decode(value)
+	if block == nil || block.Type != encryptedBlockType {
+		return value, nil // not encrypted (yet)
+	}
+	if id := block.Headers["Key-Id"]; id != e.keyID() {
+		return nil, fmt.Errorf("%s is encrypted with a different master key (%s)", key, id)
+	}
+	return e.open(key, block.Bytes)
+}
+
+// Store encrypts value if it is a private
+// key and stores it in the file of key.
+func (e *EncryptedStorage) Store(key string, value []byte) error {
+	if !encrypts(key) {
+		return e.Storage.Store(key, value)
+	}
+	ciphertext, err := e.seal(key, value)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{
+		Type:    encryptedBlockType,
+		Headers: map[string]string{"Key-Id": e.keyID()},
+		Bytes:   ciphertext,
+	}
+	return e.Storage.Store(key, pem.EncodeToMemory(block))
+}
+
+// Rekey derives a new master key from newSecret and a new salt,
+// re-encrypts every private key file in the workspace with it,
+// and replaces the KDF parameters. Private key files that were
+// not encrypted yet are encrypted too.
+//
+// If Rekey is interrupted, the workspace holds files encrypted
+// with both keys; run Rekey again with the same old and new
+// secrets to finish.
+func (e *EncryptedStorage) Rekey(newSecret []byte) error {
+	if len(newSecret) == 0 {
+		return fmt.Errorf("secret for workspace encryption must not be empty")
+	}
+
+	err := e.Storage.Lock(encryptionFile)
+	if err != nil {
+		return err
+	}
+	defer e.Storage.Unlock(encryptionFile)
+
+	next, err := newEncryptedStorage(e.Storage, newSecret)
+	if err != nil {
+		return err
+	}
+	pending, err := e.pendingRekey(newSecret)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		next = pending // finish an interrupted rekey
+	}
+	pendingBytes, err := json.Marshal(next.params)
+	if err != nil {
+		return err
+	}
+	err = e.Storage.Store(encryptionFile+".next", pendingBytes)
+	if err != nil {
+		return err
+	}
+
+	keys, err := e.Storage.List("")
+	if err != nil {
+		return err
+	}
+	var count int
+	for _, key := range keys {
+		if !encrypts(key) {
+			continue
+		}
+		raw, err := e.Storage.Load(key)
+		if err != nil {
+			return err
+		}
+		if block, _ := pem.Decode(raw); block != nil && block.Headers["Key-Id"] == next.keyID() {
+			continue // already done
+		}
+		value, err := e.Load(key)
+		if err != nil {
+			return err
+		}
+		err = next.Store(key, value)
+		if err != nil {
+			return fmt.Errorf("re-encrypting %s: %v", key, err)
+		}
+		count++
+	}
+
+	err = next.saveParams()
+	if err != nil {
+		return err
+	}
+	e.params, e.key = next.params, next.key
+	log.Printf("[INFO] Re-encrypted %d private keys with new master key", count)
+
+	return e.Storage.Delete(encryptionFile + ".next")
+}
+
+// pendingRekey returns the EncryptedStorage of an interrupted
+// rekey to newSecret, or nil if there is none.
+func (e *EncryptedStorage) pendingRekey(newSecret []byte) (*EncryptedStorage, error) {
+	pendingBytes, err := e.Storage.Load(encryptionFile + ".next")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pending := &EncryptedStorage{Storage: e.Storage}
+	err = json.Unmarshal(pendingBytes, &pending.params)
+	if err != nil {
+		return nil, err
+	}
+	err = pending.params.validate()
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s.next: %v", encryptionFile, err)
+	}
+	pending.key, err = scrypt.Key(newSecret, pending.params.Salt, pending.params.N, pending.params.R, pending.params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	check, err := pending.open(encryptionFile, pending.params.Check)
+	if err != nil || string(check) != checkValue {
+		return nil, fmt.Errorf("an interrupted rekey used a different new secret")
+	}
+	return pending, nil
+}
+
+// seal encrypts plaintext for the file of key. The nonce
+// is prepended to the ciphertext, and key is authenticated
+// with it, so encrypted files cannot be swapped.
+func (e *EncryptedStorage) seal(key string, plaintext []byte) ([]byte, error) {
+	aead, err := e.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(key)), nil
+}
+
+// open decrypts ciphertext that was sealed for the file of key.
+func (e *EncryptedStorage) open(key string, ciphertext []byte) ([]byte, error) {
+	aead, err := e.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("decrypting %s: ciphertext too short", key)
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", key, err)
+	}
+	return plaintext, nil
+}
+
+func (e *EncryptedStorage) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyID identifies the master key of e by its salt,
+// without revealing anything about the key itself.
+func (e *EncryptedStorage) keyID() string {
+	return hex.EncodeToString(e.params.Salt[:8])
+}
+
+// encrypts returns true if the file of key is encrypted.
+func encrypts(key string) bool {
+	return strings.HasSuffix(key, ".key")
+}
+
+const (
+	// The value that is encrypted with the
+	// master key to verify the secret.
+	checkValue = "certs workspace"
+
+	// The file that stores the KDF parameters.
+	encryptionFile = "encryption.json"
+
+	// The PEM block type of encrypted files.
+	encryptedBlockType = "CERTS ENCRYPTED DATA"
+)
@@ -0,0 +1,205 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ExportFormat is a format a site's certificate can be exported in.
+type ExportFormat string
+
+// The export formats.
+const (
+	// ExportPKCS12 is a password-protected PKCS#12 file (.p12 or
+	// .pfx) with the key, certificate and chain, which Java's
+	// keytool and Windows can import.
+	ExportPKCS12 ExportFormat = "pkcs12"
+
+	// ExportDER is the certificate alone, DER-encoded.
+	ExportDER ExportFormat = "der"
+
+	// ExportLeaf is the certificate alone, PEM-encoded.
+	ExportLeaf ExportFormat = "leaf"
+
+	// ExportChain is the chain without the certificate, PEM-encoded.
+	ExportChain ExportFormat = "chain"
+
+	// ExportFullchain is the certificate followed by the chain,
+	// PEM-encoded.
+	ExportFullchain ExportFormat = "fullchain"
+
+	// ExportCombined is the private key followed by the certificate
+	// and the chain, PEM-encoded, as HAProxy expects.
+	ExportCombined ExportFormat = "combined"
+)
+
+// ParseExportFormat returns the ExportFormat named s, ignoring case.
+func ParseExportFormat(s string) (ExportFormat, error) {
+	f := ExportFormat(strings.ToLower(s))
+	switch f {
+	case ExportPKCS12, ExportDER, ExportLeaf, ExportChain, ExportFullchain, ExportCombined:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format '%s'; must be one of pkcs12, der, leaf, chain, fullchain, combined", s)
+}
+
+// needsKey returns true if exports in format f include the private key.
+func (f ExportFormat) needsKey() bool {
+	return f == ExportPKCS12 || f == ExportCombined
+}
+
+// Export is a file a site's certificate is exported to each
+// time it is issued or renewed, in addition to its Output.
+type Export struct {
+	// Format is the format of the file.
+	Format ExportFormat `json:"format"`
+
+	// Path is the file to write.
+	Path string `json:"path"`
+
+	// PasswordFile is the file with the password that
+	// protects PKCS#12 exports. The password itself is
+	// never stored in the workspace.
+	PasswordFile string `json:"password_file,omitempty"`
+}
+
+// ReadPassword returns the contents of file, without a
+// trailing newline, for use as an export password.
+func ReadPassword(file string) (string, error) {
+	password, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// ExportSite returns the certificate of the site named site in
+// format. PKCS#12 exports are protected with password.
+func (m *Manager) ExportSite(site string, format ExportFormat, password string) ([]byte, error) {
+	certBytes, err := m.Storage.Load(SiteCertFile(site))
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", site, err)
+	}
+
+	var keyPEM []byte
+	if format.needsKey() {
+		keyPEM, err = m.Storage.Load(SiteKeyFile(site))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: the private key is not in the workspace, so it can't be exported as %s", site, format)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: loading private key: %v", site, err)
+		}
+	}
+
+	switch format {
+	case ExportPKCS12:
+		if password == "" {
+			return nil, fmt.Errorf("%s: a password is required to export as %s", site, format)
+		}
+		key, err := ParsePrivateKey(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", site, err)
+		}
+		// the legacy algorithms are the ones that
+		// older versions of Java and Windows can read
+		return pkcs12.Legacy.Encode(key, certs[0], certs[1:], password)
+	case ExportDER:
+		return certs[0].Raw, nil
+	case ExportLeaf:
+		return encodeCertificates(certs[:1]), nil
+	case ExportChain:
+		return encodeCertificates(certs[1:]), nil
+	case ExportFullchain:
+		return encodeCertificates(certs), nil
+	case ExportCombined:
+		return append(keyPEM, encodeCertificates(certs)...), nil
+	}
+	return nil, fmt.Errorf("unknown export format '%s'", format)
+}
+
+// encodeCertificates PEM-encodes certs, one after another.
+func encodeCertificates(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// writeExport writes the export e of the site named site.
+func (m *Manager) writeExport(site string, e Export) error {
+	var password string
+	if e.PasswordFile != "" {
+		var err error
+		password, err = ReadPassword(e.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading export password: %v", err)
+		}
+	}
+	return m.WriteExport(site, e.Format, e.Path, password)
+}
+
+// WriteExport writes the certificate of the site named site in
+// format to the file at path, replacing it atomically. Files with
+// the private key in them are only readable by their owner.
+// PKCS#12 exports are protected with password.
+func (m *Manager) WriteExport(site string, format ExportFormat, path, password string) error {
+	data, err := m.ExportSite(site, format, password)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if format.needsKey() {
+		perm = 0600
+	}
+	return writeFile(path, data, perm)
+}
+
+// AddExport adds e to the exports of the site named site, which
+// are written each time its certificate is issued or renewed. An
+// export to the same path is replaced.
+func (m *Manager) AddExport(site string, e Export) error {
+	meta, err := m.loadSiteMeta(site)
+	if err != nil {
+		return err
+	}
+	out := new(Output)
+	if meta.Output != nil {
+		*out = *meta.Output
+	}
+	var exports []Export
+	for _, existing := range out.Exports {
+		if existing.Path != e.Path {
+			exports = append(exports, existing)
+		}
+	}
+	out.Exports = append(exports, e)
+	meta.Output = out
+	return m.saveSiteMeta(meta)
+}
@@ -0,0 +1,208 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExportSite(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+	certPEM, keyPEM := selfSignedPEM(t, []string{"example.com"}, time.Now().Add(24*time.Hour))
+	issuerPEM, _ := selfSignedPEM(t, []string{"Test CA"}, time.Now().Add(24*time.Hour))
+	m.Storage.Store(SiteCertFile("example.com"), append(append([]byte(nil), certPEM...), issuerPEM...))
+	m.Storage.Store(SiteKeyFile("example.com"), keyPEM)
+
+	for _, test := range []struct {
+		format   ExportFormat
+		expected []byte
+	}{
+		{ExportLeaf, certPEM},
+		{ExportChain, issuerPEM},
+		{ExportFullchain, append(append([]byte(nil), certPEM...), issuerPEM...)},
+		{ExportCombined, append(append(append([]byte(nil), keyPEM...), certPEM...), issuerPEM...)},
+	} {
+		actual, err := m.ExportSite("example.com", test.format, "")
+		if err != nil {
+			t.Errorf("%s: Expected no error, got: %v", test.format, err)
+			continue
+		}
+		if !bytes.Equal(actual, test.expected) {
+			t.Errorf("%s: Expected %q, got %q", test.format, test.expected, actual)
+		}
+	}
+
+	cert, err := loadCertificate(m.Storage, SiteCertFile("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := m.ExportSite("example.com", ExportDER, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !bytes.Equal(der, cert.Raw) {
+		t.Error("Expected DER export to be the certificate")
+	}
+
+	if _, err := m.ExportSite("example.com", ExportPKCS12, ""); err == nil {
+		t.Error("Expected error exporting PKCS#12 without a password, but got none")
+	}
+	pfx, err := m.ExportSite("example.com", ExportPKCS12, "secret")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	key, p12Cert, chain, err := pkcs12.DecodeChain(pfx, "secret")
+	if err != nil {
+		t.Fatalf("Expected PKCS#12 export to decode, got: %v", err)
+	}
+	if !keyMatchesCert(key, p12Cert) || len(chain) != 1 || chain[0].Subject.CommonName != "Test CA" {
+		t.Errorf("Expected key, certificate and chain in PKCS#12 export, got %v and chain %v", p12Cert.Subject, chain)
+	}
+
+	// certificates obtained for a CSR have no key to export
+	m.Storage.Delete(SiteKeyFile("example.com"))
+	if _, err := m.ExportSite("example.com", ExportCombined, ""); err == nil {
+		t.Error("Expected error exporting the key of a certificate without one, but got none")
+	}
+	if _, err := m.ExportSite("example.com", ExportFullchain, ""); err != nil {
+		t.Errorf("Expected no error exporting the chain without a key, got: %v", err)
+	}
+}
+
+func TestAddExportAndDeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs_export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Manager{Storage: new(MemoryStorage)}
+	certPEM, keyPEM := selfSignedPEM(t, []string{"example.com"}, time.Now().Add(24*time.Hour))
+	err = m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.com",
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}, Bundle{Names: []string{"example.com"}}, KeyGenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passwordFile := filepath.Join(dir, "password")
+	err = ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12 := filepath.Join(dir, "example.com.p12")
+	der := filepath.Join(dir, "example.com.der")
+	for _, e := range []Export{
+		{Format: ExportLeaf, Path: der},
+		{Format: ExportPKCS12, Path: p12, PasswordFile: passwordFile},
+		{Format: ExportDER, Path: der},
+	} {
+		err := m.AddExport("example.com", e)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	bundle, _, err := m.renewalBundle([]string{"example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Output.Exports) != 2 {
+		t.Fatalf("Expected export to the same path to be replaced, got %+v", bundle.Output.Exports)
+	}
+
+	err = m.deploy("example.com", bundle)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	pfx, err := ioutil.ReadFile(p12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := pkcs12.Decode(pfx, "secret"); err != nil {
+		t.Errorf("Expected PKCS#12 export with the password from the file, got: %v", err)
+	}
+	derBytes, err := ioutil.ReadFile(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := loadCertificate(m.Storage, SiteCertFile("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(derBytes, cert.Raw) {
+		t.Error("Expected DER export to be written")
+	}
+}
+
+func TestWriteExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs_export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Manager{Storage: new(MemoryStorage)}
+	certPEM, keyPEM := selfSignedPEM(t, []string{"example.com"}, time.Now().Add(24*time.Hour))
+	err = m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.com",
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}, Bundle{Names: []string{"example.com"}}, KeyGenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing file that is readable by all must not stay
+	// that way once the private key is written to it
+	path := filepath.Join(dir, "example.com.pem")
+	err = ioutil.WriteFile(path, []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		format ExportFormat
+		perm   os.FileMode
+	}{
+		{format: ExportCombined, perm: 0600},
+		{format: ExportFullchain, perm: 0644},
+	} {
+		err := m.WriteExport("example.com", test.format, path, "")
+		if err != nil {
+			t.Fatalf("%s: Expected no error, got: %v", test.format, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != test.perm {
+			t.Errorf("%s: Expected permissions %v, got %v", test.format, test.perm, info.Mode().Perm())
+		}
+		data, _ := ioutil.ReadFile(path)
+		if expected, _ := m.ExportSite("example.com", test.format, ""); !bytes.Equal(data, expected) {
+			t.Errorf("%s: Expected export to be written, got:\n%s", test.format, data)
+		}
+	}
+}
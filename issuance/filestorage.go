@@ -0,0 +1,157 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileStorage is a Storage that keeps assets in a folder on
+// the local file system. Each key is a file path relative to
+// the root folder.
+type FileStorage string
+
+// Path returns the file path of key.
+func (s FileStorage) Path(key string) string {
+	return filepath.Join(string(s), filepath.FromSlash(key))
+}
+
+// Load reads the file of key.
+func (s FileStorage) Load(key string) ([]byte, error) {
+	return ioutil.ReadFile(s.Path(key))
+}
+
+// Store writes value to the file of key, readable only by
+// the owner. The file is replaced atomically, so readers
+// never see a partially written file.
+func (s FileStorage) Store(key string, value []byte) error {
+	file := s.Path(key)
+	dir := filepath.Dir(file)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, tempFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op if renamed
+
+	err = tmp.Chmod(0600)
+	if err == nil {
+		_, err = tmp.Write(value)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// Delete removes the file or folder of key.
+func (s FileStorage) Delete(key string) error {
+	return os.RemoveAll(s.Path(key))
+}
+
+// Exists returns true if the file of key exists.
+func (s FileStorage) Exists(key string) bool {
+	info, err := os.Stat(s.Path(key))
+	return err == nil && !info.IsDir()
+}
+
+// List walks the folder of prefix and returns the
+// keys of the files in it.
+func (s FileStorage) List(prefix string) ([]string, error) {
+	var keys []string
+	root := s.Path(prefix)
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if file == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || isBookkeepingFile(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(string(s), file)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Lock creates a lock file for key, waiting for it to be removed
+// if another process holds the lock. A lock file that is older
+// than staleLockAge is assumed to be left over from a process
+// that died, and is taken over.
+func (s FileStorage) Lock(key string) error {
+	lockFile := s.Path(key) + lockFileSuffix
+
+	err := os.MkdirAll(filepath.Dir(lockFile), 0700)
+	if err != nil {
+		return err
+	}
+
+	for {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			return f.Close()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(lockFile); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			os.Remove(lockFile)
+			continue
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// Unlock removes the lock file for key.
+func (s FileStorage) Unlock(key string) error {
+	return os.Remove(s.Path(key) + lockFileSuffix)
+}
+
+// isBookkeepingFile returns true for lock files and temporary
+// files, which are not values in storage.
+func isBookkeepingFile(name string) bool {
+	return strings.HasSuffix(name, lockFileSuffix) || strings.HasPrefix(name, tempFilePrefix)
+}
+
+const (
+	lockFileSuffix   = ".lock"
+	tempFilePrefix   = ".tmp-"
+	lockPollInterval = 100 * time.Millisecond
+	staleLockAge     = 10 * time.Minute
+)
@@ -0,0 +1,307 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Index is a lightweight database of the certificates in the
+// workspace, which keeps track of which site has the certificate
+// for each name, and the basics of each certificate. It is updated
+// each time a site's certificate or metadata is saved, and can be
+// rebuilt from the sites with Reindex.
+type Index struct {
+	// Sites maps each site to its entry.
+	Sites map[string]IndexSite `json:"sites"`
+
+	// Names maps each name to the site whose certificate
+	// covers it. If more than one does, it is the one that
+	// was saved last.
+	Names map[string]string `json:"names"`
+}
+
+// IndexSite is the entry of a site in the Index.
+type IndexSite struct {
+	// Names are the names on the site's certificate,
+	// with the Common Name first.
+	Names []string `json:"names"`
+
+	// Dropped are names that were requested for the
+	// certificate but dropped because they failed
+	// validation.
+	Dropped []string `json:"dropped,omitempty"`
+
+	// Serial is the certificate's serial number in hex,
+	// and Issuer is the Common Name of its issuer.
+	Serial string `json:"serial,omitempty"`
+	Issuer string `json:"issuer,omitempty"`
+
+	// NotBefore and NotAfter bound the certificate's
+	// validity period.
+	NotBefore time.Time `json:"not_before,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+
+	// Account is the email address of the account that
+	// obtained the certificate; empty for the default one.
+	Account string `json:"account,omitempty"`
+
+	// Status is the status of the certificate when the
+	// entry was written; see also CurrentStatus.
+	Status SiteStatus `json:"status"`
+}
+
+// SiteStatus is the status of a site's certificate.
+type SiteStatus string
+
+// The statuses of a site's certificate.
+const (
+	StatusValid   SiteStatus = "valid"
+	StatusExpired SiteStatus = "expired"
+	StatusRevoked SiteStatus = "revoked"
+)
+
+// CurrentStatus returns the status of the certificate now,
+// which is StatusExpired once a valid certificate has expired.
+func (e IndexSite) CurrentStatus() SiteStatus {
+	if e.Status == StatusValid && !e.NotAfter.IsZero() && time.Now().After(e.NotAfter) {
+		return StatusExpired
+	}
+	return e.Status
+}
+
+// Site returns the site whose certificate covers name.
+func (idx *Index) Site(name string) (string, bool) {
+	site, ok := idx.Names[strings.ToLower(name)]
+	return site, ok
+}
+
+// setSite sets the entry of site to entry, pointing each
+// of its names at it. Names that the site used to have
+// but no longer does are removed, unless another site
+// covers them.
+func (idx *Index) setSite(site string, entry IndexSite) {
+	site = strings.ToLower(site)
+	if idx.Sites == nil {
+		idx.Sites = make(map[string]IndexSite)
+	}
+	if idx.Names == nil {
+		idx.Names = make(map[string]string)
+	}
+	old := idx.Sites[site].Names
+	idx.Sites[site] = entry
+	for _, name := range old {
+		if idx.Names[name] != site {
+			continue
+		}
+		delete(idx.Names, name)
+		for other, e := range idx.Sites {
+			if other != site && containsName(e.Names, name) {
+				idx.Names[name] = other
+				break
+			}
+		}
+	}
+	for _, name := range entry.Names {
+		idx.Names[name] = site
+	}
+}
+
+// LoadIndex loads the index of the workspace. If there is
+// no index yet, an empty one is returned.
+func (m *Manager) LoadIndex() (*Index, error) {
+	idx := new(Index)
+	jsonBytes, err := m.Storage.Load(IndexFile)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(jsonBytes, idx)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// updateIndex loads the index, calls update with it, and saves
+// it, all while holding the index's lock.
+func (m *Manager) updateIndex(update func(*Index)) error {
+	err := m.Storage.Lock(IndexFile)
+	if err != nil {
+		return err
+	}
+	defer m.Storage.Unlock(IndexFile)
+
+	idx, err := m.LoadIndex()
+	if err != nil {
+		return err
+	}
+	update(idx)
+	jsonBytes, err := json.MarshalIndent(idx, "", "\t")
+	if err != nil {
+		return err
+	}
+	return m.Storage.Store(IndexFile, jsonBytes)
+}
+
+// Reindex rebuilds the index of the workspace from the
+// certificates and metadata of its sites, and saves it.
+func (m *Manager) Reindex() (*Index, error) {
+	sites, err := SiteNames(m.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	var idx *Index
+	err = m.updateIndex(func(old *Index) {
+		idx = new(Index)
+		for _, site := range sites {
+			if !m.Storage.Exists(SiteCertFile(site)) {
+				continue
+			}
+			meta, err := m.loadSiteMeta(site)
+			if err != nil {
+				log.Printf("[WARNING] Indexing %s: loading metadata: %v", site, err)
+			}
+			idx.setSite(site, m.siteIndexEntry(site, meta))
+		}
+		*old = *idx
+	})
+	return idx, err
+}
+
+// siteIndexEntry returns the index entry for site, which has
+// the metadata meta, from the certificate in storage. If the
+// certificate can't be loaded, the entry has only the site's
+// name and what is in meta.
+func (m *Manager) siteIndexEntry(site string, meta SiteMeta) IndexSite {
+	entry := IndexSite{
+		Names:   []string{strings.ToLower(site)},
+		Dropped: meta.Dropped,
+		Account: meta.Account,
+		Status:  StatusValid,
+	}
+	if meta.Revoked != nil {
+		entry.Status = StatusRevoked
+	}
+	cert, err := loadCertificate(m.Storage, SiteCertFile(site))
+	if err != nil {
+		return entry
+	}
+	if names := certDomains(cert); len(names) > 0 {
+		entry.Names = names
+	}
+	entry.Serial = fmt.Sprintf("%x", cert.SerialNumber)
+	entry.Issuer = cert.Issuer.CommonName
+	entry.NotBefore = cert.NotBefore.UTC()
+	entry.NotAfter = cert.NotAfter.UTC()
+	if entry.Status == StatusValid && time.Now().After(cert.NotAfter) {
+		entry.Status = StatusExpired
+	}
+	return entry
+}
+
+// indexedSite returns the entry of site in the index. Sites
+// that were saved before the workspace had an index are
+// looked up in their certificate and metadata instead.
+func (m *Manager) indexedSite(site string) (IndexSite, error) {
+	idx, err := m.LoadIndex()
+	if err != nil {
+		return IndexSite{}, err
+	}
+	if entry, ok := idx.Sites[strings.ToLower(site)]; ok {
+		return entry, nil
+	}
+	if _, err := loadCertificate(m.Storage, SiteCertFile(site)); err != nil {
+		return IndexSite{}, err
+	}
+	meta, err := m.loadSiteMeta(site)
+	if err != nil {
+		return IndexSite{}, err
+	}
+	return m.siteIndexEntry(site, meta), nil
+}
+
+// alreadyIssued returns true if a site has a certificate and
+// private key (or CSR) in storage, and the certificate is for
+// exactly names, ignoring order and case. The site is looked up
+// in the index by each of names, so it need not be named after
+// the first one. Names that were dropped from the certificate
+// because they failed validation count as being on it. If the
+// index or a site can't be read, the names are not considered
+// issued, so that a changed certificate is never skipped.
+func (m *Manager) alreadyIssued(names []string) bool {
+	idx, err := m.LoadIndex()
+	if err != nil {
+		log.Printf("[WARNING] Loading index: %v - not skipping %v", err, names)
+		return false
+	}
+
+	sites := []string{strings.ToLower(names[0])}
+	for _, name := range names {
+		if site, ok := idx.Site(name); ok && !containsName(sites, site) {
+			sites = append(sites, site)
+		}
+	}
+
+	for _, site := range sites {
+		if !m.existingCertAndKey(site) {
+			continue
+		}
+		entry, ok := idx.Sites[site]
+		if !ok {
+			// a site saved before the workspace had an index
+			entry, err = m.indexedSite(site)
+			if err != nil {
+				log.Printf("[WARNING] Loading %s: %v - not counting it as issued", site, err)
+				continue
+			}
+		}
+		have := append(append([]string(nil), entry.Names...), entry.Dropped...)
+		if sameNames(names, have) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameNames returns true if a and b have the
+// same names, ignoring order, case and repeats.
+func sameNames(a, b []string) bool {
+	set := func(names []string) map[string]bool {
+		s := make(map[string]bool)
+		for _, name := range names {
+			s[strings.ToLower(name)] = true
+		}
+		return s
+	}
+	sa, sb := set(a), set(b)
+	if len(sa) != len(sb) {
+		return false
+	}
+	for name := range sa {
+		if !sb[name] {
+			return false
+		}
+	}
+	return true
+}
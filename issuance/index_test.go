@@ -0,0 +1,196 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestIndexSetSite(t *testing.T) {
+	idx := new(Index)
+	idx.setSite("a.com", IndexSite{Names: []string{"a.com", "www.a.com", "shared.com"}})
+	idx.setSite("b.com", IndexSite{Names: []string{"b.com", "shared.com"}})
+
+	for name, expected := range map[string]string{"a.com": "a.com", "WWW.a.com": "a.com", "shared.com": "b.com", "b.com": "b.com"} {
+		if site, ok := idx.Site(name); !ok || site != expected {
+			t.Errorf("Expected %s to be covered by %s, got '%s'", name, expected, site)
+		}
+	}
+
+	// dropping names from a site
+	idx.setSite("b.com", IndexSite{Names: []string{"b.com"}})
+	idx.setSite("a.com", IndexSite{Names: []string{"a.com", "shared.com"}})
+	if _, ok := idx.Site("www.a.com"); ok {
+		t.Error("Expected www.a.com to be removed from the index, but it wasn't")
+	}
+	if site, _ := idx.Site("shared.com"); site != "a.com" {
+		t.Errorf("Expected shared.com to be covered by a.com, got '%s'", site)
+	}
+
+	// a name that another site still covers is kept
+	idx.setSite("b.com", IndexSite{Names: []string{"b.com", "shared.com"}})
+	idx.setSite("b.com", IndexSite{Names: []string{"b.com"}})
+	if site, _ := idx.Site("shared.com"); site != "a.com" {
+		t.Errorf("Expected shared.com to go back to a.com, got '%s'", site)
+	}
+}
+
+func TestAlreadyIssued(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+	names := []string{"example.com", "www.example.com"}
+	if m.alreadyIssued(names) {
+		t.Error("Expected no certificate in empty workspace")
+	}
+
+	// a site saved before the workspace had an index
+	certPEM, keyPEM := selfSignedPEM(t, names, time.Now().Add(24*time.Hour))
+	m.Storage.Store(SiteCertFile("example.com"), certPEM)
+	m.Storage.Store(SiteKeyFile("example.com"), keyPEM)
+	if !m.alreadyIssued([]string{"example.com", "WWW.example.com"}) {
+		t.Error("Expected certificate for the same names to be found without an index")
+	}
+	if m.alreadyIssued([]string{"example.com"}) {
+		t.Error("Expected certificate for different names not to count")
+	}
+
+	// saving indexes the names on the certificate itself
+	certPEM, keyPEM = selfSignedPEM(t, []string{"example.com"}, time.Now().Add(24*time.Hour))
+	err := m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.com",
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}, Bundle{Names: []string{"example.com"}, dropped: []string{"old.example.com"}}, KeyGenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := m.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if site, ok := idx.Site("example.com"); !ok || site != "example.com" {
+		t.Errorf("Expected example.com to be indexed, got '%s'", site)
+	}
+	if _, ok := idx.Site("www.example.com"); ok {
+		t.Error("Expected www.example.com not to be indexed, since it isn't on the certificate")
+	}
+
+	if m.alreadyIssued(names) {
+		t.Error("Expected changed names to need a new certificate")
+	}
+	if !m.alreadyIssued([]string{"example.com", "old.example.com"}) {
+		t.Error("Expected dropped names to count as being on the certificate")
+	}
+
+	// a site is found by any of its names
+	names = []string{"www.example.org", "example.org"}
+	certPEM, keyPEM = selfSignedPEM(t, []string{"example.org", "www.example.org"}, time.Now().Add(24*time.Hour))
+	err = m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.org",
+		Certificate: certPEM,
+		PrivateKey:  keyPEM,
+	}, Bundle{Names: []string{"example.org", "www.example.org"}}, KeyGenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.alreadyIssued(names) {
+		t.Error("Expected names covered by a site named after another of them to count as issued")
+	}
+	if m.alreadyIssued([]string{"www.example.org"}) {
+		t.Error("Expected a subset of the names on a certificate not to count")
+	}
+
+	// if the index can't be read, nothing counts as issued
+	m.Storage.Store(IndexFile, []byte("{corrupt"))
+	if m.alreadyIssued(names) {
+		t.Error("Expected names not to count as issued when the index is corrupt")
+	}
+}
+
+func TestReindex(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	for _, names := range [][]string{{"a.com", "www.a.com"}, {"b.com"}} {
+		certPEM, keyPEM := selfSignedPEM(t, names, notAfter)
+		err := m.saveCertResource(acme.CertificateResource{
+			Domain:      names[0],
+			Certificate: certPEM,
+			PrivateKey:  keyPEM,
+		}, Bundle{Names: names, account: "me@example.com"}, KeyGenerated)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	certPEM, _ := selfSignedPEM(t, []string{"old.com"}, time.Now().Add(-time.Hour))
+	m.Storage.Store(SiteCertFile("old.com"), certPEM)
+
+	// revoking a site updates its status
+	meta, err := m.loadSiteMeta("b.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Revoked = &Revocation{Reason: Superseded, Time: time.Now().UTC()}
+	err = m.saveSiteMeta(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := m.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := before.Sites["old.com"]; ok {
+		t.Error("Expected site stored without saving not to be indexed yet")
+	}
+
+	err = m.Storage.Delete(IndexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := m.Reindex()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	loaded, err := m.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(idx, loaded) {
+		t.Errorf("Expected saved index to be the one returned, got %+v", loaded)
+	}
+	for site, entry := range before.Sites {
+		if !reflect.DeepEqual(idx.Sites[site], entry) {
+			t.Errorf("Expected rebuilt entry for %s to be %+v, got %+v", site, entry, idx.Sites[site])
+		}
+	}
+
+	a := idx.Sites["a.com"]
+	if a.Serial == "" || a.Issuer == "" || !a.NotAfter.Equal(notAfter) || a.Account != "me@example.com" || a.Status != StatusValid {
+		t.Errorf("Expected complete entry for a.com, got %+v", a)
+	}
+	if site, _ := idx.Site("www.a.com"); site != "a.com" {
+		t.Errorf("Expected www.a.com to be covered by a.com, got '%s'", site)
+	}
+	if status := idx.Sites["b.com"].Status; status != StatusRevoked {
+		t.Errorf("Expected b.com to be %s, got %s", StatusRevoked, status)
+	}
+	if status := idx.Sites["old.com"].CurrentStatus(); status != StatusExpired {
+		t.Errorf("Expected old.com to be %s, got %s", StatusExpired, status)
+	}
+}
@@ -16,14 +16,102 @@
 // via the ACME protocol.
 package issuance
 
-// ServerURL is the URL to the ACME CA's directory. This must be
-// set before obtaining certificates.
+// ServerURL is the URL to the ACME CA's directory used by the
+// default Manager. This must be set before obtaining certificates.
 var ServerURL string
 
-// Agree is whether the user agrees to the CA's service agreement.
-// This need only be true if the user has not agreed before.
+// Agree is whether the user of the default Manager agrees to the
+// CA's service agreement. This need only be true if the user has
+// not agreed before.
 var Agree bool
 
+// Manager obtains and manages certificates with an ACME CA and
+// keeps their assets in a workspace. The package-level variables
+// configure a default Manager that the package-level functions
+// use; create a Manager to use more than one CA or workspace in
+// the same process.
+type Manager struct {
+	// ServerURL is the URL to the ACME CA's directory.
+	ServerURL string
+
+	// Agree is whether the user agrees to the CA's service
+	// agreement. This need only be true if the user has not
+	// agreed before.
+	Agree bool
+
+	// Storage is where assets are stored.
+	Storage Storage
+
+	// KeyType is the type of new private keys, both for
+	// accounts and for certificates that do not choose their
+	// own. If empty, DefaultKeyType is used.
+	KeyType KeyType
+
+	// Concurrency is how many certificates ObtainCerts and
+	// ObtainBundles obtain at once. The workers share the
+	// account's rate limit, so if any of them is rate
+	// limited, all of them pause. Values below 1 mean 1.
+	//
+	// Workers that solve the http-01 or tls-sni-01
+	// challenges by binding the same address take turns
+	// at it, so with those, only the rest of the work is
+	// done at once; use a webroot or the dns-01 challenge
+	// to obtain many at once.
+	Concurrency int
+
+	// KeepGoing is whether ObtainCerts and ObtainBundles go
+	// on to the other bundles when one fails, instead of
+	// starting no more.
+	KeepGoing bool
+
+	// DropFailedNames is whether a certificate is obtained
+	// without the SubjectAltNames that fail validation,
+	// rather than not at all. The Common Name must still
+	// validate. Dropped names are recorded in the site's
+	// metadata, and renewals try to add them back.
+	DropFailedNames bool
+
+	// Solver configures how challenges are solved for
+	// certificates whose bundles leave that up to the
+	// Manager; each field that a bundle's Solver leaves
+	// empty is taken from here. It is not recorded with
+	// the certificates, so renewals use the Solver of the
+	// Manager that renews them.
+	Solver Solver
+
+	// Force is whether ObtainCerts and ObtainBundles obtain
+	// certificates that are already in the workspace. By
+	// default, a bundle is skipped if its site has a
+	// certificate for exactly the same names.
+	Force bool
+}
+
+// defaultManager returns a Manager that is configured
+// with the package-level variables.
+func defaultManager() *Manager {
+	return &Manager{
+		ServerURL: ServerURL,
+		Agree:     Agree,
+		Storage:   Workspace,
+	}
+}
+
+// keyType returns the type of new private keys.
+func (m *Manager) keyType() KeyType {
+	if m.KeyType != "" {
+		return m.KeyType
+	}
+	return DefaultKeyType
+}
+
+// concurrency returns how many certificates to obtain at once.
+func (m *Manager) concurrency() int {
+	if m.Concurrency < 1 {
+		return 1
+	}
+	return m.Concurrency
+}
+
 // DefaultWorkspace is where assets will be stored if no custom
 // Workspace variable is set by the importing package.
 const DefaultWorkspace = "./certs_data"
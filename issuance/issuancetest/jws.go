@@ -0,0 +1,250 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuancetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// request is a verified request to one of the server's
+// resources, with the fields of all their payloads.
+type request struct {
+	Resource   string   `json:"resource"`
+	Contact    []string `json:"contact"`
+	Agreement  string   `json:"agreement"`
+	Identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"identifier"`
+	KeyAuthorization string `json:"keyAuthorization"`
+	CSR              string `json:"csr"`
+	Certificate      string `json:"certificate"`
+	Reason           *int   `json:"reason"`
+
+	thumbprint string   // of the key that signed the request
+	id         string   // the ID in the request's path
+	acct       *account // the account of the key, if any
+}
+
+// jws is a JSON web signature in flattened JSON serialization.
+type jws struct {
+	Protected string          `json:"protected"`
+	Header    json.RawMessage `json:"header"`
+	Payload   string          `json:"payload"`
+	Signature string          `json:"signature"`
+}
+
+// jwsHeader has the header fields the server uses.
+type jwsHeader struct {
+	Alg   string `json:"alg"`
+	Nonce string `json:"nonce"`
+	JWK   *jwk   `json:"jwk"`
+}
+
+// jwk is an RSA or ECDSA public key in JSON web key form.
+type jwk struct {
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseRequest verifies the signature and nonce of the JWS in
+// body, and decodes its payload. Nonces are used up.
+func (s *Server) parseRequest(body []byte) (*request, *Problem) {
+	var sig jws
+	err := json.Unmarshal(body, &sig)
+	if err != nil {
+		p := malformed("Parsing JWS: %v", err)
+		return nil, &p
+	}
+
+	// protected fields take precedence over unprotected ones
+	var header jwsHeader
+	if len(sig.Header) > 0 {
+		json.Unmarshal(sig.Header, &header)
+	}
+	protected, err := decodeBase64(sig.Protected)
+	if err == nil {
+		err = json.Unmarshal(protected, &header)
+	}
+	if err != nil || header.JWK == nil {
+		p := malformed("JWS has no valid protected header with a key")
+		return nil, &p
+	}
+
+	s.mu.Lock()
+	valid := s.nonces[header.Nonce]
+	delete(s.nonces, header.Nonce)
+	s.mu.Unlock()
+	if !valid {
+		return nil, &Problem{Type: "urn:acme:error:badNonce", Detail: "JWS has invalid anti-replay nonce", Status: http.StatusBadRequest}
+	}
+
+	pub, thumbprint, err := header.JWK.publicKey()
+	if err != nil {
+		p := malformed("Invalid JWK: %v", err)
+		return nil, &p
+	}
+	signature, err := decodeBase64(sig.Signature)
+	if err == nil {
+		err = verify(header.Alg, pub, []byte(sig.Protected+"."+sig.Payload), signature)
+	}
+	if err != nil {
+		p := malformed("JWS verification error: %v", err)
+		return nil, &p
+	}
+
+	payload, err := decodeBase64(sig.Payload)
+	if err != nil {
+		p := malformed("Decoding payload: %v", err)
+		return nil, &p
+	}
+	req := &request{thumbprint: thumbprint}
+	err = json.Unmarshal(payload, req)
+	if err != nil {
+		p := malformed("Parsing payload: %v", err)
+		return nil, &p
+	}
+	return req, nil
+}
+
+// publicKey returns the key k describes, and its
+// RFC 7638 thumbprint in base64url form.
+func (k *jwk) publicKey() (crypto.PublicKey, string, error) {
+	var thumb string
+	var pub crypto.PublicKey
+	switch k.Kty {
+	case "RSA":
+		n, err1 := decodeBase64(k.N)
+		e, err2 := decodeBase64(k.E)
+		if err1 != nil || err2 != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, "", fmt.Errorf("invalid RSA key")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		pub = key
+		thumb = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`,
+			encodeBase64(big.NewInt(int64(key.E)).Bytes()), encodeBase64(key.N.Bytes()))
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, "", fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err1 := decodeBase64(k.X)
+		y, err2 := decodeBase64(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, "", fmt.Errorf("invalid EC key")
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, "", fmt.Errorf("invalid EC key")
+		}
+		pub = key
+		size := (curve.Params().BitSize + 7) / 8
+		thumb = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`,
+			k.Crv, encodeBase64(padded(key.X, size)), encodeBase64(padded(key.Y, size)))
+	default:
+		return nil, "", fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+	sum := sha256.Sum256([]byte(thumb))
+	return pub, encodeBase64(sum[:]), nil
+}
+
+// verify checks that signature is the signature of
+// signed by pub with the JWS algorithm alg.
+func verify(alg string, pub crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	default:
+		sum := sha512.Sum512(signed)
+		digest = sum[:]
+	}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("algorithm %s does not match ECDSA key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", pub)
+}
+
+// padded returns the bytes of n, padded
+// with leading zeros to size bytes.
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeBase64 decodes base64url, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,756 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package issuancetest provides an in-process ACME server for
+// testing, which issues certificates from a throwaway root. It
+// can be scripted to fail in the ways a real CA does, so that
+// registration, retries and saving can be tested offline.
+package issuancetest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is a resource of the server that
+// can be scripted to fail with FailNext.
+type Endpoint string
+
+// The endpoints of the server.
+const (
+	NewReg     Endpoint = "new-reg"
+	Reg        Endpoint = "reg"
+	NewAuthz   Endpoint = "new-authz"
+	Challenge  Endpoint = "challenge"
+	NewCert    Endpoint = "new-cert"
+	RevokeCert Endpoint = "revoke-cert"
+)
+
+// Problem is an error returned by the server.
+type Problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+// Problems that are commonly scripted.
+var (
+	// RateLimited is what a CA says when there
+	// have been too many requests.
+	RateLimited = Problem{
+		Type:   "urn:acme:error:rateLimited",
+		Detail: "Error creating new cert :: Too many certificates already issued",
+		Status: 429,
+	}
+
+	// ServerError is an unexpected error of the CA.
+	ServerError = Problem{
+		Type:   "urn:acme:error:serverInternal",
+		Detail: "Internal server error",
+		Status: http.StatusInternalServerError,
+	}
+)
+
+// termsError is the detail of the error for accounts that
+// have not agreed to the current terms, which clients
+// recognize.
+const termsError = "Must agree to subscriber agreement before any further actions"
+
+// Server is an ACME server for testing. Create one with
+// NewServer and close it when done.
+type Server struct {
+	// URL is the base URL of the server.
+	URL string
+
+	// Root is the certificate that issued
+	// certificates are signed by.
+	Root *x509.Certificate
+
+	// Challenges are the types of challenges offered for
+	// each name, in order of preference. By default, they
+	// are http-01, tls-sni-01 and dns-01. Set before use.
+	Challenges []string
+
+	// Validity is how long issued certificates are
+	// valid for; by default, 90 days. Set before use.
+	Validity time.Duration
+
+	srv     *httptest.Server
+	rootKey crypto.Signer
+
+	mu       sync.Mutex
+	nonces   map[string]bool
+	accounts map[string]*account // by key thumbprint
+	authzs   map[string]*authz
+	chals    map[string]*challenge
+	certs    map[string]*issued // by serial
+	faults   map[Endpoint][]Problem
+	invalid  map[string]string // name to validation error
+	requests map[Endpoint]int
+	terms    int
+	lastID   int
+}
+
+type account struct {
+	id         string
+	thumbprint string
+	contact    []string
+	agreement  string
+	agreed     int // the terms agreed to; 0 for none
+}
+
+type authz struct {
+	id       string
+	acct     *account
+	name     string
+	status   string
+	expires  time.Time
+	chals    []*challenge
+	verified bool
+}
+
+type challenge struct {
+	id      string
+	authz   *authz
+	typ     string
+	token   string
+	status  string
+	keyAuth string
+	err     *Problem
+}
+
+type issued struct {
+	cert    *x509.Certificate
+	acct    *account
+	revoked bool
+	reason  int // RFC 5280 reason code, if revoked
+}
+
+// NewServer starts a Server with a new root.
+func NewServer() *Server {
+	s := &Server{
+		Challenges: []string{"http-01", "tls-sni-01", "dns-01"},
+		Validity:   90 * 24 * time.Hour,
+		nonces:     make(map[string]bool),
+		accounts:   make(map[string]*account),
+		authzs:     make(map[string]*authz),
+		chals:      make(map[string]*challenge),
+		certs:      make(map[string]*issued),
+		faults:     make(map[Endpoint][]Problem),
+		invalid:    make(map[string]string),
+		requests:   make(map[Endpoint]int),
+		terms:      1,
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("issuancetest: generating root key: %v", err))
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "issuancetest root", Organization: []string{"issuancetest"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		panic(fmt.Sprintf("issuancetest: creating root: %v", err))
+	}
+	s.Root, err = x509.ParseCertificate(der)
+	if err != nil {
+		panic(fmt.Sprintf("issuancetest: parsing root: %v", err))
+	}
+	s.rootKey = key
+
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// DirectoryURL returns the URL of the server's directory,
+// which is what ACME clients are configured with.
+func (s *Server) DirectoryURL() string {
+	return s.URL + "/directory"
+}
+
+// TermsURL returns the URL of the current terms of service.
+func (s *Server) TermsURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.termsURL()
+}
+
+func (s *Server) termsURL() string {
+	return fmt.Sprintf("%s/terms/%d", s.URL, s.terms)
+}
+
+// FailNext makes the next times requests to endpoint
+// fail with p, after any failures already scripted.
+func (s *Server) FailNext(endpoint Endpoint, p Problem, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < times; i++ {
+		s.faults[endpoint] = append(s.faults[endpoint], p)
+	}
+}
+
+// FailValidation makes validation of name fail with
+// detail from now on, until it is called again with an
+// empty detail.
+func (s *Server) FailValidation(name, detail string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name = strings.ToLower(name)
+	if detail == "" {
+		delete(s.invalid, name)
+		return
+	}
+	s.invalid[name] = detail
+}
+
+// ChangeTerms publishes new terms of service. Accounts must
+// agree to them before they can authorize any more names.
+func (s *Server) ChangeTerms() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terms++
+}
+
+// Requests returns how many requests were made to endpoint,
+// including those that failed.
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[endpoint]
+}
+
+// Accounts returns the contacts of the registered
+// accounts, like "mailto:me@example.com".
+func (s *Server) Accounts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var contacts []string
+	for _, acct := range s.accounts {
+		contacts = append(contacts, acct.contact...)
+	}
+	return contacts
+}
+
+// Issued returns the certificates that were issued.
+func (s *Server) Issued() []*x509.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var certs []*x509.Certificate
+	for _, iss := range s.certs {
+		certs = append(certs, iss.cert)
+	}
+	return certs
+}
+
+// Revoked returns true if cert was issued
+// by the server and has been revoked.
+func (s *Server) Revoked(cert *x509.Certificate) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	iss, ok := s.certs[cert.SerialNumber.Text(16)]
+	return ok && iss.revoked
+}
+
+// RevocationReason returns the reason code that cert was
+// revoked for, and whether it was issued by the server
+// and revoked at all.
+func (s *Server) RevocationReason(cert *x509.Certificate) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	iss, ok := s.certs[cert.SerialNumber.Text(16)]
+	if !ok || !iss.revoked {
+		return 0, false
+	}
+	return iss.reason, true
+}
+
+// serveHTTP routes requests to the resources of the server.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	var id string
+	if len(parts) == 2 {
+		id = parts[1]
+	}
+
+	if r.Method == http.MethodGet {
+		switch parts[0] {
+		case "directory":
+			writeJSON(w, http.StatusOK, map[string]string{
+				"new-reg":     s.URL + "/new-reg",
+				"new-authz":   s.URL + "/new-authz",
+				"new-cert":    s.URL + "/new-cert",
+				"revoke-cert": s.URL + "/revoke-cert",
+			})
+		case "terms":
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "Terms of service, version %s\n", id)
+		case "authz":
+			s.getAuthz(w, id)
+		case "challenge":
+			s.getChallenge(w, id)
+		case "cert":
+			s.getCert(w, id)
+		case "issuer":
+			w.Header().Set("Content-Type", "application/pkix-cert")
+			w.Write(s.Root.Raw)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		writeProblem(w, Problem{Type: "urn:acme:error:malformed", Detail: "Method not allowed", Status: http.StatusMethodNotAllowed})
+		return
+	}
+
+	endpoint := Endpoint(parts[0])
+	handle := map[Endpoint]func(http.ResponseWriter, *request){
+		NewReg:     s.newReg,
+		Reg:        s.reg,
+		NewAuthz:   s.newAuthz,
+		Challenge:  s.postChallenge,
+		NewCert:    s.newCert,
+		RevokeCert: s.revokeCert,
+	}[endpoint]
+	if handle == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, malformed("Reading request: %v", err))
+		return
+	}
+	req, p := s.parseRequest(body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[endpoint]++
+	if p != nil {
+		writeProblem(w, *p)
+		return
+	}
+	if req.Resource != string(endpoint) {
+		writeProblem(w, malformed("Request for resource '%s' sent to %s", req.Resource, endpoint))
+		return
+	}
+	if faults := s.faults[endpoint]; len(faults) > 0 {
+		s.faults[endpoint] = faults[1:]
+		writeProblem(w, faults[0])
+		return
+	}
+	req.id = id
+	req.acct = s.accounts[req.thumbprint]
+	if req.acct == nil && endpoint != NewReg {
+		writeProblem(w, Problem{Type: "urn:acme:error:unauthorized", Detail: "No registration exists matching provided key", Status: http.StatusForbidden})
+		return
+	}
+	handle(w, req)
+}
+
+// newNonce returns a new nonce, which is
+// valid for one request.
+func (s *Server) newNonce() string {
+	nonce := randomString()
+	s.mu.Lock()
+	s.nonces[nonce] = true
+	s.mu.Unlock()
+	return nonce
+}
+
+// nextID returns a new ID for a resource. s.mu must be locked.
+func (s *Server) nextID() string {
+	s.lastID++
+	return strconv.Itoa(s.lastID)
+}
+
+// newReg registers an account.
+func (s *Server) newReg(w http.ResponseWriter, req *request) {
+	if req.acct != nil {
+		w.Header().Set("Location", s.URL+"/reg/"+req.acct.id)
+		writeProblem(w, Problem{Type: "urn:acme:error:malformed", Detail: "Registration key is already in use", Status: http.StatusConflict})
+		return
+	}
+	acct := &account{
+		id:         s.nextID(),
+		thumbprint: req.thumbprint,
+		contact:    req.Contact,
+	}
+	s.agree(acct, req.Agreement)
+	s.accounts[acct.thumbprint] = acct
+	s.writeAccount(w, http.StatusCreated, acct)
+}
+
+// reg updates an account, which is how clients agree to terms.
+func (s *Server) reg(w http.ResponseWriter, req *request) {
+	if req.id != req.acct.id {
+		writeProblem(w, Problem{Type: "urn:acme:error:unauthorized", Detail: "Request signing key did not match registration key", Status: http.StatusForbidden})
+		return
+	}
+	if len(req.Contact) > 0 {
+		req.acct.contact = req.Contact
+	}
+	s.agree(req.acct, req.Agreement)
+	s.writeAccount(w, http.StatusAccepted, req.acct)
+}
+
+// agree records that acct agreed to the current terms if agreement
+// is set. Like real CAs, it doesn't matter which URL it is.
+func (s *Server) agree(acct *account, agreement string) {
+	if agreement != "" {
+		acct.agreement = agreement
+		acct.agreed = s.terms
+	}
+}
+
+func (s *Server) writeAccount(w http.ResponseWriter, status int, acct *account) {
+	id, _ := strconv.Atoi(acct.id)
+	w.Header().Set("Location", s.URL+"/reg/"+acct.id)
+	w.Header().Add("Link", link(s.URL+"/new-authz", "next"))
+	w.Header().Add("Link", link(s.termsURL(), "terms-of-service"))
+	writeJSON(w, status, map[string]interface{}{
+		"id":        id,
+		"contact":   acct.contact,
+		"agreement": acct.agreement,
+	})
+}
+
+// newAuthz creates an authorization for a name.
+func (s *Server) newAuthz(w http.ResponseWriter, req *request) {
+	if req.acct.agreed != s.terms {
+		writeProblem(w, Problem{Type: "urn:acme:error:unauthorized", Detail: termsError, Status: http.StatusForbidden})
+		return
+	}
+	if req.Identifier.Type != "dns" || req.Identifier.Value == "" {
+		writeProblem(w, malformed("Invalid identifier"))
+		return
+	}
+	az := &authz{
+		id:      s.nextID(),
+		acct:    req.acct,
+		name:    strings.ToLower(req.Identifier.Value),
+		status:  "pending",
+		expires: time.Now().Add(7 * 24 * time.Hour),
+	}
+	for _, typ := range s.Challenges {
+		c := &challenge{id: s.nextID(), authz: az, typ: typ, token: randomString(), status: "pending"}
+		az.chals = append(az.chals, c)
+		s.chals[c.id] = c
+	}
+	s.authzs[az.id] = az
+
+	w.Header().Set("Location", s.URL+"/authz/"+az.id)
+	w.Header().Add("Link", link(s.URL+"/new-cert", "next"))
+	writeJSON(w, http.StatusCreated, s.authzJSON(az))
+}
+
+func (s *Server) getAuthz(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	az, ok := s.authzs[id]
+	if !ok {
+		writeProblem(w, notFound("No such authorization"))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.authzJSON(az))
+}
+
+func (s *Server) authzJSON(az *authz) map[string]interface{} {
+	var chals []map[string]interface{}
+	var combinations [][]int
+	for i, c := range az.chals {
+		chals = append(chals, s.challengeJSON(c))
+		combinations = append(combinations, []int{i})
+	}
+	return map[string]interface{}{
+		"identifier":   map[string]string{"type": "dns", "value": az.name},
+		"status":       az.status,
+		"expires":      az.expires.UTC().Format(time.RFC3339),
+		"challenges":   chals,
+		"combinations": combinations,
+	}
+}
+
+// postChallenge validates a challenge. Validation happens at
+// once, and checks only the key authorization; it fails if the
+// challenge's name was scripted to fail with FailValidation.
+func (s *Server) postChallenge(w http.ResponseWriter, req *request) {
+	c, ok := s.chals[req.id]
+	if !ok {
+		writeProblem(w, notFound("No such challenge"))
+		return
+	}
+	if c.authz.acct != req.acct {
+		writeProblem(w, Problem{Type: "urn:acme:error:unauthorized", Detail: "Challenge belongs to another account", Status: http.StatusForbidden})
+		return
+	}
+	if c.status == "pending" {
+		c.keyAuth = req.KeyAuthorization
+		var detail string
+		if d, ok := s.invalid[c.authz.name]; ok {
+			detail = d
+		} else if req.KeyAuthorization != c.token+"."+req.thumbprint {
+			detail = "The key authorization did not match this challenge"
+		}
+		if detail != "" {
+			c.status = "invalid"
+			c.err = &Problem{Type: "urn:acme:error:unauthorized", Detail: detail, Status: http.StatusForbidden}
+			c.authz.status = "invalid"
+		} else {
+			c.status = "valid"
+			c.authz.status = "valid"
+		}
+	}
+	w.Header().Add("Link", link(s.URL+"/authz/"+c.authz.id, "up"))
+	writeJSON(w, http.StatusAccepted, s.challengeJSON(c))
+}
+
+func (s *Server) getChallenge(w http.ResponseWriter, id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.chals[id]
+	if !ok {
+		writeProblem(w, notFound("No such challenge"))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, s.challengeJSON(c))
+}
+
+func (s *Server) challengeJSON(c *challenge) map[string]interface{} {
+	j := map[string]interface{}{
+		"type":   c.typ,
+		"status": c.status,
+		"uri":    s.URL + "/challenge/" + c.id,
+		"token":  c.token,
+	}
+	if c.keyAuth != "" {
+		j["keyAuthorization"] = c.keyAuth
+	}
+	if c.err != nil {
+		j["error"] = c.err
+	}
+	return j
+}
+
+// newCert issues a certificate for a CSR, if the account
+// has valid authorizations for all the names in it.
+func (s *Server) newCert(w http.ResponseWriter, req *request) {
+	csrDER, err := decodeBase64(req.CSR)
+	if err != nil {
+		writeProblem(w, malformed("Decoding CSR: %v", err))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		writeProblem(w, malformed("Invalid CSR: %v", err))
+		return
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		name = strings.ToLower(name)
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		writeProblem(w, malformed("CSR has no names"))
+		return
+	}
+	var unauthorized []string
+	for _, name := range names {
+		if !s.authorized(req.acct, name) {
+			unauthorized = append(unauthorized, name)
+		}
+	}
+	if len(unauthorized) > 0 {
+		writeProblem(w, Problem{
+			Type:   "urn:acme:error:unauthorized",
+			Detail: "Error creating new cert :: authorizations for these names not found or expired: " + strings.Join(unauthorized, ", "),
+			Status: http.StatusForbidden,
+		})
+		return
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		writeProblem(w, Problem{Type: ServerError.Type, Detail: err.Error(), Status: ServerError.Status})
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(s.Validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IssuingCertificateURL: []string{s.URL + "/issuer"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.Root, csr.PublicKey, s.rootKey)
+	if err != nil {
+		writeProblem(w, Problem{Type: ServerError.Type, Detail: err.Error(), Status: ServerError.Status})
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		writeProblem(w, Problem{Type: ServerError.Type, Detail: err.Error(), Status: ServerError.Status})
+		return
+	}
+	s.certs[cert.SerialNumber.Text(16)] = &issued{cert: cert, acct: req.acct}
+
+	w.Header().Set("Location", s.URL+"/cert/"+cert.SerialNumber.Text(16))
+	writeCert(w, s.URL, http.StatusCreated, der)
+}
+
+// authorized returns true if acct has a valid
+// authorization for name. s.mu must be locked.
+func (s *Server) authorized(acct *account, name string) bool {
+	for _, az := range s.authzs {
+		if az.acct == acct && az.name == name && az.status == "valid" && time.Now().Before(az.expires) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) getCert(w http.ResponseWriter, serial string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	iss, ok := s.certs[serial]
+	if !ok {
+		writeProblem(w, notFound("No such certificate"))
+		return
+	}
+	writeCert(w, s.URL, http.StatusOK, iss.cert.Raw)
+}
+
+// revokeCert revokes a certificate that was obtained by the
+// account that asks, for the reason given, if any.
+func (s *Server) revokeCert(w http.ResponseWriter, req *request) {
+	var reason int
+	if req.Reason != nil {
+		reason = *req.Reason
+		if reason < 0 || reason == 7 || reason > 10 {
+			writeProblem(w, malformed("Unsupported revocation reason: %d", reason))
+			return
+		}
+	}
+	der, err := decodeBase64(req.Certificate)
+	if err != nil {
+		writeProblem(w, malformed("Decoding certificate: %v", err))
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		writeProblem(w, malformed("Invalid certificate: %v", err))
+		return
+	}
+	iss, ok := s.certs[cert.SerialNumber.Text(16)]
+	if !ok || string(iss.cert.Raw) != string(der) {
+		writeProblem(w, notFound("No such certificate"))
+		return
+	}
+	if iss.acct != req.acct {
+		writeProblem(w, Problem{Type: "urn:acme:error:unauthorized", Detail: "Revocation request must be signed by the account that issued the certificate", Status: http.StatusForbidden})
+		return
+	}
+	if iss.revoked {
+		writeProblem(w, Problem{Type: "urn:acme:error:malformed", Detail: "Certificate already revoked", Status: http.StatusConflict})
+		return
+	}
+	iss.revoked = true
+	iss.reason = reason
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeCert(w http.ResponseWriter, baseURL string, status int, der []byte) {
+	w.Header().Add("Link", link(baseURL+"/issuer", "up"))
+	w.Header().Set("Content-Type", "application/pkix-cert")
+	w.WriteHeader(status)
+	w.Write(der)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, p Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func malformed(format string, a ...interface{}) Problem {
+	return Problem{Type: "urn:acme:error:malformed", Detail: fmt.Sprintf(format, a...), Status: http.StatusBadRequest}
+}
+
+func notFound(detail string) Problem {
+	return Problem{Type: "urn:acme:error:malformed", Detail: detail, Status: http.StatusNotFound}
+}
+
+func link(url, rel string) string {
+	return fmt.Sprintf(`<%s>;rel="%s"`, url, rel)
+}
+
+// randomString returns a random string that is safe in URLs.
+func randomString() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("issuancetest: %v", err))
+	}
+	return encodeBase64(b)
+}
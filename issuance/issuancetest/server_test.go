@@ -0,0 +1,278 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuancetest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testClient is a bare-bones ACME client for testing the server.
+type testClient struct {
+	t     *testing.T
+	s     *Server
+	key   *ecdsa.PrivateKey
+	nonce string
+}
+
+func newTestClient(t *testing.T, s *Server) *testClient {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Head(s.DirectoryURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return &testClient{t: t, s: s, key: key, nonce: resp.Header.Get("Replay-Nonce")}
+}
+
+func (c *testClient) jwk() *jwk {
+	return &jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   encodeBase64(padded(c.key.X, 32)),
+		Y:   encodeBase64(padded(c.key.Y, 32)),
+	}
+}
+
+func (c *testClient) thumbprint() string {
+	_, thumbprint, err := c.jwk().publicKey()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return thumbprint
+}
+
+// post signs payload and posts it to url, returning the response
+// and its decoded JSON body, if it has one.
+func (c *testClient) post(url string, payload interface{}) (*http.Response, map[string]interface{}) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	headerJSON, err := json.Marshal(jwsHeader{Alg: "ES256", Nonce: c.nonce, JWK: c.jwk()})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	protected := encodeBase64(headerJSON)
+	encodedPayload := encodeBase64(payloadJSON)
+	digest := sha256.Sum256([]byte(protected + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	body, err := json.Marshal(jws{
+		Protected: protected,
+		Payload:   encodedPayload,
+		Signature: encodeBase64(append(padded(r, 32), padded(s, 32)...)),
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	resp, err := http.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	var result map[string]interface{}
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		json.NewDecoder(resp.Body).Decode(&result)
+	}
+	return resp, result
+}
+
+// authorize authorizes name with the first challenge offered.
+func (c *testClient) authorize(name string) string {
+	resp, authz := c.post(c.s.URL+"/new-authz", map[string]interface{}{
+		"resource":   "new-authz",
+		"identifier": map[string]string{"type": "dns", "value": name},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		c.t.Fatalf("Expected authorization to be created, got %d: %v", resp.StatusCode, authz)
+	}
+	chal := authz["challenges"].([]interface{})[0].(map[string]interface{})
+	_, result := c.post(chal["uri"].(string), map[string]string{
+		"resource":         "challenge",
+		"type":             chal["type"].(string),
+		"keyAuthorization": chal["token"].(string) + "." + c.thumbprint(),
+	})
+	return result["status"].(string)
+}
+
+func (c *testClient) csr(names ...string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return encodeBase64(der)
+}
+
+func TestServerIssueAndRevoke(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := newTestClient(t, s)
+
+	resp, _ := c.post(s.URL+"/new-reg", map[string]interface{}{
+		"resource": "new-reg",
+		"contact":  []string{"mailto:me@example.com"},
+	})
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") == "" {
+		t.Fatalf("Expected account to be created, got %d", resp.StatusCode)
+	}
+	links := strings.Join(resp.Header["Link"], ",")
+	if !strings.Contains(links, s.TermsURL()) || !strings.Contains(links, `rel="next"`) {
+		t.Errorf("Expected links to terms and next, got %s", links)
+	}
+
+	// names can't be authorized until the terms are agreed to
+	resp, problem := c.post(s.URL+"/new-authz", map[string]interface{}{
+		"resource":   "new-authz",
+		"identifier": map[string]string{"type": "dns", "value": "example.com"},
+	})
+	if resp.StatusCode != http.StatusForbidden || problem["detail"] != termsError {
+		t.Errorf("Expected terms error, got %d: %v", resp.StatusCode, problem)
+	}
+	resp, _ = c.post(s.URL+"/reg/1", map[string]string{"resource": "reg", "agreement": s.TermsURL()})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected agreement to be accepted, got %d", resp.StatusCode)
+	}
+
+	for _, name := range []string{"example.com", "www.example.com"} {
+		if status := c.authorize(name); status != "valid" {
+			t.Fatalf("Expected %s to be authorized, got %s", name, status)
+		}
+	}
+	resp, _ = c.post(s.URL+"/new-cert", map[string]string{"resource": "new-cert", "csr": c.csr("example.com", "www.example.com")})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected certificate to be issued, got %d", resp.StatusCode)
+	}
+	if links := strings.Join(resp.Header["Link"], ","); !strings.Contains(links, s.URL+"/issuer") {
+		t.Errorf("Expected link up to the issuer, got %s", links)
+	}
+	certResp, err := http.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := ioutil.ReadAll(certResp.Body)
+	certResp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Expected certificate, got: %v", err)
+	}
+	if err := cert.CheckSignatureFrom(s.Root); err != nil {
+		t.Errorf("Expected certificate to be signed by root, got: %v", err)
+	}
+	if len(cert.DNSNames) != 2 || len(s.Issued()) != 1 {
+		t.Errorf("Expected one certificate for both names, got %v and %d issued", cert.DNSNames, len(s.Issued()))
+	}
+
+	// names must be authorized first
+	resp, problem = c.post(s.URL+"/new-cert", map[string]string{"resource": "new-cert", "csr": c.csr("example.org")})
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(problem["detail"].(string), "example.org") {
+		t.Errorf("Expected unauthorized name error, got %d: %v", resp.StatusCode, problem)
+	}
+
+	resp, _ = c.post(s.URL+"/revoke-cert", map[string]string{"resource": "revoke-cert", "certificate": encodeBase64(der)})
+	if resp.StatusCode != http.StatusOK || !s.Revoked(cert) {
+		t.Errorf("Expected certificate to be revoked, got %d", resp.StatusCode)
+	}
+	resp, _ = c.post(s.URL+"/revoke-cert", map[string]string{"resource": "revoke-cert", "certificate": encodeBase64(der)})
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected conflict revoking twice, got %d", resp.StatusCode)
+	}
+}
+
+func TestServerScriptedFailures(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := newTestClient(t, s)
+	c.post(s.URL+"/new-reg", map[string]interface{}{"resource": "new-reg", "agreement": s.TermsURL()})
+
+	s.FailNext(NewAuthz, RateLimited, 1)
+	s.FailNext(NewAuthz, ServerError, 1)
+	for _, expected := range []Problem{RateLimited, ServerError} {
+		resp, problem := c.post(s.URL+"/new-authz", map[string]interface{}{
+			"resource":   "new-authz",
+			"identifier": map[string]string{"type": "dns", "value": "example.com"},
+		})
+		if resp.StatusCode != expected.Status || problem["type"] != expected.Type {
+			t.Errorf("Expected %s, got %d: %v", expected.Type, resp.StatusCode, problem)
+		}
+	}
+	if status := c.authorize("example.com"); status != "valid" {
+		t.Errorf("Expected authorization to succeed after scripted failures, got %s", status)
+	}
+	if n := s.Requests(NewAuthz); n != 3 {
+		t.Errorf("Expected 3 requests for authorizations, got %d", n)
+	}
+
+	s.FailValidation("bad.example.com", "Connection refused")
+	if status := c.authorize("bad.example.com"); status != "invalid" {
+		t.Errorf("Expected validation to fail, got %s", status)
+	}
+
+	s.ChangeTerms()
+	resp, problem := c.post(s.URL+"/new-authz", map[string]interface{}{
+		"resource":   "new-authz",
+		"identifier": map[string]string{"type": "dns", "value": "example.com"},
+	})
+	if resp.StatusCode != http.StatusForbidden || problem["detail"] != termsError {
+		t.Errorf("Expected terms error after terms changed, got %d: %v", resp.StatusCode, problem)
+	}
+
+	// a used nonce is rejected
+	nonce := c.nonce
+	c.post(s.URL+"/reg/1", map[string]string{"resource": "reg", "agreement": s.TermsURL()})
+	c.nonce = nonce
+	resp, problem = c.post(s.URL+"/reg/1", map[string]string{"resource": "reg"})
+	if resp.StatusCode != http.StatusBadRequest || problem["type"] != "urn:acme:error:badNonce" {
+		t.Errorf("Expected bad nonce error, got %d: %v", resp.StatusCode, problem)
+	}
+
+	if status := c.authorize("example.com"); status != "valid" {
+		t.Errorf("Expected authorization to succeed after agreeing to new terms, got %s", status)
+	}
+
+	// other keys have no account
+	other := newTestClient(t, s)
+	resp, _ = other.post(s.URL+"/new-cert", map[string]string{"resource": "new-cert", "csr": other.csr("example.com")})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected request without account to be forbidden, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobState is the state of a bundle in a job.
+type JobState string
+
+// The states of a bundle in a job.
+const (
+	// JobPending bundles have not been started.
+	JobPending JobState = "pending"
+
+	// JobInProgress bundles are being obtained.
+	JobInProgress JobState = "in_progress"
+
+	// JobDeferred bundles were rate limited and
+	// will be tried again once the pause is over.
+	JobDeferred JobState = "deferred"
+
+	// JobSucceeded bundles were obtained.
+	JobSucceeded JobState = "succeeded"
+
+	// JobSkipped bundles had nothing to do.
+	JobSkipped JobState = "skipped"
+
+	// JobFailed bundles could not be obtained.
+	JobFailed JobState = "failed"
+)
+
+// finished returns true if bundles in state s
+// do not need to be tried again.
+func (s JobState) finished() bool {
+	return s == JobSucceeded || s == JobSkipped
+}
+
+// jobState returns the final job state of a bundle with outcome o.
+func (o Outcome) jobState() JobState {
+	switch o {
+	case Obtained:
+		return JobSucceeded
+	case Skipped:
+		return JobSkipped
+	}
+	return JobFailed
+}
+
+// Job is a bulk run whose progress is recorded in a journal in
+// the workspace as it goes, so that if it is interrupted, it can
+// be resumed where it stopped.
+type Job struct {
+	// ID names the job in the workspace.
+	ID string `json:"id"`
+
+	// Input describes where the bundles came from,
+	// like the name of an input file.
+	Input string `json:"input,omitempty"`
+
+	// Started is when the job was created, and Updated
+	// is when its journal was last written.
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	// Options are the settings of the Manager the job was
+	// started with, which it is resumed with too.
+	Options *JobOptions `json:"options,omitempty"`
+
+	// Bundles are the journal entries of the job's bundles.
+	Bundles []JobBundle `json:"bundles"`
+
+	mu  sync.Mutex
+	mgr *Manager
+}
+
+// JobOptions are the settings of a Manager that change what
+// a job obtains, as opposed to how quickly or how it reports
+// failures. They apply to every bundle of the job that does
+// not choose otherwise.
+type JobOptions struct {
+	KeyType         KeyType `json:"key_type,omitempty"`
+	Solver          *Solver `json:"solver,omitempty"`
+	DropFailedNames bool    `json:"drop_failed_names,omitempty"`
+	Force           bool    `json:"force,omitempty"`
+}
+
+// Restore sets the options of m to the ones the job was
+// started with. Jobs that did not record them leave m as
+// it is.
+func (j *Job) Restore(m *Manager) {
+	if j.Options == nil {
+		return
+	}
+	m.KeyType = j.Options.KeyType
+	m.Solver = Solver{}
+	if j.Options.Solver != nil {
+		m.Solver = *j.Options.Solver
+	}
+	m.DropFailedNames = j.Options.DropFailedNames
+	m.Force = j.Options.Force
+}
+
+// JobBundle is the journal entry of one bundle in a job. It has
+// everything needed to obtain the certificate again, except for
+// a supplied private key, which is stored next to the journal.
+type JobBundle struct {
+	Email       string   `json:"email,omitempty"`
+	CA          string   `json:"ca,omitempty"`
+	Names       []string `json:"names,omitempty"`
+	KeyType     KeyType  `json:"key_type,omitempty"`
+	SuppliedKey bool     `json:"supplied_key,omitempty"`
+	CSR         string   `json:"csr,omitempty"`
+	Solver      *Solver  `json:"solver,omitempty"`
+	Output      *Output  `json:"output,omitempty"`
+	PostIssue   []string `json:"post_issue,omitempty"`
+
+	State   JobState `json:"state"`
+	Error   string   `json:"error,omitempty"`
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// NewJob creates a job for entries and saves its journal, with
+// all the bundles pending. Entries should have their Email and
+// CA set, since the job may be resumed with other defaults. The
+// options of m are recorded so that the job can be resumed with
+// them; see Restore. input describes where the entries came from.
+func (m *Manager) NewJob(input string, entries []JobEntry) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{Input: input, Started: now, mgr: m}
+	job.Options = &JobOptions{
+		KeyType:         m.KeyType,
+		DropFailedNames: m.DropFailedNames,
+		Force:           m.Force,
+	}
+	if !m.Solver.isZero() {
+		solver := m.Solver
+		job.Options.Solver = &solver
+	}
+
+	err := m.Storage.Lock(jobsKey)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Storage.Unlock(jobsKey)
+
+	id := now.Format("20060102-150405")
+	job.ID = id
+	for n := 2; m.Storage.Exists(JobFile(job.ID)); n++ {
+		job.ID = id + "-" + strconv.Itoa(n)
+	}
+
+	for i, entry := range entries {
+		b := entry.Bundle
+		jb := JobBundle{
+			Email:     entry.Email,
+			CA:        entry.CA,
+			Names:     b.Names,
+			KeyType:   b.KeyType,
+			PostIssue: b.PostIssue,
+			State:     JobPending,
+		}
+		if b.CSR != nil {
+			jb.CSR = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: b.CSR.Raw}))
+		}
+		if b.Key != nil {
+			err := savePrivateKey(m.Storage, b.Key, JobKeyFile(job.ID, i))
+			if err != nil {
+				return nil, fmt.Errorf("saving supplied private key: %v", err)
+			}
+			jb.SuppliedKey = true
+		}
+		if !b.Solver.isZero() {
+			solver := b.Solver
+			jb.Solver = &solver
+		}
+		if !b.Output.isZero() {
+			output := b.Output
+			jb.Output = &output
+		}
+		job.Bundles = append(job.Bundles, jb)
+	}
+
+	return job, job.save()
+}
+
+// LoadJob loads the job with the given ID from the workspace.
+func (m *Manager) LoadJob(id string) (*Job, error) {
+	jsonBytes, err := m.Storage.Load(JobFile(id))
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{mgr: m}
+	err = json.Unmarshal(jsonBytes, job)
+	if err != nil {
+		return nil, fmt.Errorf("decoding journal of job %s: %v", id, err)
+	}
+	return job, nil
+}
+
+// Jobs loads all the jobs in the workspace,
+// from the oldest to the newest.
+func (m *Manager) Jobs() ([]*Job, error) {
+	keys, err := m.Storage.List(jobsKey)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for _, key := range keys {
+		// only journals directly under jobs are jobs
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 || parts[2] != jobJournal {
+			continue
+		}
+		job, err := m.LoadJob(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.Before(jobs[j].Started)
+	})
+	return jobs, nil
+}
+
+// Count returns how many of the job's bundles are in state.
+func (j *Job) Count(state JobState) int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var n int
+	for _, b := range j.Bundles {
+		if b.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Unfinished returns the indexes of the bundles that have not
+// succeeded or been skipped, which are the ones to obtain when
+// the job is resumed. Failed bundles are tried again.
+func (j *Job) Unfinished() []int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var unfinished []int
+	for i, b := range j.Bundles {
+		if !b.State.finished() {
+			unfinished = append(unfinished, i)
+		}
+	}
+	return unfinished
+}
+
+// Entry returns the job entry for the bundle at index i, loading
+// its supplied private key or parsing its CSR if it has one.
+func (j *Job) Entry(i int) (JobEntry, error) {
+	j.mu.Lock()
+	jb := j.Bundles[i]
+	j.mu.Unlock()
+
+	entry := JobEntry{
+		Email: jb.Email,
+		CA:    jb.CA,
+		Bundle: Bundle{
+			Names:     jb.Names,
+			KeyType:   jb.KeyType,
+			PostIssue: jb.PostIssue,
+		},
+	}
+	var err error
+	if jb.SuppliedKey {
+		entry.Bundle.Key, err = loadPrivateKey(j.mgr.Storage, JobKeyFile(j.ID, i))
+		if err != nil {
+			return entry, fmt.Errorf("loading supplied private key: %v", err)
+		}
+	}
+	if jb.CSR != "" {
+		entry.Bundle.CSR, err = ParseCSR([]byte(jb.CSR))
+		if err != nil {
+			return entry, err
+		}
+	}
+	if jb.Solver != nil {
+		entry.Bundle.Solver = *jb.Solver
+	}
+	if jb.Output != nil {
+		entry.Bundle.Output = *jb.Output
+	}
+	return entry, nil
+}
+
+// ObtainJob obtains the bundles of job at indexes, which must all
+// be for u, like ObtainSummary does, recording the state of each
+// in the job's journal as it goes.
+func (u *User) ObtainJob(job *Job, indexes []int) (Summary, error) {
+	bundles := make([]Bundle, len(indexes))
+	for n, i := range indexes {
+		entry, err := job.Entry(i)
+		if err != nil {
+			return Summary{}, fmt.Errorf("job %s, bundle %d: %v", job.ID, i, err)
+		}
+		bundles[n] = entry.Bundle
+	}
+
+	return u.obtainAll(bundles, func(n int, state JobState, result BundleResult) {
+		err := job.set(indexes[n], state, result)
+		if err != nil {
+			log.Printf("[ERROR] Saving journal of job %s: %v", job.ID, err)
+		}
+	})
+}
+
+// set records that the bundle at index i is in state, with the
+// names, dropped names and error of result, and saves the journal.
+// Once the bundle is finished, the copy of its supplied private
+// key is deleted, since it will not be needed again.
+func (j *Job) set(i int, state JobState, result BundleResult) error {
+	j.mu.Lock()
+	b := &j.Bundles[i]
+	b.State = state
+	b.Error = result.Error
+	if state.finished() || state == JobFailed {
+		if len(result.Names) > 0 {
+			b.Names = result.Names
+		}
+		b.Dropped = result.Dropped
+	}
+	suppliedKey := b.SuppliedKey
+	j.mu.Unlock()
+
+	err := j.save()
+	if err != nil {
+		return err
+	}
+	if state.finished() && suppliedKey {
+		err := j.mgr.Storage.Delete(JobKeyFile(j.ID, i))
+		if err != nil {
+			return fmt.Errorf("deleting supplied private key: %v", err)
+		}
+	}
+	return nil
+}
+
+// save writes the journal of j to the workspace.
+func (j *Job) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Updated = time.Now().UTC()
+	jsonBytes, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	return j.mgr.Storage.Store(JobFile(j.ID), jsonBytes)
+}
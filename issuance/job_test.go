@@ -0,0 +1,204 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestNewJobAndLoad(t *testing.T) {
+	m := &Manager{
+		Storage:         new(MemoryStorage),
+		KeyType:         P256,
+		Solver:          Solver{Challenges: []acme.Challenge{acme.HTTP01}, Webroot: "/var/www"},
+		DropFailedNames: true,
+		Force:           true,
+	}
+
+	key, err := P256.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "example.org"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []JobEntry{
+		{Email: "me@example.com", CA: "https://ca.example.com/directory", Bundle: Bundle{
+			Names:     []string{"example.com"},
+			KeyType:   P384,
+			Solver:    Solver{Challenges: []acme.Challenge{acme.DNS01}},
+			Output:    Output{Cert: "/etc/ssl/example.com.crt"},
+			PostIssue: []string{"true"},
+		}},
+		{Bundle: Bundle{Names: []string{"example.net"}, Key: key}},
+		{Bundle: Bundle{CSR: csr}},
+	}
+	job, err := m.NewJob("domains.csv", entries)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	job2, err := m.NewJob("other.csv", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if job.ID == job2.ID {
+		t.Errorf("Expected jobs to have different IDs, but both were %s", job.ID)
+	}
+
+	loaded, err := m.LoadJob(job.ID)
+	if err != nil {
+		t.Fatalf("Expected no error loading job, got: %v", err)
+	}
+	if loaded.Input != "domains.csv" || len(loaded.Bundles) != 3 {
+		t.Fatalf("Expected job with 3 bundles from domains.csv, got %+v", loaded)
+	}
+	if expected := []int{0, 1, 2}; !reflect.DeepEqual(loaded.Unfinished(), expected) {
+		t.Errorf("Expected unfinished bundles %v, got %v", expected, loaded.Unfinished())
+	}
+
+	for i, expected := range entries {
+		actual, err := loaded.Entry(i)
+		if err != nil {
+			t.Errorf("Entry %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		if expected.Bundle.Key != nil {
+			if !privateKeysSame(actual.Bundle.Key, expected.Bundle.Key) {
+				t.Errorf("Entry %d: Expected supplied key to be restored, but it wasn't", i)
+			}
+			actual.Bundle.Key, expected.Bundle.Key = nil, nil
+		}
+		if expected.Bundle.CSR != nil {
+			if actual.Bundle.CSR == nil || !reflect.DeepEqual(actual.Bundle.CSR.Raw, expected.Bundle.CSR.Raw) {
+				t.Errorf("Entry %d: Expected CSR to be restored, but it wasn't", i)
+			}
+			actual.Bundle.CSR, expected.Bundle.CSR = nil, nil
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Entry %d: Expected %+v, got %+v", i, expected, actual)
+		}
+	}
+
+	// the job is resumed with the options it was started with
+	resumed := &Manager{Storage: m.Storage, KeyType: RSA2048, Solver: Solver{HTTPAddress: ":5002"}}
+	loaded.Restore(resumed)
+	if resumed.KeyType != m.KeyType || !reflect.DeepEqual(resumed.Solver, m.Solver) || !resumed.DropFailedNames || !resumed.Force {
+		t.Errorf("Expected options of the job to be restored, got %+v", resumed)
+	}
+
+	jobs, err := m.Jobs()
+	if err != nil {
+		t.Fatalf("Expected no error listing jobs, got: %v", err)
+	}
+	if len(jobs) != 2 || jobs[0].ID != job.ID || jobs[1].ID != job2.ID {
+		t.Errorf("Expected jobs %s and %s, got %v", job.ID, job2.ID, jobs)
+	}
+}
+
+func TestObtainJobRecordsStates(t *testing.T) {
+	m := &Manager{ServerURL: "https://ca.example.com/directory", Storage: new(MemoryStorage), Concurrency: 2}
+
+	// certificates that exist already are skipped
+	// without contacting the CA
+	var entries []JobEntry
+	for _, domain := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		certPEM, keyPEM := selfSignedPEM(t, []string{domain}, time.Now().Add(24*time.Hour))
+		m.Storage.Store(SiteCertFile(domain), certPEM)
+		m.Storage.Store(SiteKeyFile(domain), keyPEM)
+		entries = append(entries, JobEntry{Bundle: Bundle{Names: []string{domain}}})
+	}
+
+	job, err := m.NewJob("", entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := m.GetUser("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resume only some of them, as after an interruption
+	summary, err := user.ObtainJob(job, []int{0, 2})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Count(Skipped) != 2 {
+		t.Errorf("Expected 2 skipped, got: %v", summary)
+	}
+
+	loaded, err := m.LoadJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []JobState{JobSkipped, JobPending, JobSkipped} {
+		if actual := loaded.Bundles[i].State; actual != expected {
+			t.Errorf("Bundle %d: Expected state %s, got %s", i, expected, actual)
+		}
+	}
+	if expected := []int{1}; !reflect.DeepEqual(loaded.Unfinished(), expected) {
+		t.Errorf("Expected unfinished bundles %v, got %v", expected, loaded.Unfinished())
+	}
+}
+
+func TestJobDeletesSuppliedKeys(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+	var entries []JobEntry
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		key, err := P256.generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, JobEntry{Bundle: Bundle{Names: []string{domain}, Key: key}})
+	}
+	job, err := m.NewJob("", entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		index  int
+		state  JobState
+		exists bool
+	}{
+		{index: 0, state: JobInProgress, exists: true},
+		{index: 0, state: JobFailed, exists: true},
+		{index: 0, state: JobSucceeded, exists: false},
+		{index: 1, state: JobDeferred, exists: true},
+		{index: 1, state: JobSkipped, exists: false},
+	} {
+		err := job.set(test.index, test.state, BundleResult{})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if exists := m.Storage.Exists(JobKeyFile(job.ID, test.index)); exists != test.exists {
+			t.Errorf("Bundle %d %s: Expected supplied key to exist: %v, but got: %v", test.index, test.state, test.exists, exists)
+		}
+	}
+}
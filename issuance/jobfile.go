@@ -0,0 +1,593 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JobEntry is one certificate to obtain, as described
+// by an entry in a job file.
+type JobEntry struct {
+	// Line is the line of the job file the entry starts on.
+	Line int
+
+	// Email is the email address of the account to obtain
+	// the certificate with. If empty, the default is used.
+	Email string
+
+	// CA is the URL of the directory of the CA to obtain
+	// the certificate from. If empty, the default is used.
+	CA string
+
+	// Bundle describes the certificate.
+	Bundle Bundle
+}
+
+// LoadJobFile loads the job file filename, which describes
+// certificates to obtain in JSON or YAML. The whole file is
+// validated, and if there are any problems, the returned error
+// is a JobFileErrors listing all of them. Relative paths in the
+// file are relative to the folder the file is in.
+//
+// A job file is a list of entries, one per certificate, under
+// a "certificates" field:
+//
+//     certificates:
+//       - names: [example.com, www.example.com]
+//         key_type: p256          # or key: file, or csr: file
+//         email: me@example.com
+//         ca: https://acme-v01.api.letsencrypt.org/directory
+//         challenges: [http-01]
+//         solver:
+//           http_address: ":5002"
+//           tls_address: ":5001"
+//           # or, for http-01 with a web server already on :80:
+//           # webroot: /var/www/html
+//           # webroots: {static.example.com: /srv/static}
+//           dns:
+//             provider: exec
+//             exec: /usr/local/bin/update-dns  # run with present or
+//             propagation_wait: 30s            # cleanup, FQDN, value
+//             timeout: 2m                      # and TTL
+//             # or, for dynamic updates (RFC 2136):
+//             # provider: rfc2136
+//             # nameserver: ns1.example.com
+//             # zone: example.com
+//             # tsig_key: certs
+//             # tsig_algorithm: hmac-sha256
+//             # tsig_secret_file: /etc/certs/tsig.secret
+//         output:
+//           cert: /etc/ssl/example.com.crt
+//           key: /etc/ssl/example.com.key
+//           bundle: /etc/haproxy/example.com.pem
+//           exports:
+//             - format: pkcs12      # or der, leaf, chain,
+//               path: /etc/ssl/example.com.p12  # fullchain, combined
+//               password_file: /etc/ssl/p12-password
+//         hooks:
+//           post_issue: ["systemctl reload nginx"]
+//
+// Only names (or csr) are required.
+func LoadJobFile(filename string) ([]JobEntry, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ParseJob(data, dir)
+	if errs, ok := err.(JobFileErrors); ok {
+		for i := range errs {
+			errs[i].File = filename
+		}
+		return nil, errs
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", filename, err)
+	}
+	return entries, nil
+}
+
+// ParseJob parses and validates the job file in data, resolving
+// relative paths against dir. See LoadJobFile.
+func ParseJob(data []byte, dir string) ([]JobEntry, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &jobParser{dir: dir, sites: make(map[string]int)}
+	if len(doc.Content) == 0 {
+		p.errorf(&doc, "", "job file is empty")
+		return nil, p.errs
+	}
+
+	root := doc.Content[0]
+	list := root
+	if root.Kind == yaml.MappingNode {
+		list = nil
+		p.mapping(root, "", func(key string, value *yaml.Node) bool {
+			if key != "certificates" {
+				return false
+			}
+			list = value
+			return true
+		})
+		if list == nil && len(p.errs) == 0 {
+			p.errorf(root, "certificates", "required field is missing")
+		}
+	}
+	if list != nil {
+		if list.Kind != yaml.SequenceNode {
+			p.errorf(list, "certificates", "must be a list")
+		} else {
+			for i, node := range list.Content {
+				p.entry(node, fmt.Sprintf("certificates[%d]", i))
+			}
+		}
+	}
+
+	if len(p.errs) > 0 {
+		sort.Stable(p.errs)
+		return nil, p.errs
+	}
+	return p.entries, nil
+}
+
+// jobParser parses the nodes of a job file,
+// collecting entries and errors.
+type jobParser struct {
+	dir     string
+	entries []JobEntry
+	errs    JobFileErrors
+	sites   map[string]int // site name to line
+}
+
+// entry parses the entry in node, whose field path is field.
+func (p *jobParser) entry(node *yaml.Node, field string) {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, field, "must be a mapping")
+		return
+	}
+
+	entry := JobEntry{Line: node.Line}
+	b := &entry.Bundle
+	var keyTypeNode, keyNode, csrNode, solverNode, outputNode *yaml.Node
+	var namesGiven bool
+
+	p.mapping(node, field, func(key string, value *yaml.Node) bool {
+		f := field + "." + key
+		switch key {
+		case "names":
+			namesGiven = true
+			p.each(value, f, func(item *yaml.Node, itemField, name string) {
+				name = strings.ToLower(strings.TrimSpace(name))
+				if !validName(name) {
+					p.errorf(item, itemField, "invalid domain name '%s'", name)
+					return
+				}
+				b.Names = append(b.Names, name)
+			})
+			if value.Kind == yaml.SequenceNode && len(value.Content) == 0 {
+				p.errorf(value, f, "must not be empty")
+			}
+		case "key_type":
+			keyTypeNode = value
+			if s, ok := p.str(value, f); ok {
+				kt, err := ParseKeyType(s)
+				if err != nil {
+					p.errorf(value, f, "%v", err)
+				}
+				b.KeyType = kt
+			}
+		case "key":
+			keyNode = value
+			if s, ok := p.str(value, f); ok {
+				keyBytes, err := ioutil.ReadFile(p.path(s))
+				if err == nil {
+					b.Key, err = ParsePrivateKey(keyBytes)
+				}
+				if err != nil {
+					p.errorf(value, f, "%v", err)
+				}
+			}
+		case "csr":
+			csrNode = value
+			if s, ok := p.str(value, f); ok {
+				csrBytes, err := ioutil.ReadFile(p.path(s))
+				if err == nil {
+					b.CSR, err = ParseCSR(csrBytes)
+				}
+				if err != nil {
+					p.errorf(value, f, "%v", err)
+				}
+			}
+		case "email":
+			entry.Email, _ = p.str(value, f)
+		case "ca":
+			if s, ok := p.str(value, f); ok {
+				u, err := url.Parse(s)
+				if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+					p.errorf(value, f, "must be an http or https URL")
+				}
+				entry.CA = s
+			}
+		case "challenges":
+			p.each(value, f, func(item *yaml.Node, itemField, name string) {
+				c, err := ParseChallenge(name)
+				if err != nil {
+					p.errorf(item, itemField, "%v", err)
+					return
+				}
+				b.Solver.Challenges = append(b.Solver.Challenges, c)
+			})
+		case "solver":
+			solverNode = value
+			p.solver(value, f, &b.Solver)
+		case "output":
+			outputNode = value
+			p.output(value, f, &b.Output)
+		case "hooks":
+			p.mapping(value, f, func(key string, value *yaml.Node) bool {
+				if key != "post_issue" {
+					return false
+				}
+				b.PostIssue = p.strings(value, f+"."+key)
+				return true
+			})
+		default:
+			return false
+		}
+		return true
+	})
+
+	switch {
+	case csrNode != nil && namesGiven:
+		p.errorf(csrNode, field+".csr", "cannot be used with names; the names come from the CSR")
+	case csrNode != nil && keyNode != nil:
+		p.errorf(csrNode, field+".csr", "cannot be used with key")
+	case csrNode != nil && keyTypeNode != nil:
+		p.errorf(csrNode, field+".csr", "cannot be used with key_type")
+	case csrNode != nil && outputNode != nil && (b.Output.Key != "" || b.Output.Bundle != "" || b.Output.exportsKey()):
+		p.errorf(outputNode, field+".output", "cannot write a key, bundle, or export with the key for a CSR, whose key is not in the workspace")
+	case keyNode != nil && keyTypeNode != nil:
+		p.errorf(keyTypeNode, field+".key_type", "cannot be used with key")
+	case csrNode == nil && !namesGiven:
+		p.errorf(node, field+".names", "required field is missing")
+	}
+
+	if solverNode != nil && b.Solver.usesWebroot() {
+		names := b.Names
+		if b.CSR != nil {
+			names = uniqueNames(b.CSR.Subject.CommonName, b.CSR.DNSNames)
+		}
+		for _, name := range names {
+			if _, err := b.Solver.webrootFor(name); err != nil {
+				p.errorf(solverNode, field+".solver.webroots", "%v", err)
+			}
+		}
+	}
+
+	if site := b.Site(); site != "" {
+		if line, ok := p.sites[site]; ok {
+			p.errorf(node, field, "certificate for %s is already in the job file, on line %d", site, line)
+		}
+		p.sites[site] = node.Line
+	}
+
+	p.entries = append(p.entries, entry)
+}
+
+// solver parses the solver settings in node into s.
+func (p *jobParser) solver(node *yaml.Node, field string, s *Solver) {
+	p.mapping(node, field, func(key string, value *yaml.Node) bool {
+		f := field + "." + key
+		var addr *string
+		switch key {
+		case "http_address":
+			addr = &s.HTTPAddress
+		case "tls_address":
+			addr = &s.TLSAddress
+		case "webroot":
+			if dir, ok := p.str(value, f); ok {
+				s.Webroot = p.path(dir)
+			}
+			return true
+		case "webroots":
+			s.Webroots = make(map[string]string)
+			p.mapping(value, f, func(name string, value *yaml.Node) bool {
+				name = strings.ToLower(strings.TrimSpace(name))
+				if !validName(name) {
+					p.errorf(value, f+"."+name, "invalid domain name '%s'", name)
+				}
+				if dir, ok := p.str(value, f+"."+name); ok {
+					s.Webroots[name] = p.path(dir)
+				}
+				return true
+			})
+			return true
+		case "dns":
+			s.DNS = new(DNSConfig)
+			p.dns(value, f, s.DNS)
+			return true
+		default:
+			return false
+		}
+		if s, ok := p.str(value, f); ok {
+			if err := validateAddress(s); err != nil {
+				p.errorf(value, f, "%v", err)
+			}
+			*addr = s
+		}
+		return true
+	})
+	if s.HTTPAddress != "" && s.usesWebroot() {
+		p.errorf(node, field+".http_address", "cannot be used with a webroot")
+	}
+}
+
+// dns parses the DNS provider settings in node into c.
+func (p *jobParser) dns(node *yaml.Node, field string, c *DNSConfig) {
+	p.mapping(node, field, func(key string, value *yaml.Node) bool {
+		f := field + "." + key
+		switch key {
+		case "provider":
+			c.Provider, _ = p.str(value, f)
+		case "exec":
+			if s, ok := p.str(value, f); ok {
+				// bare names are looked up in PATH
+				c.Exec = s
+				if filepath.Base(s) != s {
+					c.Exec = p.path(s)
+				}
+			}
+		case "nameserver":
+			c.Nameserver, _ = p.str(value, f)
+		case "zone":
+			c.Zone, _ = p.str(value, f)
+		case "tsig_key":
+			c.TSIGKey, _ = p.str(value, f)
+		case "tsig_algorithm":
+			c.TSIGAlgorithm, _ = p.str(value, f)
+		case "tsig_secret_file":
+			if s, ok := p.str(value, f); ok {
+				c.TSIGSecretFile = p.path(s)
+			}
+		case "propagation_wait":
+			c.PropagationWait = p.duration(value, f)
+		case "timeout":
+			c.Timeout = p.duration(value, f)
+		default:
+			return false
+		}
+		return true
+	})
+	if node.Kind == yaml.MappingNode {
+		if err := c.Validate(); err != nil {
+			p.errorf(node, field, "%v", err)
+		}
+	}
+}
+
+// output parses the output paths in node into out.
+func (p *jobParser) output(node *yaml.Node, field string, out *Output) {
+	p.mapping(node, field, func(key string, value *yaml.Node) bool {
+		var path *string
+		switch key {
+		case "cert":
+			path = &out.Cert
+		case "key":
+			path = &out.Key
+		case "bundle":
+			path = &out.Bundle
+		case "exports":
+			p.exports(value, field+"."+key, out)
+			return true
+		default:
+			return false
+		}
+		if s, ok := p.str(value, field+"."+key); ok {
+			*path = p.path(s)
+		}
+		return true
+	})
+}
+
+// exports parses the list of exports in node into out.
+func (p *jobParser) exports(node *yaml.Node, field string, out *Output) {
+	if node.Kind != yaml.SequenceNode {
+		p.errorf(node, field, "must be a list")
+		return
+	}
+	for i, item := range node.Content {
+		itemField := fmt.Sprintf("%s[%d]", field, i)
+		var e Export
+		p.mapping(item, itemField, func(key string, value *yaml.Node) bool {
+			f := itemField + "." + key
+			switch key {
+			case "format":
+				if s, ok := p.str(value, f); ok {
+					format, err := ParseExportFormat(s)
+					if err != nil {
+						p.errorf(value, f, "%v", err)
+					}
+					e.Format = format
+				}
+			case "path":
+				if s, ok := p.str(value, f); ok {
+					e.Path = p.path(s)
+				}
+			case "password_file":
+				if s, ok := p.str(value, f); ok {
+					e.PasswordFile = p.path(s)
+				}
+			default:
+				return false
+			}
+			return true
+		})
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		switch {
+		case e.Format == "":
+			p.errorf(item, itemField+".format", "required field is missing")
+		case e.Path == "":
+			p.errorf(item, itemField+".path", "required field is missing")
+		case e.Format == ExportPKCS12 && e.PasswordFile == "":
+			p.errorf(item, itemField+".password_file", "required field is missing; pkcs12 exports need a password")
+		}
+		out.Exports = append(out.Exports, e)
+	}
+}
+
+// mapping calls field for each key and value in the mapping
+// node. If field returns false, the key is reported as unknown.
+func (p *jobParser) mapping(node *yaml.Node, path string, field func(key string, value *yaml.Node) bool) {
+	if node.Kind != yaml.MappingNode {
+		p.errorf(node, path, "must be a mapping")
+		return
+	}
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, value := node.Content[i], node.Content[i+1]
+		key := keyNode.Value
+		fieldPath := key
+		if path != "" {
+			fieldPath = path + "." + key
+		}
+		if seen[key] {
+			p.errorf(keyNode, fieldPath, "field is specified more than once")
+			continue
+		}
+		seen[key] = true
+		if !field(key, value) {
+			p.errorf(keyNode, fieldPath, "unknown field")
+		}
+	}
+}
+
+// str returns the string in node, which must be a scalar.
+func (p *jobParser) str(node *yaml.Node, field string) (string, bool) {
+	if node.Kind != yaml.ScalarNode || node.Tag != "!!str" {
+		p.errorf(node, field, "must be a string")
+		return "", false
+	}
+	return node.Value, true
+}
+
+// strings returns the strings in node, which must be a list.
+func (p *jobParser) strings(node *yaml.Node, field string) []string {
+	var list []string
+	p.each(node, field, func(_ *yaml.Node, _, s string) {
+		list = append(list, s)
+	})
+	return list
+}
+
+// duration returns the duration in node, like "30s",
+// which must not be negative.
+func (p *jobParser) duration(node *yaml.Node, field string) time.Duration {
+	s, ok := p.str(node, field)
+	if !ok {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		p.errorf(node, field, "must be a duration, like 30s or 2m")
+		return 0
+	}
+	return d
+}
+
+// each calls fn for each string in node, which must be a
+// list, with the node and field path of the string.
+func (p *jobParser) each(node *yaml.Node, field string, fn func(item *yaml.Node, itemField, s string)) {
+	if node.Kind != yaml.SequenceNode {
+		p.errorf(node, field, "must be a list")
+		return
+	}
+	for i, item := range node.Content {
+		itemField := fmt.Sprintf("%s[%d]", field, i)
+		if s, ok := p.str(item, itemField); ok {
+			fn(item, itemField, s)
+		}
+	}
+}
+
+// path returns file, relative to the folder of the job file.
+func (p *jobParser) path(file string) string {
+	if file == "" || filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(p.dir, file)
+}
+
+func (p *jobParser) errorf(node *yaml.Node, field, format string, args ...interface{}) {
+	p.errs = append(p.errs, JobFileError{Line: node.Line, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// validName returns true if name can be a
+// domain name on a certificate.
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".") &&
+		!strings.ContainsAny(name, " \t/\\:*@,")
+}
+
+// JobFileError is a problem with a field in a job file.
+type JobFileError struct {
+	File    string
+	Line    int
+	Field   string
+	Message string
+}
+
+// Error returns e as "file:line: field: message".
+func (e JobFileError) Error() string {
+	msg := e.Message
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, msg)
+}
+
+// JobFileErrors are all the problems with a job
+// file, in the order they appear in the file.
+type JobFileErrors []JobFileError
+
+// Error returns all the errors in e, one per line.
+func (e JobFileErrors) Error() string {
+	var lines []string
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e JobFileErrors) Len() int           { return len(e) }
+func (e JobFileErrors) Less(i, j int) bool { return e[i].Line < e[j].Line }
+func (e JobFileErrors) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
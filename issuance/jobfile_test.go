@@ -0,0 +1,220 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestParseJobYAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs_job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, keyPEM := selfSignedPEM(t, []string{"example.net"}, time.Now())
+	err = ioutil.WriteFile(filepath.Join(dir, "example.net.key"), keyPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := `certificates:
+  - names: [Example.com, www.example.com]
+    key_type: p256
+    email: me@example.com
+    ca: https://ca.example.com/directory
+    challenges: [http-01, DNS-01]
+    solver:
+      http_address: ":5002"
+    output:
+      cert: out/example.com.crt
+      bundle: /etc/haproxy/example.com.pem
+      exports:
+        - format: PKCS12
+          path: out/example.com.p12
+          password_file: p12-password
+    hooks:
+      post_issue: ["systemctl reload nginx"]
+  - names: [example.net, Static.example.net]
+    key: example.net.key
+    solver:
+      webroot: www
+      webroots:
+        Static.example.net: /srv/static
+      dns:
+        provider: exec
+        exec: bin/update-dns
+        propagation_wait: 30s
+        timeout: 2m
+`
+	entries, err := ParseJob([]byte(job), dir)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+
+	e := entries[0]
+	if e.Line != 2 || e.Email != "me@example.com" || e.CA != "https://ca.example.com/directory" {
+		t.Errorf("Expected line 2 with account and CA, got %+v", e)
+	}
+	b := e.Bundle
+	if expected := []string{"example.com", "www.example.com"}; !reflect.DeepEqual(b.Names, expected) {
+		t.Errorf("Expected names %v, got %v", expected, b.Names)
+	}
+	if b.KeyType != P256 {
+		t.Errorf("Expected key type %s, got %s", P256, b.KeyType)
+	}
+	expectedSolver := Solver{Challenges: []acme.Challenge{acme.HTTP01, acme.DNS01}, HTTPAddress: ":5002"}
+	if !reflect.DeepEqual(b.Solver, expectedSolver) {
+		t.Errorf("Expected solver %+v, got %+v", expectedSolver, b.Solver)
+	}
+	expectedOutput := Output{
+		Cert:   filepath.Join(dir, "out", "example.com.crt"),
+		Bundle: "/etc/haproxy/example.com.pem",
+		Exports: []Export{
+			{Format: ExportPKCS12, Path: filepath.Join(dir, "out", "example.com.p12"), PasswordFile: filepath.Join(dir, "p12-password")},
+		},
+	}
+	if !reflect.DeepEqual(b.Output, expectedOutput) {
+		t.Errorf("Expected output %+v, got %+v", expectedOutput, b.Output)
+	}
+	if expected := []string{"systemctl reload nginx"}; !reflect.DeepEqual(b.PostIssue, expected) {
+		t.Errorf("Expected hooks %v, got %v", expected, b.PostIssue)
+	}
+
+	if entries[1].Bundle.Key == nil {
+		t.Error("Expected key to be loaded relative to the job file, but it was not")
+	}
+	expectedSolver = Solver{
+		Webroot:  filepath.Join(dir, "www"),
+		Webroots: map[string]string{"static.example.net": "/srv/static"},
+		DNS:      &DNSConfig{Provider: "exec", Exec: filepath.Join(dir, "bin", "update-dns"), PropagationWait: 30 * time.Second, Timeout: 2 * time.Minute},
+	}
+	if !reflect.DeepEqual(entries[1].Bundle.Solver, expectedSolver) {
+		t.Errorf("Expected solver %+v, got %+v", expectedSolver, entries[1].Bundle.Solver)
+	}
+}
+
+func TestParseJobJSON(t *testing.T) {
+	job := `{
+	"certificates": [
+		{"names": ["example.com"], "key_type": "rsa4096"},
+		{"names": ["example.org"]}
+	]
+}`
+	entries, err := ParseJob([]byte(job), ".")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Bundle.KeyType != RSA4096 || entries[1].Line != 4 {
+		t.Errorf("Expected 2 entries, the second on line 4, got %+v", entries)
+	}
+}
+
+func TestParseJobErrors(t *testing.T) {
+	job := `certificates:
+  - names: [example.com, "bad name"]
+    key_type: dsa
+    colour: blue
+  - key_type: p256
+  - names: [example.org]
+    challenges: [http-01, carrier-pigeon]
+    ca: ftp://ca.example.com
+    solver:
+      http_address: 5002
+      tls_address: nope
+    output: /etc/ssl
+  - names: [example.com]
+`
+	_, err := ParseJob([]byte(job), ".")
+	errs, ok := err.(JobFileErrors)
+	if !ok {
+		t.Fatalf("Expected JobFileErrors, got %T: %v", err, err)
+	}
+
+	expected := []struct {
+		line  int
+		field string
+	}{
+		{2, "certificates[0].names[1]"},
+		{3, "certificates[0].key_type"},
+		{4, "certificates[0].colour"},
+		{5, "certificates[1].names"},
+		{7, "certificates[2].challenges[1]"},
+		{8, "certificates[2].ca"},
+		{10, "certificates[2].solver.http_address"},
+		{11, "certificates[2].solver.tls_address"},
+		{12, "certificates[2].output"},
+		{13, "certificates[3]"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d:\n%v", len(expected), len(errs), errs)
+	}
+	for i, exp := range expected {
+		if errs[i].Line != exp.line || errs[i].Field != exp.field {
+			t.Errorf("Error %d: Expected line %d, field %s, got: %v", i, exp.line, exp.field, errs[i])
+		}
+	}
+	if !strings.Contains(errs[9].Message, "line 2") {
+		t.Errorf("Expected duplicate certificate to refer to line 2, got: %s", errs[9].Message)
+	}
+}
+
+func TestParseJobConflicts(t *testing.T) {
+	for i, test := range []struct {
+		job   string
+		field string
+	}{
+		{"certificates:\n  - names: [a.com]\n    key: a.key\n    key_type: p256\n", "certificates[0].key_type"},
+		{"certificates:\n  - names: [a.com]\n    csr: a.csr\n", "certificates[0].csr"},
+		{"certificates:\n  - names: [a.com]\n    output:\n      exports:\n        - format: pkcs12\n          path: a.p12\n", "certificates[0].output.exports[0].password_file"},
+		{"certificates:\n  - names: [a.com]\n    output:\n      exports:\n        - format: jks\n          path: a.jks\n", "certificates[0].output.exports[0].format"},
+		{"certificates:\n  - names: [a.com, b.com]\n    solver:\n      webroots:\n        a.com: /srv/a\n", "certificates[0].solver.webroots"},
+		{"certificates:\n  - names: [a.com]\n    solver:\n      webroot: /srv/a\n      http_address: :5002\n", "certificates[0].solver.http_address"},
+		{"certificates:\n  - names: [a.com]\n    solver:\n      dns:\n        provider: exec\n", "certificates[0].solver.dns"},
+		{"certificates:\n  - names: [a.com]\n    solver:\n      dns:\n        provider: exec\n        exec: update-dns\n        timeout: soon\n", "certificates[0].solver.dns.timeout"},
+		{"certificates:\n  - names: [a.com]\n    solver:\n      dns:\n        provider: rfc2136\n        tsig_key: certs\n", "certificates[0].solver.dns"},
+		{"certificates: {}\n", "certificates"},
+		{"sites: []\n", "sites"},
+		{"", ""},
+	} {
+		_, err := ParseJob([]byte(test.job), ".")
+		errs, ok := err.(JobFileErrors)
+		if !ok || len(errs) == 0 {
+			t.Errorf("Test %d: Expected JobFileErrors, got %v", i, err)
+			continue
+		}
+		found := false
+		for _, e := range errs {
+			if e.Field == test.field {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Test %d: Expected an error for field '%s', got: %v", i, test.field, errs)
+		}
+	}
+}
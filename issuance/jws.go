@@ -0,0 +1,221 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// The ACME client has no way to send fields it does not know
+// about, like the reason code of a revocation, so requests that
+// need them are signed and posted here instead. Only what those
+// requests need is implemented.
+
+// acmeProblem is an error returned by an ACME server.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p acmeProblem) Error() string {
+	return fmt.Sprintf("acme: Error %d - %s - %s", p.Status, p.Type, p.Detail)
+}
+
+// acmeDirectory fetches the directory of the ACME server at
+// directoryURL and returns it, along with a fresh nonce.
+func acmeDirectory(directoryURL string) (map[string]string, string, error) {
+	resp, err := acmeRequest("GET", directoryURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("getting ACME directory: %s", resp.Status)
+	}
+	var dir map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding ACME directory: %v", err)
+	}
+	return dir, resp.Header.Get("Replay-Nonce"), nil
+}
+
+// acmePost signs payload with key and posts it to url, using
+// nonce if it is not empty. If the server rejects the nonce, it
+// tries once more with the new one. A response with an error
+// status is returned as an acmeProblem.
+func acmePost(key crypto.PrivateKey, url, nonce string, payload interface{}) error {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if nonce == "" {
+			resp, err := acmeRequest("HEAD", url, nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			nonce = resp.Header.Get("Replay-Nonce")
+		}
+
+		body, err := signJWS(key, nonce, payloadJSON)
+		if err != nil {
+			return err
+		}
+		resp, err := acmeRequest("POST", url, body)
+		if err != nil {
+			return err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode < 400 {
+			return nil
+		}
+
+		problem := acmeProblem{Status: resp.StatusCode}
+		if json.Unmarshal(respBody, &problem) != nil || problem.Type == "" {
+			problem.Detail = strings.TrimSpace(string(respBody))
+		}
+		if strings.HasSuffix(problem.Type, ":badNonce") && attempt == 0 {
+			nonce = resp.Header.Get("Replay-Nonce")
+			continue
+		}
+		return problem
+	}
+}
+
+// acmeRequest makes an HTTP request with the
+// ACME client's User-Agent.
+func acmeRequest(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", acme.UserAgent)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/jose+json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// signJWS signs payload with key and returns it as a JWS in
+// flattened JSON serialization, with the public key and nonce
+// in its protected header.
+func signJWS(key crypto.PrivateKey, nonce string, payload []byte) ([]byte, error) {
+	var alg string
+	var jwk map[string]string
+	var hash crypto.Hash
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg, hash = "RS256", crypto.SHA256
+		jwk = map[string]string{
+			"kty": "RSA",
+			"n":   encodeBase64(k.N.Bytes()),
+			"e":   encodeBase64(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case *ecdsa.PrivateKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		switch k.Curve.Params().BitSize {
+		case 256:
+			alg, hash = "ES256", crypto.SHA256
+		case 384:
+			alg, hash = "ES384", crypto.SHA384
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+		jwk = map[string]string{
+			"kty": "EC",
+			"crv": k.Curve.Params().Name,
+			"x":   encodeBase64(padded(k.X, size)),
+			"y":   encodeBase64(padded(k.Y, size)),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported account key type %T", key)
+	}
+
+	header, err := json.Marshal(map[string]interface{}{"alg": alg, "jwk": jwk, "nonce": nonce})
+	if err != nil {
+		return nil, err
+	}
+	protected := encodeBase64(header)
+	encodedPayload := encodeBase64(payload)
+	signed := []byte(protected + "." + encodedPayload)
+
+	var digest []byte
+	if hash == crypto.SHA256 {
+		sum := sha256.Sum256(signed)
+		digest = sum[:]
+	} else {
+		sum := sha512.Sum384(signed)
+		digest = sum[:]
+	}
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		if err != nil {
+			return nil, err
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = append(padded(r, size), padded(s, size)...)
+	}
+
+	return json.Marshal(map[string]string{
+		"protected": protected,
+		"payload":   encodedPayload,
+		"signature": encodeBase64(signature),
+	})
+}
+
+// padded returns the bytes of n, padded
+// with leading zeros to size bytes.
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func encodeBase64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
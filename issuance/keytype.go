@@ -0,0 +1,115 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// KeyType is a type of private key, for accounts or certificates.
+type KeyType string
+
+// The supported key types.
+const (
+	RSA2048 KeyType = "rsa2048"
+	RSA3072 KeyType = "rsa3072"
+	RSA4096 KeyType = "rsa4096"
+	P256    KeyType = "p256"
+	P384    KeyType = "p384"
+)
+
+// DefaultKeyType is the type of new private keys
+// if the Manager does not specify one.
+const DefaultKeyType = RSA2048
+
+// ParseKeyType returns the KeyType named s, ignoring case. An
+// empty string is the DefaultKeyType.
+func ParseKeyType(s string) (KeyType, error) {
+	if s == "" {
+		return DefaultKeyType, nil
+	}
+	kt := KeyType(strings.ToLower(s))
+	switch kt {
+	case RSA2048, RSA3072, RSA4096, P256, P384:
+		return kt, nil
+	}
+	return "", fmt.Errorf("unknown key type '%s'; must be one of rsa2048, rsa3072, rsa4096, p256, p384", s)
+}
+
+// generate makes a new private key of type kt.
+func (kt KeyType) generate() (crypto.PrivateKey, error) {
+	switch kt {
+	case RSA2048, RSA3072, RSA4096:
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits[kt])
+	case P256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case P384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type '%s'", kt)
+}
+
+// acmeKeyType returns the closest lego key type to kt. lego only
+// uses it to generate certificate keys, which we always generate
+// ourselves, so it does not matter that it has no 3072-bit RSA.
+func (kt KeyType) acmeKeyType() acme.KeyType {
+	switch kt {
+	case RSA4096:
+		return acme.RSA4096
+	case P256:
+		return acme.EC256
+	case P384:
+		return acme.EC384
+	}
+	return acme.RSA2048
+}
+
+// keyTypeOf returns the KeyType of key, or
+// an empty KeyType if it is not supported.
+func keyTypeOf(key crypto.PrivateKey) KeyType {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		for kt, bits := range rsaKeyBits {
+			if k.N.BitLen() == bits {
+				return kt
+			}
+		}
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return P256
+		case elliptic.P384():
+			return P384
+		}
+	}
+	return ""
+}
+
+// rsaKeyBits is the size in bits of each type of RSA key. This
+// shouldn't need to change except for in tests; the sizes can
+// be drastically reduced for speed.
+var rsaKeyBits = map[KeyType]int{
+	RSA2048: 2048,
+	RSA3072: 3072,
+	RSA4096: 4096,
+}
@@ -0,0 +1,113 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import "testing"
+
+func TestParseKeyType(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expected  KeyType
+		shouldErr bool
+	}{
+		{"", DefaultKeyType, false},
+		{"rsa2048", RSA2048, false},
+		{"RSA3072", RSA3072, false},
+		{"rsa4096", RSA4096, false},
+		{"p256", P256, false},
+		{"P384", P384, false},
+		{"rsa1024", "", true},
+		{"ed25519", "", true},
+	} {
+		actual, err := ParseKeyType(test.input)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error for '%s', but got none", i, test.input)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error for '%s', but got: %v", i, test.input, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected %s, got %s", i, test.expected, actual)
+		}
+	}
+}
+
+func TestGenerateKeyTypes(t *testing.T) {
+	for _, kt := range []KeyType{RSA2048, RSA3072, RSA4096, P256, P384} {
+		key, err := kt.generate()
+		if err != nil {
+			t.Errorf("Expected no error generating %s key, got: %v", kt, err)
+			continue
+		}
+		if actual := keyTypeOf(key); actual != kt {
+			t.Errorf("Expected generated key to be %s, got '%s'", kt, actual)
+		}
+	}
+}
+
+func TestNewUserKeyType(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage), KeyType: P384}
+	user, err := m.newUser("me@foobar.com")
+	if err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if kt := keyTypeOf(user.key); kt != P384 {
+		t.Errorf("Expected account key to be %s, got '%s'", P384, kt)
+	}
+
+	err = m.saveUser(user)
+	if err != nil {
+		t.Fatalf("Error saving user: %v", err)
+	}
+	user2, err := m.GetUser("me@foobar.com")
+	if err != nil {
+		t.Fatalf("Error getting user: %v", err)
+	}
+	if !privateKeysSame(user.key, user2.key) {
+		t.Error("Expected ECDSA account key to be the same after loading, but it wasn't")
+	}
+}
+
+func TestRenewalKeyType(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage), KeyType: RSA4096}
+	domains := []string{"example.com"}
+
+	bundle, source, err := m.renewalBundle(domains)
+	if err != nil {
+		t.Fatalf("Expected no error for site without key, got: %v", err)
+	}
+	if kt := keyTypeOf(bundle.Key); kt != RSA4096 || source != KeyGenerated {
+		t.Errorf("Expected new %s key for site without key, got '%s' (%s)", RSA4096, kt, source)
+	}
+
+	ecKey, err := P256.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = savePrivateKey(m.Storage, ecKey, SiteKeyFile("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, _, err = m.renewalBundle(domains)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if kt := keyTypeOf(bundle.Key); kt != P256 {
+		t.Errorf("Expected renewal key to keep type %s, got '%s'", P256, kt)
+	}
+	if privateKeysSame(bundle.Key, ecKey) {
+		t.Error("Expected renewal key to be new, but it was the old key")
+	}
+}
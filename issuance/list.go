@@ -0,0 +1,108 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// SiteInfo describes a site in the workspace for listing.
+type SiteInfo struct {
+	// Site is the name of the site.
+	Site string `json:"site"`
+
+	IndexSite
+}
+
+// ListFilter chooses which sites ListSites returns. The zero
+// value of each field matches all sites.
+type ListFilter struct {
+	// ExpiringDays matches certificates that expire within
+	// this many days, including those that have expired.
+	ExpiringDays int
+
+	// Account matches certificates obtained by the account
+	// with this email address, ignoring case.
+	Account string
+
+	// Issuer matches certificates whose issuer's Common Name
+	// contains this, ignoring case.
+	Issuer string
+
+	// Name matches certificates with a name that matches
+	// this glob, as with path.Match, ignoring case.
+	Name string
+
+	// Revoked matches only certificates that were revoked.
+	Revoked bool
+}
+
+// match returns true if info is chosen by f.
+func (f ListFilter) match(info SiteInfo) bool {
+	if f.ExpiringDays > 0 && info.NotAfter.Sub(time.Now()) >= time.Duration(f.ExpiringDays)*24*time.Hour {
+		return false
+	}
+	if f.Account != "" && !strings.EqualFold(info.Account, f.Account) {
+		return false
+	}
+	if f.Issuer != "" && !strings.Contains(strings.ToLower(info.Issuer), strings.ToLower(f.Issuer)) {
+		return false
+	}
+	if f.Revoked && info.Status != StatusRevoked {
+		return false
+	}
+	if f.Name != "" {
+		pattern := strings.ToLower(f.Name)
+		for _, name := range info.Names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ListSites returns the sites in the workspace that have a
+// certificate and are chosen by filter, in order of name. It
+// reads each site's certificate and metadata rather than the
+// index, so it is accurate even if the index is not.
+func (m *Manager) ListSites(filter ListFilter) ([]SiteInfo, error) {
+	if _, err := path.Match(strings.ToLower(filter.Name), ""); err != nil {
+		return nil, err
+	}
+	sites, err := SiteNames(m.Storage)
+	if err != nil {
+		return nil, err
+	}
+	var list []SiteInfo
+	for _, site := range sites {
+		if !m.Storage.Exists(SiteCertFile(site)) {
+			continue
+		}
+		meta, err := m.loadSiteMeta(site)
+		if err != nil {
+			log.Printf("[WARNING] Listing %s: loading metadata: %v", site, err)
+		}
+		info := SiteInfo{Site: site, IndexSite: m.siteIndexEntry(site, meta)}
+		if filter.match(info) {
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
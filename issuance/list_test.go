@@ -0,0 +1,92 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestListSites(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+
+	for _, site := range []struct {
+		names    []string
+		notAfter time.Time
+		account  string
+	}{
+		{[]string{"a.com", "www.a.com"}, time.Now().Add(60 * 24 * time.Hour), "me@example.com"},
+		{[]string{"b.com"}, time.Now().Add(5 * 24 * time.Hour), "you@example.com"},
+		{[]string{"c.net"}, time.Now().Add(-time.Hour), ""},
+	} {
+		certPEM, keyPEM := selfSignedPEM(t, site.names, site.notAfter)
+		err := m.saveCertResource(acme.CertificateResource{
+			Domain:      site.names[0],
+			Certificate: certPEM,
+			PrivateKey:  keyPEM,
+		}, Bundle{Names: site.names, account: site.account}, KeyGenerated)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	meta, err := m.loadSiteMeta("a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Revoked = &Revocation{Reason: KeyCompromise, Time: time.Now().UTC()}
+	err = m.saveSiteMeta(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		filter   ListFilter
+		expected []string
+	}{
+		{ListFilter{}, []string{"a.com", "b.com", "c.net"}},
+		{ListFilter{ExpiringDays: 30}, []string{"b.com", "c.net"}},
+		{ListFilter{Account: "ME@example.com"}, []string{"a.com"}},
+		{ListFilter{Issuer: "B.C"}, []string{"b.com"}},
+		{ListFilter{Name: "www.*"}, []string{"a.com"}},
+		{ListFilter{Name: "*.com", ExpiringDays: 30}, []string{"b.com"}},
+		{ListFilter{Revoked: true}, []string{"a.com"}},
+	} {
+		list, err := m.ListSites(test.filter)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+			continue
+		}
+		var actual []string
+		for _, info := range list {
+			actual = append(actual, info.Site)
+		}
+		if len(actual) != len(test.expected) {
+			t.Errorf("Test %d: Expected sites %v, got %v", i, test.expected, actual)
+			continue
+		}
+		for j := range actual {
+			if actual[j] != test.expected[j] {
+				t.Errorf("Test %d: Expected sites %v, got %v", i, test.expected, actual)
+				break
+			}
+		}
+	}
+
+	if _, err := m.ListSites(ListFilter{Name: "["}); err == nil {
+		t.Error("Expected error for malformed name glob, but got none")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SiteBusyError is returned when an operation on a site can't
+// start because another operation of the same User is working
+// on it. Its value is the name of the site.
+type SiteBusyError string
+
+// Error returns a message saying which site is busy.
+func (e SiteBusyError) Error() string {
+	return fmt.Sprintf("another operation on %s is in progress; try again later", string(e))
+}
+
+// nameLocks is a set of locks, one for each name, that are
+// made as they are needed. Names are not case-sensitive.
+//
+// A User has one for its sites, so that two goroutines sharing
+// it (like the API and the renewal loop of certsd) never obtain,
+// save or revoke the certificate of the same site at the same
+// time, while operations on different sites are not held up.
+type nameLocks struct {
+	mu   sync.Mutex
+	held map[string]chan struct{} // closed when released
+}
+
+// lock locks name, waiting for it to be released if it is held.
+func (l *nameLocks) lock(name string) {
+	for {
+		if released := l.acquire(name); released != nil {
+			<-released
+			continue
+		}
+		return
+	}
+}
+
+// tryLock locks name and returns true, or returns false
+// right away if it is held.
+func (l *nameLocks) tryLock(name string) bool {
+	return l.acquire(name) == nil
+}
+
+// acquire locks name and returns nil if it is not held;
+// otherwise, it returns a channel that is closed when
+// the lock is released.
+func (l *nameLocks) acquire(name string) chan struct{} {
+	name = strings.ToLower(name)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held == nil {
+		l.held = make(map[string]chan struct{})
+	}
+	if released, ok := l.held[name]; ok {
+		return released
+	}
+	l.held[name] = make(chan struct{})
+	return nil
+}
+
+// unlock releases name.
+func (l *nameLocks) unlock(name string) {
+	name = strings.ToLower(name)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if released, ok := l.held[name]; ok {
+		delete(l.held, name)
+		close(released)
+	}
+}
+
+// lockSite locks site for an operation of u. If wait is false
+// and another operation holds the lock, it returns a
+// SiteBusyError instead of waiting.
+func (u *User) lockSite(site string, wait bool) error {
+	if wait {
+		u.sites.lock(site)
+		return nil
+	}
+	if !u.sites.tryLock(site) {
+		return SiteBusyError(strings.ToLower(site))
+	}
+	return nil
+}
+
+// unlockSite releases the lock that u holds on site.
+func (u *User) unlockSite(site string) {
+	u.sites.unlock(site)
+}
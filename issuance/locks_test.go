@@ -0,0 +1,68 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNameLocks(t *testing.T) {
+	var l nameLocks
+	if !l.tryLock("example.com") {
+		t.Fatal("Expected to lock a free site")
+	}
+	if l.tryLock("Example.com") {
+		t.Error("Expected not to lock a held site, ignoring case")
+	}
+	if !l.tryLock("example.org") {
+		t.Error("Expected to lock another site while one is held")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		l.lock("example.com")
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Expected lock to wait for the site to be released")
+	case <-time.After(10 * time.Millisecond):
+	}
+	l.unlock("example.com")
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Expected lock to be acquired once the site was released")
+	}
+}
+
+func TestBusySite(t *testing.T) {
+	m := &Manager{ServerURL: "https://ca.example.com/directory", Storage: new(MemoryStorage)}
+	user, err := m.GetUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.sites.lock("example.com")
+	defer user.sites.unlock("example.com")
+
+	if err := user.TryRenewSite("example.com"); err != SiteBusyError("example.com") {
+		t.Errorf("Expected renewal of a busy site to fail, got: %v", err)
+	}
+	if _, err := user.TryObtain(Bundle{Names: []string{"Example.com"}}); err != SiteBusyError("example.com") {
+		t.Errorf("Expected obtaining for a busy site to fail, got: %v", err)
+	}
+}
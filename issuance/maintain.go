@@ -0,0 +1,216 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Maintainer keeps the certificates in the workspace renewed
+// for as long as it runs. It is what powers certsd.
+type Maintainer struct {
+	// User is the account that renews the certificates.
+	User *User
+
+	// Days is how many days before expiration a
+	// certificate is renewed.
+	Days int
+
+	// Interval is how often the workspace is scanned
+	// for certificates that need renewal.
+	Interval time.Duration
+
+	// Jitter is the maximum random delay before each
+	// renewal, so that renewals are spread out rather
+	// than all hitting the CA at once.
+	Jitter time.Duration
+
+	// ShutdownTimeout is how long to wait for a renewal
+	// that is in progress when the Maintainer is stopped.
+	// If it does not finish in time, it is abandoned and
+	// its certificate will not be saved.
+	ShutdownTimeout time.Duration
+}
+
+// Run scans the workspace and renews certificates until ctx is
+// done. Failed renewals are logged and retried at the next scan;
+// when rate limited, the user's rate limiter is used to back off
+// between attempts. Run returns nil once it has stopped cleanly.
+func (m *Maintainer) Run(ctx context.Context) error {
+	if m.User.manager().ServerURL == "" {
+		return fmt.Errorf("must set ServerURL before maintaining certificates")
+	}
+	if m.Interval <= 0 {
+		return fmt.Errorf("scan interval must be positive")
+	}
+
+	clients := make(map[string]*acme.Client)
+	_, err := m.User.clientFor(clients, Solver{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		bundles, total, err := m.User.manager().dueForRenewal(m.Days)
+		if err != nil {
+			log.Printf("[ERROR] Scanning workspace: %v", err)
+		} else {
+			log.Printf("[INFO] %d of %d certificates expire within %d days", len(bundles), total, m.Days)
+		}
+
+		for _, domains := range bundles {
+			if ctx.Err() != nil || !m.renew(ctx, clients, domains) {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(m.Interval):
+		}
+	}
+}
+
+// renew renews the certificate for domains after a random delay
+// of up to m.Jitter, retrying as long as it is rate limited. The
+// client for its bundle is taken from, or added to, clients. It
+// returns false if ctx was done before it finished.
+func (m *Maintainer) renew(ctx context.Context, clients map[string]*acme.Client, domains []string) bool {
+	if !sleep(ctx, m.jitter()) {
+		return false
+	}
+
+	// the site may be busy with a request to the API;
+	// if so, it will be looked at again at the next scan
+	err := m.User.lockSite(domains[0], false)
+	if err != nil {
+		log.Printf("[INFO] Not renewing %v now: %v", domains, err)
+		return true
+	}
+	defer m.User.unlockSite(domains[0])
+
+	bundle, source, err := m.User.manager().renewalBundle(domains)
+	if err != nil {
+		log.Printf("[ERROR] Renewing %v: %v", domains, err)
+		return true
+	}
+	client, err := m.User.clientFor(clients, bundle.Solver)
+	if err != nil {
+		log.Printf("[ERROR] Renewing %v: %v", domains, err)
+		return true
+	}
+	bundle.account = m.User.Email
+
+	for {
+		d, seen := m.User.pause()
+		if d > 0 && !sleep(ctx, d) {
+			return false
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+
+		log.Printf("[INFO] Renewing certificate for %v", domains)
+
+		finished, err := m.attempt(ctx, client, bundle, source)
+		if !finished {
+			return false
+		}
+		if rateLimited(err) {
+			d := m.User.backOffOnce(seen)
+			log.Printf("[WARNING] Rate limited: %v - backing off and retrying in %v", err, d)
+			continue
+		}
+		if err != nil {
+			log.Printf("[ERROR] Renewing %v: %v", domains, err)
+			return true
+		}
+
+		m.User.resumeOnce(seen)
+		return true
+	}
+}
+
+// attempt makes one attempt at renewing the certificate for bundle
+// and saves it if successful. If ctx is done while the order is in
+// progress, attempt waits up to m.ShutdownTimeout for it before
+// abandoning it, in which case finished is false. An abandoned order is
+// never saved, and an order that is being saved is never abandoned,
+// so the site's assets are left either old or new, not mixed.
+func (m *Maintainer) attempt(ctx context.Context, client *acme.Client, bundle Bundle, source KeySource) (finished bool, err error) {
+	domains := bundle.Names
+	var mu sync.Mutex // held while saving, and when abandoning
+	var abandoned bool
+	done := make(chan error, 1)
+
+	go func() {
+		certRes, err := obtainDropping(client, &bundle, m.User.manager().DropFailedNames)
+		if err == nil {
+			mu.Lock()
+			if !abandoned {
+				err = m.User.manager().saveObtained(certRes, bundle, source)
+			}
+			mu.Unlock()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return true, err
+	case <-ctx.Done():
+	}
+
+	log.Printf("[INFO] Shutting down; waiting up to %v for renewal of %v", m.ShutdownTimeout, domains)
+	select {
+	case err := <-done:
+		return true, err
+	case <-time.After(m.ShutdownTimeout):
+		mu.Lock()
+		abandoned = true
+		mu.Unlock()
+		log.Printf("[WARNING] Abandoned renewal of %v", domains)
+		return false, nil
+	}
+}
+
+// jitter returns a random duration in [0, m.Jitter).
+func (m *Maintainer) jitter() time.Duration {
+	if m.Jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(m.Jitter)))
+}
+
+// sleep waits for d to elapse and returns true, or
+// returns false as soon as ctx is done. If ctx is done
+// when d elapses, as it may be for a d of 0, it returns
+// false too.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return ctx.Err() == nil
+	}
+}
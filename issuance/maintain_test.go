@@ -0,0 +1,64 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMaintainerJitter(t *testing.T) {
+	m := Maintainer{}
+	if j := m.jitter(); j != 0 {
+		t.Errorf("Expected no jitter when disabled, got %v", j)
+	}
+
+	m.Jitter = 10 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		if j := m.jitter(); j < 0 || j >= m.Jitter {
+			t.Fatalf("Expected jitter in [0, %v), got %v", m.Jitter, j)
+		}
+	}
+}
+
+func TestSleep(t *testing.T) {
+	if !sleep(context.Background(), time.Millisecond) {
+		t.Error("Expected sleep to finish, but it was canceled")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if sleep(ctx, time.Hour) {
+		t.Error("Expected sleep to be canceled, but it finished")
+	}
+	if since := time.Since(start); since > time.Second {
+		t.Errorf("Expected canceled sleep to return right away, but it took %v", since)
+	}
+
+	for i := 0; i < 100; i++ {
+		if sleep(ctx, 0) {
+			t.Fatal("Expected sleep without delay to be canceled, but it finished")
+		}
+	}
+}
+
+func TestMaintainerRunRequiresServerURL(t *testing.T) {
+	m := Maintainer{User: &User{mgr: new(Manager)}, Interval: time.Hour}
+	if err := m.Run(context.Background()); err == nil {
+		t.Error("Expected an error without ServerURL, but got none")
+	}
+}
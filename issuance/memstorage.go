@@ -0,0 +1,120 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStorage is a Storage that keeps assets in memory. It
+// is mostly useful for tests. The zero value is ready to use,
+// but a MemoryStorage must not be copied after first use.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	locks  map[string]chan struct{}
+}
+
+// Load returns a copy of the value of key.
+func (s *MemoryStorage) Load(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, &os.PathError{Op: "load", Path: key, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), value...), nil
+}
+
+// Store stores a copy of value under key.
+func (s *MemoryStorage) Store(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string][]byte)
+	}
+	s.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+// Delete deletes key and all keys under it.
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range s.values {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(s.values, k)
+		}
+	}
+	return nil
+}
+
+// Exists returns true if key has a value.
+func (s *MemoryStorage) Exists(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.values[key]
+	return ok
+}
+
+// List returns the keys under prefix.
+func (s *MemoryStorage) List(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.values {
+		if prefix == "" || strings.HasPrefix(k, prefix+"/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Lock acquires the lock named key, waiting
+// for it to be released if it is held.
+func (s *MemoryStorage) Lock(key string) error {
+	for {
+		s.mu.Lock()
+		if s.locks == nil {
+			s.locks = make(map[string]chan struct{})
+		}
+		released, held := s.locks[key]
+		if !held {
+			s.locks[key] = make(chan struct{})
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+		<-released
+	}
+}
+
+// Unlock releases the lock named key.
+func (s *MemoryStorage) Unlock(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	released, held := s.locks[key]
+	if !held {
+		return fmt.Errorf("lock %s is not held", key)
+	}
+	delete(s.locks, key)
+	close(released)
+	return nil
+}
@@ -15,10 +15,33 @@
 package issuance
 
 import (
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
+// RateLimitError is returned by operations that do not wait
+// while the account is rate limited, like TryObtain.
+type RateLimitError struct {
+	// RetryAfter is how long is left of the account's pause.
+	RetryAfter time.Duration
+
+	// Err is what the CA said, if the operation was just
+	// rate limited; it is nil if the account was already
+	// paused.
+	Err error
+}
+
+// Error returns a message saying when to try again.
+func (e RateLimitError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("rate limited; try again in %v: %s", e.RetryAfter, strings.TrimSpace(e.Err.Error()))
+	}
+	return fmt.Sprintf("rate limited; try again in %v", e.RetryAfter)
+}
+
 /*
 type RateLimiter interface {
 	BackOff()
@@ -40,13 +63,47 @@ type RateLimiter interface {
 //     1h  - ∞x
 //
 // Upon resuming, the interval will be reset to 0.
+//
+// Each step back starts a pause that lasts for the interval.
+// A rateLimiter is safe for concurrent use, so that goroutines
+// sharing one (like the workers of an account) all wait out
+// the same pause instead of each backing off on its own.
 type rateLimiter struct {
+	mu       sync.Mutex
 	interval time.Duration // how long to wait
 	count    int           // how many times we've waited at this interval
+	until    time.Time     // when the current pause is over
+	steps    int           // how many times we've backed off
 }
 
 // BackOff tells the rate limiter to throttle another step.
 func (rl *rateLimiter) BackOff() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.backOff()
+}
+
+// backOffOnce is like BackOff, except it does nothing if
+// the rate limiter has backed off since its step count was
+// seen; that way, many goroutines that are rate limited by
+// the same burst only throttle one step. It returns how
+// long is left of the current pause.
+func (rl *rateLimiter) backOffOnce(seen int) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.steps == seen {
+		rl.backOff()
+	}
+	return rl.until.Sub(time.Now())
+}
+
+// backOff throttles another step. rl.mu must be locked.
+func (rl *rateLimiter) backOff() {
+	defer func() {
+		rl.steps++
+		rl.until = time.Now().Add(rl.interval)
+	}()
+
 	// Switch on current interval to determine the new one
 	switch rl.interval {
 	case 0:
@@ -95,12 +152,42 @@ func (rl *rateLimiter) BackOff() {
 	}
 }
 
-// Wait waits the duration of the interval.
-func (rl *rateLimiter) Wait() {
-	time.Sleep(rl.interval)
+// Wait waits until the current pause is over, if there is
+// one. It returns the step count, for backOffOnce and
+// resumeOnce.
+func (rl *rateLimiter) Wait() int {
+	d, seen := rl.pause()
+	time.Sleep(d)
+	return seen
+}
+
+// pause returns how long is left of the current pause
+// and the step count.
+func (rl *rateLimiter) pause() (time.Duration, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	d := rl.until.Sub(time.Now())
+	if d < 0 {
+		d = 0
+	}
+	return d, rl.steps
 }
 
 // Resume resets the interval back to 0.
 func (rl *rateLimiter) Resume() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 	rl.interval = 0
 }
+
+// resumeOnce is like Resume, except it does nothing if the
+// rate limiter has backed off since its step count was seen,
+// so that a success that was already in flight does not end
+// the throttling caused by another goroutine.
+func (rl *rateLimiter) resumeOnce(seen int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.steps == seen {
+		rl.interval = 0
+	}
+}
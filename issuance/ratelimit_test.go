@@ -20,7 +20,7 @@ import (
 )
 
 func TestRateLimitBackOff(t *testing.T) {
-	rl := rateLimiter{}
+	rl := &rateLimiter{}
 	for i := 0; i < 3; i++ {
 		rl.BackOff()
 		expectInterval(t, rl, 10*time.Second)
@@ -52,21 +52,46 @@ func TestRateLimitBackOff(t *testing.T) {
 }
 
 func TestRateLimitResume(t *testing.T) {
-	rl := rateLimiter{interval: 1 * time.Second}
+	rl := &rateLimiter{interval: 1 * time.Second}
 	rl.Resume()
 	expectInterval(t, rl, 0)
 }
 
 func TestRateLimitWait(t *testing.T) {
-	rl := rateLimiter{interval: 500 * time.Millisecond}
 	start := time.Now()
+	rl := &rateLimiter{until: start.Add(500 * time.Millisecond)}
 	rl.Wait()
-	if since := time.Since(start); since < rl.interval {
-		t.Errorf("Expected wait for %v, but has only been %v", rl.interval, since)
+	if since := time.Since(start); since < 500*time.Millisecond {
+		t.Errorf("Expected wait for %v, but has only been %v", 500*time.Millisecond, since)
 	}
 }
 
-func expectInterval(t *testing.T, rl rateLimiter, expected time.Duration) {
+func TestRateLimitOnce(t *testing.T) {
+	rl := &rateLimiter{}
+	seen := rl.Wait()
+
+	// several workers rate limited by the same burst
+	// should only throttle one step, all together
+	for i := 0; i < 3; i++ {
+		if d := rl.backOffOnce(seen); d <= 9*time.Second || d > 10*time.Second {
+			t.Errorf("Expected pause of about 10s, got %v", d)
+		}
+	}
+	expectInterval(t, rl, 10*time.Second)
+	if rl.count != 1 {
+		t.Errorf("Expected one step back, got %d", rl.count)
+	}
+
+	// a success that was in flight should not resume
+	rl.resumeOnce(seen)
+	expectInterval(t, rl, 10*time.Second)
+
+	_, seen = rl.pause()
+	rl.resumeOnce(seen)
+	expectInterval(t, rl, 0)
+}
+
+func expectInterval(t *testing.T, rl *rateLimiter, expected time.Duration) {
 	if rl.interval != expected {
 		t.Errorf("Expected interval to be %v but was actually %v", expected, rl.interval)
 	}
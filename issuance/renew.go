@@ -0,0 +1,295 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// DefaultRenewDays is how many days before expiration a
+// certificate becomes eligible for renewal by default.
+const DefaultRenewDays = 30
+
+// RenewCerts renews every certificate in the workspace that
+// expires within the given number of days, except for those
+// that have been revoked. Renewed certificates get a new private
+// key of the same type, unless the key was supplied by the user or
+// the certificate was obtained for a CSR; see KeySource. They
+// replace the old assets in storage, and are written to the
+// outputs the certificate was obtained with. Like ObtainCerts,
+// it handles rate limiting by backing off and retrying until
+// it succeeds.
+func (u *User) RenewCerts(days int) error {
+	m := u.manager()
+	if m.ServerURL == "" {
+		return fmt.Errorf("must set ServerURL before renewing certificates")
+	}
+
+	bundles, total, err := m.dueForRenewal(days)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] %d of %d certificates expire within %d days", len(bundles), total, days)
+	if len(bundles) == 0 {
+		return nil
+	}
+
+	clients := make(map[string]*acme.Client)
+
+	for _, domains := range bundles {
+		log.Printf("[INFO] Renewing certificate for %v", domains)
+
+		u.sites.lock(domains[0])
+		err := u.renewDomains(clients, domains, false)
+		u.sites.unlock(domains[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renewDomains renews the certificate for domains, using a
+// client from clients, and saves it right away, like ObtainCerts.
+// If failFast is true, it returns a RateLimitError instead of
+// waiting while the account is rate limited. The caller must
+// hold the lock on the site.
+func (u *User) renewDomains(clients map[string]*acme.Client, domains []string, failFast bool) error {
+	m := u.manager()
+	bundle, source, err := m.renewalBundle(domains)
+	if err != nil {
+		return err
+	}
+	bundle.failFast = failFast
+	client, err := u.clientFor(clients, bundle.Solver)
+	if err != nil {
+		return err
+	}
+	certRes, _, err := u.obtain(client, &bundle, false, nil)
+	if err != nil {
+		return err
+	}
+	return m.saveObtained(certRes, bundle, source)
+}
+
+// RenewSite renews the certificate of the site named name right
+// away, no matter when it expires, unless it has been revoked.
+func (u *User) RenewSite(name string) error {
+	return u.renewSite(name, false)
+}
+
+// TryRenewSite is like RenewSite, except it never waits: if the
+// account is rate limited, it fails with a RateLimitError, and if
+// another operation of u is working on the site, it fails with a
+// SiteBusyError.
+func (u *User) TryRenewSite(name string) error {
+	return u.renewSite(name, true)
+}
+
+// renewSite renews the certificate of the site named name; see
+// RenewSite and TryRenewSite, which failFast chooses between.
+func (u *User) renewSite(name string, failFast bool) error {
+	m := u.manager()
+	if m.ServerURL == "" {
+		return fmt.Errorf("must set ServerURL before renewing certificates")
+	}
+
+	name = strings.ToLower(name)
+	err := u.lockSite(name, !failFast)
+	if err != nil {
+		return err
+	}
+	defer u.unlockSite(name)
+
+	cert, err := loadCertificate(m.Storage, SiteCertFile(name))
+	if err != nil {
+		return fmt.Errorf("loading certificate for %s: %v", name, err)
+	}
+	meta, err := m.loadSiteMeta(name)
+	if err != nil {
+		return fmt.Errorf("loading metadata for %s: %v", name, err)
+	}
+	if meta.Revoked != nil {
+		return fmt.Errorf("certificate for %s was revoked; not renewing", name)
+	}
+
+	return u.renewDomains(make(map[string]*acme.Client), certDomains(cert), failFast)
+}
+
+// RenewBundle renews the certificate in pemBundle, which must
+// contain a PEM-encoded certificate and may contain its private
+// key. If the key is present, it is reused for the new certificate;
+// otherwise a new key of the Manager's KeyType is generated. Nothing
+// is read from or written to the workspace.
+func (u *User) RenewBundle(pemBundle []byte) (acme.CertificateResource, error) {
+	m := u.manager()
+	if m.ServerURL == "" {
+		return acme.CertificateResource{}, fmt.Errorf("must set ServerURL before renewing certificates")
+	}
+
+	cert, privKey, err := parseBundle(pemBundle)
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+	if privKey == nil {
+		privKey, err = m.keyType().generate()
+		if err != nil {
+			return acme.CertificateResource{}, err
+		}
+	}
+
+	client, err := u.clientFor(make(map[string]*acme.Client), Solver{})
+	if err != nil {
+		return acme.CertificateResource{}, err
+	}
+
+	bundle := Bundle{Names: certDomains(cert), Key: privKey}
+	certRes, _, err := u.obtain(client, &bundle, false, nil)
+	return certRes, err
+}
+
+// dueForRenewal returns the names on each certificate in the
+// workspace that expires within days and has not been revoked,
+// along with the total number of sites in the workspace. Sites
+// that cannot be loaded are logged and skipped.
+func (m *Manager) dueForRenewal(days int) (bundles [][]string, total int, err error) {
+	sites, err := SiteNames(m.Storage)
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing sites: %v", err)
+	}
+
+	for _, site := range sites {
+		cert, err := loadCertificate(m.Storage, SiteCertFile(site))
+		if err != nil {
+			log.Printf("[ERROR] Loading certificate for %s: %v - skipping", site, err)
+			continue
+		}
+		if !needsRenewal(cert, days) {
+			continue
+		}
+		meta, err := m.loadSiteMeta(site)
+		if err != nil {
+			log.Printf("[ERROR] Loading metadata for %s: %v - skipping", site, err)
+			continue
+		}
+		if meta.Revoked != nil {
+			log.Printf("[INFO] Certificate for %s was revoked; not renewing", site)
+			continue
+		}
+		bundles = append(bundles, certDomains(cert))
+	}
+
+	return bundles, len(sites), nil
+}
+
+// renewalBundle returns the bundle for renewing the certificate
+// for domains, along with the source of its key. The bundle has
+// the settings that the certificate was obtained with. A key
+// supplied by the user is reused, as is a CSR. Otherwise, a new
+// key of the same type as the current one is generated; if the
+// current key cannot be loaded or is of an unknown type, the
+// Manager's KeyType is used.
+func (m *Manager) renewalBundle(domains []string) (Bundle, KeySource, error) {
+	site := domains[0]
+	bundle := Bundle{Names: domains}
+
+	meta, err := m.loadSiteMeta(site)
+	if err != nil {
+		return bundle, "", fmt.Errorf("loading metadata for %s: %v", site, err)
+	}
+
+	if meta.Solver != nil {
+		bundle.Solver = *meta.Solver
+	}
+	if meta.Output != nil {
+		bundle.Output = *meta.Output
+	}
+	bundle.PostIssue = meta.PostIssue
+
+	// names that were dropped because they failed validation
+	// are tried again if they may be dropped again; otherwise,
+	// they stay dropped
+	if len(meta.Dropped) > 0 && meta.KeySource != KeyFromCSR {
+		if m.DropFailedNames {
+			bundle.Names = uniqueNames(domains[0], append(append([]string(nil), domains[1:]...), meta.Dropped...))
+		} else {
+			bundle.dropped = meta.Dropped
+		}
+	}
+
+	switch meta.KeySource {
+	case KeySupplied:
+		bundle.Key, err = loadPrivateKey(m.Storage, SiteKeyFile(site))
+		if err != nil {
+			return bundle, "", fmt.Errorf("loading supplied private key for %s: %v", site, err)
+		}
+	case KeyFromCSR:
+		csrBytes, err := m.Storage.Load(SiteCSRFile(site))
+		if err != nil {
+			return bundle, "", fmt.Errorf("loading CSR for %s: %v", site, err)
+		}
+		bundle.CSR, err = ParseCSR(csrBytes)
+		if err != nil {
+			return bundle, "", fmt.Errorf("loading CSR for %s: %v", site, err)
+		}
+	default:
+		keyType := m.keyType()
+		if key, err := loadPrivateKey(m.Storage, SiteKeyFile(site)); err == nil && keyTypeOf(key) != "" {
+			keyType = keyTypeOf(key)
+		}
+		bundle.Key, err = keyType.generate()
+		if err != nil {
+			return bundle, "", fmt.Errorf("generating private key for %s: %v", site, err)
+		}
+	}
+
+	return bundle, meta.KeySource, nil
+}
+
+// needsRenewal returns true if cert expires within days.
+func needsRenewal(cert *x509.Certificate, days int) bool {
+	return cert.NotAfter.Sub(time.Now()) < time.Duration(days)*24*time.Hour
+}
+
+// certDomains returns the names on cert, with the Common Name
+// first (if it has one), followed by the SubjectAltNames. Names
+// are lower-cased and duplicates are removed.
+func certDomains(cert *x509.Certificate) []string {
+	return uniqueNames(cert.Subject.CommonName, cert.DNSNames)
+}
+
+// uniqueNames returns commonName followed by sans, lower-cased
+// and without duplicates or empty names.
+func uniqueNames(commonName string, sans []string) []string {
+	var domains []string
+	seen := make(map[string]struct{})
+	for _, name := range append([]string{commonName}, sans...) {
+		name = strings.ToLower(name)
+		if _, ok := seen[name]; ok || name == "" {
+			continue
+		}
+		seen[name] = struct{}{}
+		domains = append(domains, name)
+	}
+	return domains
+}
@@ -0,0 +1,223 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestNeedsRenewal(t *testing.T) {
+	for i, test := range []struct {
+		expiresIn time.Duration
+		days      int
+		expect    bool
+	}{
+		{expiresIn: 10 * 24 * time.Hour, days: 30, expect: true},
+		{expiresIn: 60 * 24 * time.Hour, days: 30, expect: false},
+		{expiresIn: -24 * time.Hour, days: 30, expect: true},
+		{expiresIn: 10 * 24 * time.Hour, days: 0, expect: false},
+	} {
+		cert := &x509.Certificate{NotAfter: time.Now().Add(test.expiresIn)}
+		if actual := needsRenewal(cert, test.days); actual != test.expect {
+			t.Errorf("Test %d: Expected needsRenewal to be %v but was %v", i, test.expect, actual)
+		}
+	}
+}
+
+func TestCertDomains(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "Example.com"},
+		DNSNames: []string{"example.com", "www.example.com", "WWW.example.com", "api.example.com"},
+	}
+	expect := []string{"example.com", "www.example.com", "api.example.com"}
+	if actual := certDomains(cert); !reflect.DeepEqual(actual, expect) {
+		t.Errorf("Expected domains %v but got %v", expect, actual)
+	}
+
+	cert = &x509.Certificate{DNSNames: []string{"example.com"}}
+	expect = []string{"example.com"}
+	if actual := certDomains(cert); !reflect.DeepEqual(actual, expect) {
+		t.Errorf("Expected domains %v for cert without CN but got %v", expect, actual)
+	}
+}
+
+func TestParseBundle(t *testing.T) {
+	certPEM, keyPEM := selfSignedPEM(t, []string{"example.com", "www.example.com"}, time.Now().Add(24*time.Hour))
+
+	cert, key, err := parseBundle(append(certPEM, keyPEM...))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cert.Subject.CommonName != "example.com" {
+		t.Errorf("Expected CN to be example.com but was '%s'", cert.Subject.CommonName)
+	}
+	if key == nil {
+		t.Error("Expected a private key, but got nil")
+	}
+
+	_, key, err = parseBundle(certPEM)
+	if err != nil {
+		t.Fatalf("Expected no error without key, got: %v", err)
+	}
+	if key != nil {
+		t.Errorf("Expected no private key, but got %v", key)
+	}
+
+	_, _, err = parseBundle(keyPEM)
+	if err == nil {
+		t.Error("Expected an error for bundle without certificate, but got none")
+	}
+}
+
+// selfSignedPEM makes a self-signed certificate for names that
+// expires at notAfter and returns it and its key, PEM-encoded.
+func selfSignedPEM(t *testing.T, names []string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		t.Fatalf("Could not generate test private key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("Could not create test certificate: %v", err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	return
+}
+
+func TestRenewalBundleReusesSuppliedKeyAndCSR(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+
+	_, keyPEM := selfSignedPEM(t, []string{"example.com"}, time.Now())
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("Expected no error parsing key, got: %v", err)
+	}
+	err = m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.com",
+		PrivateKey:  keyPEM,
+		Certificate: []byte("cert"),
+	}, Bundle{}, KeySupplied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, source, err := m.renewalBundle([]string{"example.com"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if source != KeySupplied || !privateKeysSame(bundle.Key, key) {
+		t.Errorf("Expected supplied key to be reused, got source '%s'", source)
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "Example.org"},
+		DNSNames: []string{"www.example.org", "example.org"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := ParseCSR(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}))
+	if err != nil {
+		t.Fatalf("Expected no error parsing CSR, got: %v", err)
+	}
+	if _, err := ParseCSR(csrDER); err != nil {
+		t.Errorf("Expected no error parsing DER CSR, got: %v", err)
+	}
+	if expected := []string{"example.org", "www.example.org"}; !reflect.DeepEqual(uniqueNames(csr.Subject.CommonName, csr.DNSNames), expected) {
+		t.Errorf("Expected CSR names %v, got %v", expected, uniqueNames(csr.Subject.CommonName, csr.DNSNames))
+	}
+	err = m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.org",
+		Certificate: []byte("cert"),
+	}, Bundle{CSR: csr}, KeyFromCSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Storage.Exists(SiteKeyFile("example.org")) {
+		t.Error("Expected no key file for certificate obtained for CSR, but there was one")
+	}
+	if !m.existingCertAndKey("example.org") {
+		t.Error("Expected certificate obtained for CSR to count as existing, but it did not")
+	}
+	bundle, source, err = m.renewalBundle([]string{"example.org", "www.example.org"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if source != KeyFromCSR || bundle.CSR == nil || !bytes.Equal(bundle.CSR.Raw, csr.Raw) {
+		t.Errorf("Expected CSR to be reused, got source '%s'", source)
+	}
+	if bundle.Key != nil {
+		t.Error("Expected no key for renewal with CSR, but there was one")
+	}
+}
+
+func TestRenewalBundleDroppedNames(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+	domains := []string{"example.com", "www.example.com"}
+
+	_, keyPEM := selfSignedPEM(t, domains, time.Now())
+	err := m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.com",
+		PrivateKey:  keyPEM,
+		Certificate: []byte("cert"),
+	}, Bundle{Names: domains, dropped: []string{"old.example.com"}}, KeyGenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := m.loadSiteMeta("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"old.example.com"}; !reflect.DeepEqual(meta.Dropped, expected) {
+		t.Errorf("Expected dropped names %v in metadata, got %v", expected, meta.Dropped)
+	}
+
+	// without dropping, renewals keep the names dropped
+	bundle, _, err := m.renewalBundle(domains)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(bundle.Names, domains) || !reflect.DeepEqual(bundle.dropped, meta.Dropped) {
+		t.Errorf("Expected names %v with %v still dropped, got %v with %v", domains, meta.Dropped, bundle.Names, bundle.dropped)
+	}
+
+	// with dropping, renewals try to add them back
+	m.DropFailedNames = true
+	bundle, _, err = m.renewalBundle(domains)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if expected := []string{"example.com", "www.example.com", "old.example.com"}; !reflect.DeepEqual(bundle.Names, expected) || bundle.dropped != nil {
+		t.Errorf("Expected names %v with none dropped, got %v with %v", expected, bundle.Names, bundle.dropped)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RevocationReason is a certificate revocation reason code
+// as defined in RFC 5280 section 5.3.1.
+type RevocationReason int
+
+// The revocation reason codes of RFC 5280. The value 7
+// is not used.
+const (
+	Unspecified          RevocationReason = 0
+	KeyCompromise        RevocationReason = 1
+	CACompromise         RevocationReason = 2
+	AffiliationChanged   RevocationReason = 3
+	Superseded           RevocationReason = 4
+	CessationOfOperation RevocationReason = 5
+	CertificateHold      RevocationReason = 6
+	RemoveFromCRL        RevocationReason = 8
+	PrivilegeWithdrawn   RevocationReason = 9
+	AACompromise         RevocationReason = 10
+)
+
+var reasonNames = map[RevocationReason]string{
+	Unspecified:          "unspecified",
+	KeyCompromise:        "keyCompromise",
+	CACompromise:         "cACompromise",
+	AffiliationChanged:   "affiliationChanged",
+	Superseded:           "superseded",
+	CessationOfOperation: "cessationOfOperation",
+	CertificateHold:      "certificateHold",
+	RemoveFromCRL:        "removeFromCRL",
+	PrivilegeWithdrawn:   "privilegeWithdrawn",
+	AACompromise:         "aACompromise",
+}
+
+// ParseRevocationReason parses a reason code given either by its
+// RFC 5280 name (case-insensitive) or by its number.
+func ParseRevocationReason(s string) (RevocationReason, error) {
+	s = strings.TrimSpace(s)
+	if num, err := strconv.Atoi(s); err == nil {
+		if _, ok := reasonNames[RevocationReason(num)]; ok {
+			return RevocationReason(num), nil
+		}
+		return 0, fmt.Errorf("unknown revocation reason code: %d", num)
+	}
+	for reason, name := range reasonNames {
+		if strings.EqualFold(s, name) {
+			return reason, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown revocation reason: '%s'", s)
+}
+
+// String returns the RFC 5280 name of r.
+func (r RevocationReason) String() string {
+	if name, ok := reasonNames[r]; ok {
+		return name
+	}
+	return strconv.Itoa(int(r))
+}
+
+// MarshalText encodes r as its name.
+func (r RevocationReason) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes r from its name or number.
+func (r *RevocationReason) UnmarshalText(text []byte) error {
+	reason, err := ParseRevocationReason(string(text))
+	if err != nil {
+		return err
+	}
+	*r = reason
+	return nil
+}
+
+// RevokeSites revokes the certificates of the sites with the given
+// names and marks each site as revoked in its metadata, so that
+// it will not be renewed. It stops at the first failure. The
+// reason is sent to the CA along with each certificate. A site
+// that another operation of u is working on is not waited for;
+// it fails with a SiteBusyError.
+func (u *User) RevokeSites(names []string, reason RevocationReason) error {
+	m := u.manager()
+	if m.ServerURL == "" {
+		return fmt.Errorf("must set ServerURL before revoking certificates")
+	}
+
+	err := u.Register()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err := u.revokeSite(strings.ToLower(name), reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeSite revokes the certificate of the site named name
+// and marks the site as revoked, while holding the lock on
+// the site.
+func (u *User) revokeSite(name string, reason RevocationReason) error {
+	m := u.manager()
+	err := u.lockSite(name, false)
+	if err != nil {
+		return err
+	}
+	defer u.unlockSite(name)
+
+	meta, err := m.loadSiteMeta(name)
+	if err != nil {
+		return fmt.Errorf("loading metadata for %s: %v", name, err)
+	}
+	if meta.Revoked != nil {
+		log.Printf("[INFO] Certificate for %s was already revoked on %v; skipping", name, meta.Revoked.Time)
+		return nil
+	}
+
+	cert, err := loadCertificate(m.Storage, SiteCertFile(name))
+	if err != nil {
+		return fmt.Errorf("loading certificate for %s: %v", name, err)
+	}
+
+	err = u.revokeCertificate(cert.Raw, reason)
+	if err != nil {
+		return fmt.Errorf("revoking certificate for %s: %v", name, err)
+	}
+	log.Printf("[INFO] Revoked certificate for %s (reason: %s)", name, reason)
+
+	meta.Revoked = &Revocation{Reason: reason, Time: time.Now().UTC()}
+	err = m.saveSiteMeta(meta)
+	if err != nil {
+		return fmt.Errorf("marking %s as revoked: %v", name, err)
+	}
+	return nil
+}
+
+// RevokeBundle revokes the certificate in pemBundle. If the same
+// certificate is stored in the workspace, its site is marked as
+// revoked too.
+func (u *User) RevokeBundle(pemBundle []byte, reason RevocationReason) error {
+	m := u.manager()
+	if m.ServerURL == "" {
+		return fmt.Errorf("must set ServerURL before revoking certificates")
+	}
+
+	cert, _, err := parseBundle(pemBundle)
+	if err != nil {
+		return err
+	}
+
+	err = u.Register()
+	if err != nil {
+		return err
+	}
+
+	err = u.revokeCertificate(cert.Raw, reason)
+	if err != nil {
+		return fmt.Errorf("revoking certificate: %v", err)
+	}
+	log.Printf("[INFO] Revoked certificate for %v (reason: %s)", certDomains(cert), reason)
+
+	// mark the site if we have this very certificate
+	name := strings.ToLower(cert.Subject.CommonName)
+	if name == "" {
+		return nil
+	}
+	stored, err := loadCertificate(m.Storage, SiteCertFile(name))
+	if err != nil || stored.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return nil
+	}
+	meta, err := m.loadSiteMeta(name)
+	if err != nil {
+		return fmt.Errorf("loading metadata for %s: %v", name, err)
+	}
+	meta.Revoked = &Revocation{Reason: reason, Time: time.Now().UTC()}
+	return m.saveSiteMeta(meta)
+}
+
+// revokeCertificate asks the CA to revoke the DER-encoded
+// certificate der for reason, signing the request with u's
+// key. The ACME client cannot send a reason code, so the
+// request is made here; u must already be registered.
+func (u *User) revokeCertificate(der []byte, reason RevocationReason) error {
+	dir, nonce, err := acmeDirectory(u.manager().ServerURL)
+	if err != nil {
+		return err
+	}
+	revokeURL := dir["revoke-cert"]
+	if revokeURL == "" {
+		return fmt.Errorf("CA does not support revoking certificates")
+	}
+	return acmePost(u.key, revokeURL, nonce, map[string]interface{}{
+		"resource":    "revoke-cert",
+		"certificate": encodeBase64(der),
+		"reason":      int(reason),
+	})
+}
@@ -0,0 +1,121 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mholt/certs/issuance/issuancetest"
+	"github.com/xenolf/lego/acme"
+)
+
+func TestParseRevocationReason(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expect    RevocationReason
+		shouldErr bool
+	}{
+		{input: "keyCompromise", expect: KeyCompromise},
+		{input: "KEYCOMPROMISE", expect: KeyCompromise},
+		{input: "superseded", expect: Superseded},
+		{input: "0", expect: Unspecified},
+		{input: "10", expect: AACompromise},
+		{input: "7", shouldErr: true},
+		{input: "11", shouldErr: true},
+		{input: "stolen", shouldErr: true},
+	} {
+		actual, err := ParseRevocationReason(test.input)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but got none", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got: %v", i, err)
+		}
+		if actual != test.expect {
+			t.Errorf("Test %d: Expected reason %v but got %v", i, test.expect, actual)
+		}
+	}
+}
+
+func TestRevocationReasonJSON(t *testing.T) {
+	rev := Revocation{Reason: CessationOfOperation}
+	jsonBytes, err := json.Marshal(rev)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var decoded Revocation
+	err = json.Unmarshal(jsonBytes, &decoded)
+	if err != nil {
+		t.Fatalf("Expected no error decoding %s, got: %v", jsonBytes, err)
+	}
+	if decoded.Reason != CessationOfOperation {
+		t.Errorf("Expected reason %v after round trip, got %v", CessationOfOperation, decoded.Reason)
+	}
+}
+
+func TestRevokeFromServer(t *testing.T) {
+	s := issuancetest.NewServer()
+	defer s.Close()
+
+	for _, keyType := range []KeyType{P256, P384} {
+		m := &Manager{ServerURL: s.DirectoryURL(), Agree: true, Storage: new(MemoryStorage), KeyType: keyType}
+		user, err := m.GetUser(string(keyType) + "@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		solver := Solver{Challenges: []acme.Challenge{acme.HTTP01}, HTTPAddress: "127.0.0.1:0"}
+		site, other := string(keyType)+".example.com", string(keyType)+".example.org"
+		err = user.ObtainBundles([]Bundle{{Names: []string{site}, Solver: solver}, {Names: []string{other}, Solver: solver}})
+		if err != nil {
+			t.Fatalf("%s: Expected no error obtaining, got: %v", keyType, err)
+		}
+
+		err = user.RevokeSites([]string{site}, KeyCompromise)
+		if err != nil {
+			t.Fatalf("%s: Expected no error revoking, got: %v", keyType, err)
+		}
+		details, err := m.ShowSite(site)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason, ok := s.RevocationReason(details.Certificate); !ok || reason != int(KeyCompromise) {
+			t.Errorf("%s: Expected CA to record reason %d, got %d (revoked: %v)", keyType, KeyCompromise, reason, ok)
+		}
+		if details.Meta.Revoked == nil || details.Meta.Revoked.Reason != KeyCompromise {
+			t.Errorf("%s: Expected site to be marked revoked for key compromise, got %+v", keyType, details.Meta.Revoked)
+		}
+
+		bundle, err := m.Storage.Load(SiteCertFile(other))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = user.RevokeBundle(bundle, Superseded)
+		if err != nil {
+			t.Fatalf("%s: Expected no error revoking bundle, got: %v", keyType, err)
+		}
+		details, err = m.ShowSite(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason, ok := s.RevocationReason(details.Certificate); !ok || reason != int(Superseded) {
+			t.Errorf("%s: Expected CA to record reason %d, got %d (revoked: %v)", keyType, Superseded, reason, ok)
+		}
+		if details.Meta.Revoked == nil || details.Meta.Revoked.Reason != Superseded {
+			t.Errorf("%s: Expected bundle's site to be marked revoked as superseded, got %+v", keyType, details.Meta.Revoked)
+		}
+	}
+}
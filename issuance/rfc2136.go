@@ -0,0 +1,185 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xenolf/lego/acme"
+)
+
+// TSIGSecretEnv is the environment variable that holds the
+// secret of the TSIG key for the rfc2136 DNS provider, if the
+// DNSConfig does not name a file with it.
+const TSIGSecretEnv = "CERTS_TSIG_SECRET"
+
+// tsigAlgorithms maps the names of the supported TSIG
+// algorithms, without the trailing dot, to their names
+// in DNS messages.
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigAlgorithm returns the TSIG algorithm of c as it
+// is named in DNS messages.
+func (c DNSConfig) tsigAlgorithm() (string, error) {
+	name := strings.TrimSuffix(strings.ToLower(c.TSIGAlgorithm), ".")
+	if name == "" {
+		name = "hmac-sha256"
+	}
+	algorithm, ok := tsigAlgorithms[name]
+	if !ok {
+		return "", fmt.Errorf("unknown TSIG algorithm '%s'; must be one of hmac-md5, hmac-sha1, hmac-sha256, hmac-sha512", c.TSIGAlgorithm)
+	}
+	return algorithm, nil
+}
+
+// rfc2136Provider solves the dns-01 challenge by sending
+// dynamic updates (RFC 2136) to a nameserver, signed with
+// a TSIG key if one is configured.
+type rfc2136Provider struct {
+	config     DNSConfig
+	nameserver string
+	algorithm  string
+	secret     string
+}
+
+// newRFC2136Provider returns a provider for c,
+// which must be valid, reading its TSIG secret.
+func newRFC2136Provider(c DNSConfig) (*rfc2136Provider, error) {
+	p := &rfc2136Provider{config: c, nameserver: c.Nameserver}
+	if _, _, err := net.SplitHostPort(p.nameserver); err != nil {
+		p.nameserver = net.JoinHostPort(p.nameserver, "53")
+	}
+	if c.TSIGKey == "" {
+		return p, nil
+	}
+
+	var err error
+	p.algorithm, err = c.tsigAlgorithm()
+	if err != nil {
+		return nil, err
+	}
+	if c.TSIGSecretFile != "" {
+		p.secret, err = ReadPassword(c.TSIGSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading TSIG secret: %v", err)
+		}
+	} else {
+		p.secret = os.Getenv(TSIGSecretEnv)
+	}
+	if p.secret == "" {
+		return nil, fmt.Errorf("no secret for TSIG key %s; give a secret file or set %s", c.TSIGKey, TSIGSecretEnv)
+	}
+	return p, nil
+}
+
+// Present adds the TXT record for domain, then
+// waits for the configured propagation wait.
+func (p *rfc2136Provider) Present(domain, token, keyAuth string) error {
+	fqdn, value, ttl := acme.DNS01Record(domain, keyAuth)
+	err := p.update(fqdn, value, ttl, true)
+	if err != nil {
+		return err
+	}
+	time.Sleep(p.config.PropagationWait)
+	return nil
+}
+
+// CleanUp removes the TXT record for domain.
+func (p *rfc2136Provider) CleanUp(domain, token, keyAuth string) error {
+	fqdn, value, ttl := acme.DNS01Record(domain, keyAuth)
+	return p.update(fqdn, value, ttl, false)
+}
+
+// Timeout returns how long to wait for the record to propagate.
+func (p *rfc2136Provider) Timeout() (timeout, interval time.Duration) {
+	return p.config.timeout()
+}
+
+// update adds the TXT record at fqdn with value and ttl if
+// insert is true, and removes it otherwise. Other records at
+// fqdn are left alone, so that the records of certificates
+// being obtained at the same time do not clobber each other.
+func (p *rfc2136Provider) update(fqdn, value string, ttl int, insert bool) error {
+	zone, err := p.zone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(ttl)},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+
+	reply, err := p.exchange(m)
+	if err != nil {
+		return fmt.Errorf("updating %s in zone %s: %v", fqdn, zone, err)
+	}
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("updating %s in zone %s: server replied %s", fqdn, zone, dns.RcodeToString[reply.Rcode])
+	}
+	return nil
+}
+
+// zone returns the zone that fqdn is in: the configured
+// zone, or else the one the nameserver gives the SOA of
+// when asked about fqdn.
+func (p *rfc2136Provider) zone(fqdn string) (string, error) {
+	if p.config.Zone != "" {
+		return dns.Fqdn(p.config.Zone), nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	reply, err := p.exchange(m)
+	if err != nil {
+		return "", fmt.Errorf("finding zone of %s: %v", fqdn, err)
+	}
+	for _, rr := range append(reply.Answer, reply.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("finding zone of %s: %s did not say; configure the zone", fqdn, p.nameserver)
+}
+
+// exchange sends m to the nameserver, signing it if
+// there is a TSIG key, and returns the reply.
+func (p *rfc2136Provider) exchange(m *dns.Msg) (*dns.Msg, error) {
+	c := new(dns.Client)
+	if p.config.TSIGKey != "" {
+		key := dns.Fqdn(p.config.TSIGKey)
+		c.TsigSecret = map[string]string{key: p.secret}
+		m.SetTsig(key, p.algorithm, 300, time.Now().Unix())
+	}
+	reply, _, err := c.Exchange(m, p.nameserver)
+	return reply, err
+}
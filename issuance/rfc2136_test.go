@@ -0,0 +1,206 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/xenolf/lego/acme"
+)
+
+// testNameserver is an in-process stand-in for a nameserver
+// that accepts dynamic updates to the TXT records of one zone.
+type testNameserver struct {
+	zone   string
+	addr   string
+	server *dns.Server
+
+	mu      sync.Mutex
+	records map[string][]string
+}
+
+// startNameserver starts a nameserver for zone on a local
+// port. If key is not empty, it only accepts messages signed
+// with the TSIG key of that name and secret.
+func startNameserver(t *testing.T, zone, key, secret string) *testNameserver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := &testNameserver{zone: dns.Fqdn(zone), addr: pc.LocalAddr().String(), records: make(map[string][]string)}
+	started := make(chan struct{})
+	ns.server = &dns.Server{PacketConn: pc, Handler: ns, NotifyStartedFunc: func() { close(started) }}
+	if key != "" {
+		ns.server.TsigSecret = map[string]string{dns.Fqdn(key): secret}
+	}
+	go ns.server.ActivateAndServe()
+	<-started
+	return ns
+}
+
+func (ns *testNameserver) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	tsig := r.IsTsig()
+	switch {
+	case ns.server.TsigSecret != nil && (tsig == nil || w.TsigStatus() != nil):
+		m.Rcode = dns.RcodeNotAuth
+	case r.Opcode == dns.OpcodeUpdate:
+		if r.Question[0].Name != ns.zone {
+			m.Rcode = dns.RcodeNotZone
+			break
+		}
+		ns.mu.Lock()
+		for _, rr := range r.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			name := strings.ToLower(txt.Hdr.Name)
+			if txt.Hdr.Class == dns.ClassNONE {
+				ns.records[name] = withoutNames(ns.records[name], txt.Txt)
+			} else {
+				ns.records[name] = append(ns.records[name], txt.Txt...)
+			}
+		}
+		ns.mu.Unlock()
+	default:
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{&dns.SOA{
+			Hdr:  dns.RR_Header{Name: ns.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:   "ns1." + ns.zone,
+			Mbox: "hostmaster." + ns.zone,
+		}}
+	}
+	if tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+// txt returns the TXT records at fqdn.
+func (ns *testNameserver) txt(fqdn string) []string {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.records[fqdn]
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	const secret = "c2VjcmV0IGZvciB0ZXN0aW5nIGR5bmFtaWMgdXBkYXRlcw=="
+	ns := startNameserver(t, "example.com", "certs", secret)
+	defer ns.server.Shutdown()
+
+	dir, err := ioutil.TempDir("", "certs_rfc2136")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "tsig.secret")
+	err = ioutil.WriteFile(secretFile, []byte(secret+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DNSConfig{Provider: "rfc2136", Nameserver: ns.addr, TSIGKey: "certs", TSIGSecretFile: secretFile}
+	provider, err := config.provider()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	// the zone is found by asking the nameserver
+	fqdn, value, _ := acme.DNS01Record("www.example.com", "token.thumbprint")
+	err = provider.Present("www.example.com", "token", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if actual := ns.txt(fqdn); !reflect.DeepEqual(actual, []string{value}) {
+		t.Errorf("Expected TXT record %s at %s, got %v", value, fqdn, actual)
+	}
+	err = provider.CleanUp("www.example.com", "token", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("Expected no error cleaning up, got: %v", err)
+	}
+	if actual := ns.txt(fqdn); len(actual) != 0 {
+		t.Errorf("Expected TXT record to be removed, got %v", actual)
+	}
+
+	// the secret can come from the environment
+	config.TSIGSecretFile = ""
+	os.Setenv(TSIGSecretEnv, secret)
+	defer os.Unsetenv(TSIGSecretEnv)
+	config.Zone = "example.com"
+	provider, err = config.provider()
+	if err != nil {
+		t.Fatalf("Expected no error with secret in environment, got: %v", err)
+	}
+	if err := provider.Present("example.com", "token", "token.thumbprint"); err != nil {
+		t.Errorf("Expected no error with configured zone, got: %v", err)
+	}
+
+	// failures are reported with the server's reply
+	config.Zone = "example.org"
+	provider, _ = config.provider()
+	if err := provider.Present("example.org", "token", "token.thumbprint"); err == nil || !strings.Contains(err.Error(), "NOTZONE") {
+		t.Errorf("Expected NOTZONE for another zone, got: %v", err)
+	}
+	config.Zone = ""
+	for _, unsigned := range []DNSConfig{
+		{Provider: "rfc2136", Nameserver: ns.addr},
+		{Provider: "rfc2136", Nameserver: ns.addr, TSIGKey: "other"},
+	} {
+		provider, err := unsigned.provider()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := provider.Present("example.com", "token", "token.thumbprint"); err == nil {
+			t.Errorf("Expected update with key '%s' to be refused, but it wasn't", unsigned.TSIGKey)
+		}
+	}
+
+	os.Unsetenv(TSIGSecretEnv)
+	if _, err := config.provider(); err == nil || !strings.Contains(err.Error(), TSIGSecretEnv) {
+		t.Errorf("Expected an error for a TSIG key without a secret, got: %v", err)
+	}
+}
+
+func TestRFC2136Validate(t *testing.T) {
+	for i, test := range []struct {
+		config    DNSConfig
+		shouldErr bool
+	}{
+		{DNSConfig{Provider: "rfc2136", Nameserver: "ns1.example.com"}, false},
+		{DNSConfig{Provider: "rfc2136", Nameserver: "ns1.example.com:5353", TSIGKey: "certs", TSIGAlgorithm: "HMAC-SHA512."}, false},
+		{DNSConfig{Provider: "rfc2136"}, true},
+		{DNSConfig{Provider: "rfc2136", Nameserver: "ns1.example.com", TSIGKey: "certs", TSIGAlgorithm: "hmac-sha3"}, true},
+		{DNSConfig{Provider: "rfc2136", Nameserver: "ns1.example.com", TSIGSecretFile: "tsig.secret"}, true},
+	} {
+		err := test.config.Validate()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+	}
+}
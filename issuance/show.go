@@ -0,0 +1,177 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SiteDetails is everything that is known about a site's
+// certificate, for inspecting it.
+type SiteDetails struct {
+	// Site is the name of the site.
+	Site string
+
+	// Certificate is the site's certificate, and Chain is
+	// the rest of the certificates in its file, starting
+	// with its issuer.
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+
+	// Meta is the metadata of the site.
+	Meta SiteMeta
+
+	// HasKey is true if the site's private key is in the
+	// workspace; it isn't if the certificate was obtained
+	// for a CSR. KeyMatches is true if that key belongs to
+	// the certificate.
+	HasKey     bool
+	KeyMatches bool
+}
+
+// ShowSite loads the details of the certificate of the site
+// named name, or if there is no such site, of the site whose
+// certificate covers name according to the index.
+func (m *Manager) ShowSite(name string) (*SiteDetails, error) {
+	site, err := m.SiteFor(name)
+	if err != nil {
+		return nil, err
+	}
+
+	certBytes, err := m.Storage.Load(SiteCertFile(site))
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", site, err)
+	}
+
+	details := &SiteDetails{Site: site, Certificate: certs[0], Chain: certs[1:]}
+	details.Meta, err = m.loadSiteMeta(site)
+	if err != nil {
+		return nil, fmt.Errorf("%s: loading metadata: %v", site, err)
+	}
+
+	key, err := loadPrivateKey(m.Storage, SiteKeyFile(site))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: loading private key: %v", site, err)
+	}
+	if key != nil {
+		details.HasKey = true
+		details.KeyMatches = keyMatchesCert(key, details.Certificate)
+	}
+	return details, nil
+}
+
+// SiteFor returns name if it is a site with a certificate in
+// the workspace. Otherwise, it returns the site whose certificate
+// covers name according to the index.
+func (m *Manager) SiteFor(name string) (string, error) {
+	site := strings.ToLower(name)
+	if m.Storage.Exists(SiteCertFile(site)) {
+		return site, nil
+	}
+	idx, err := m.LoadIndex()
+	if err != nil {
+		return "", err
+	}
+	site, ok := idx.Site(name)
+	if !ok {
+		return "", fmt.Errorf("no certificate for %s in the workspace", name)
+	}
+	return site, nil
+}
+
+// parseCertificates parses all the certificates in
+// pemBytes, which must have at least one.
+func parseCertificates(pemBytes []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(pemBytes); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate found in PEM data")
+	}
+	return certs, nil
+}
+
+// keyMatchesCert returns true if key is the
+// private key of cert's public key.
+func keyMatchesCert(key crypto.PrivateKey, cert *x509.Certificate) bool {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	pub, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(pub, cert.RawSubjectPublicKeyInfo)
+}
+
+// PublicKeyDescription describes the type and size of the
+// public key of cert, like "RSA 2048" or "ECDSA P-256".
+func PublicKeyDescription(cert *x509.Certificate) string {
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// Fingerprint returns the SHA-1 and SHA-256 fingerprints of
+// cert, as colon-separated hex like OpenSSL prints them.
+func Fingerprint(cert *x509.Certificate) (sha1Hex, sha256Hex string) {
+	s1 := sha1.Sum(cert.Raw)
+	s256 := sha256.Sum256(cert.Raw)
+	return colonHex(s1[:]), colonHex(s256[:])
+}
+
+// SPKIPin returns the base64 SHA-256 hash of the subject
+// public key info of cert, as used for public key pinning.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// colonHex formats b as upper-case hex bytes separated by colons.
+func colonHex(b []byte) string {
+	hex := make([]string, len(b))
+	for i, c := range b {
+		hex[i] = fmt.Sprintf("%02X", c)
+	}
+	return strings.Join(hex, ":")
+}
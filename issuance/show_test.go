@@ -0,0 +1,90 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestShowSite(t *testing.T) {
+	m := &Manager{Storage: new(MemoryStorage)}
+
+	names := []string{"example.com", "www.example.com"}
+	certPEM, keyPEM := selfSignedPEM(t, names, time.Now().Add(24*time.Hour))
+	issuerPEM, otherKeyPEM := selfSignedPEM(t, []string{"Test CA"}, time.Now().Add(24*time.Hour))
+	err := m.saveCertResource(acme.CertificateResource{
+		Domain:      "example.com",
+		Certificate: append(certPEM, issuerPEM...),
+		PrivateKey:  keyPEM,
+	}, Bundle{Names: names, account: "me@example.com"}, KeyGenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	details, err := m.ShowSite("WWW.example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if details.Site != "example.com" {
+		t.Errorf("Expected site example.com, got %s", details.Site)
+	}
+	if len(details.Chain) != 1 || details.Chain[0].Subject.CommonName != "Test CA" {
+		t.Errorf("Expected chain with Test CA, got %v", details.Chain)
+	}
+	if details.Meta.Account != "me@example.com" {
+		t.Errorf("Expected account me@example.com, got '%s'", details.Meta.Account)
+	}
+	if !details.HasKey || !details.KeyMatches {
+		t.Errorf("Expected matching key, got HasKey=%t KeyMatches=%t", details.HasKey, details.KeyMatches)
+	}
+	if desc := PublicKeyDescription(details.Certificate); desc != "RSA 512" {
+		t.Errorf("Expected RSA 512 key, got %s", desc)
+	}
+	sha1Hex, sha256Hex := Fingerprint(details.Certificate)
+	if len(sha1Hex) != 20*3-1 || len(sha256Hex) != 32*3-1 || strings.ToUpper(sha256Hex) != sha256Hex {
+		t.Errorf("Expected colon-separated upper-case fingerprints, got %s and %s", sha1Hex, sha256Hex)
+	}
+	if pin := SPKIPin(details.Certificate); len(pin) != 44 {
+		t.Errorf("Expected base64 SHA-256 pin, got %s", pin)
+	}
+
+	// a key that belongs to another certificate
+	m.Storage.Store(SiteKeyFile("example.com"), otherKeyPEM)
+	details, err = m.ShowSite("example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !details.HasKey || details.KeyMatches {
+		t.Errorf("Expected mismatched key, got HasKey=%t KeyMatches=%t", details.HasKey, details.KeyMatches)
+	}
+
+	// certificates obtained for a CSR have no key
+	m.Storage.Delete(SiteKeyFile("example.com"))
+	details, err = m.ShowSite("example.com")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if details.HasKey {
+		t.Error("Expected no key, but there was one")
+	}
+
+	if _, err := m.ShowSite("example.net"); err == nil {
+		t.Error("Expected error for name not in the workspace, but got none")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// SiteMeta is the metadata stored alongside a site's certificate
+// and key. It is the certificate resource from the CA plus what
+// we know about the certificate's state.
+type SiteMeta struct {
+	acme.CertificateResource
+
+	// KeySource is where the certificate's key came from,
+	// which determines how the certificate is renewed.
+	KeySource KeySource `json:"key_source,omitempty"`
+
+	// Solver, Output and PostIssue are the settings of the
+	// bundle the certificate was obtained for, which are
+	// used again when it is renewed.
+	Solver    *Solver  `json:"solver,omitempty"`
+	Output    *Output  `json:"output,omitempty"`
+	PostIssue []string `json:"post_issue,omitempty"`
+
+	// Dropped are names that were requested for the
+	// certificate but dropped because they failed
+	// validation. Renewals try to add them back.
+	Dropped []string `json:"dropped,omitempty"`
+
+	// Account is the email address of the account that
+	// obtained the certificate; empty for the default one.
+	Account string `json:"account,omitempty"`
+
+	// Revoked is set once the certificate has been revoked.
+	Revoked *Revocation `json:"revoked,omitempty"`
+}
+
+// KeySource is where the private key of a certificate came from.
+type KeySource string
+
+// The sources of private keys.
+const (
+	// KeyGenerated keys were generated for the certificate.
+	// Each renewal generates a new key of the same type.
+	KeyGenerated KeySource = ""
+
+	// KeySupplied keys were supplied by the user. Renewals
+	// reuse the key.
+	KeySupplied KeySource = "supplied"
+
+	// KeyFromCSR certificates were obtained for a CSR, so
+	// the key is not in the workspace. Renewals reuse the
+	// CSR, which is stored alongside the certificate.
+	KeyFromCSR KeySource = "csr"
+)
+
+// Revocation records when and why a certificate was revoked.
+type Revocation struct {
+	Reason RevocationReason `json:"reason"`
+	Time   time.Time        `json:"time"`
+}
+
+// loadSiteMeta loads the metadata for the site named domain.
+// If the site has no metadata file, an empty SiteMeta for
+// domain is returned.
+func (m *Manager) loadSiteMeta(domain string) (SiteMeta, error) {
+	meta := SiteMeta{CertificateResource: acme.CertificateResource{Domain: domain}}
+	metaBytes, err := m.Storage.Load(SiteMetaFile(domain))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(metaBytes, &meta)
+	return meta, err
+}
+
+// saveSiteMeta writes meta to the metadata file of its site,
+// then updates the site's entry in the index to match it and
+// the site's certificate.
+func (m *Manager) saveSiteMeta(meta SiteMeta) error {
+	jsonBytes, err := json.MarshalIndent(&meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = m.Storage.Store(SiteMetaFile(meta.Domain), jsonBytes)
+	if err != nil {
+		return err
+	}
+	return m.updateIndex(func(idx *Index) {
+		idx.setSite(meta.Domain, m.siteIndexEntry(meta.Domain, meta))
+	})
+}
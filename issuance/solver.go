@@ -0,0 +1,247 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/xenolf/lego/acme"
+)
+
+// Solver configures how the challenges for a certificate
+// are solved. The zero value uses the ACME client's defaults.
+// Fields that are left empty in a bundle's Solver are taken
+// from the Manager's Solver; the settings for the http-01
+// challenge, HTTPAddress or the webroots, are taken together.
+type Solver struct {
+	// Challenges are the types of challenges that may be
+	// solved. If empty, all types that the client can solve
+	// are allowed.
+	Challenges []acme.Challenge `json:"challenges,omitempty"`
+
+	// HTTPAddress is the interface and port to bind to
+	// when solving the http-01 challenge, like ":5002".
+	HTTPAddress string `json:"http_address,omitempty"`
+
+	// Webroot, if set, is the document root of a web
+	// server that already serves the names on port 80.
+	// The http-01 challenge is then solved by writing
+	// files into its .well-known/acme-challenge folder
+	// instead of binding HTTPAddress. Webroots maps
+	// names to their own document roots, for names that
+	// are served from somewhere other than Webroot.
+	Webroot  string            `json:"webroot,omitempty"`
+	Webroots map[string]string `json:"webroots,omitempty"`
+
+	// TLSAddress is the interface and port to bind to
+	// when solving the tls-sni-01 challenge.
+	TLSAddress string `json:"tls_address,omitempty"`
+
+	// DNS, if set, configures the provider that solves
+	// the dns-01 challenge, which can't be solved without
+	// one.
+	DNS *DNSConfig `json:"dns,omitempty"`
+}
+
+// allChallenges are the challenge types that can be solved.
+var allChallenges = []acme.Challenge{acme.HTTP01, acme.TLSSNI01, acme.DNS01}
+
+// ParseChallenge returns the challenge type named s, ignoring case.
+func ParseChallenge(s string) (acme.Challenge, error) {
+	switch c := acme.Challenge(strings.ToLower(s)); c {
+	case acme.HTTP01, acme.TLSSNI01, acme.DNS01:
+		return c, nil
+	case "tls-alpn-01":
+		return "", fmt.Errorf("challenge type '%s' is not supported yet; use %s", s, acme.TLSSNI01)
+	}
+	return "", fmt.Errorf("unknown challenge type '%s'; must be one of %s, %s, %s", s, acme.HTTP01, acme.TLSSNI01, acme.DNS01)
+}
+
+// ParseChallenges returns the challenge types in the
+// comma-separated list s, like "http-01,dns-01".
+func ParseChallenges(s string) ([]acme.Challenge, error) {
+	var challenges []acme.Challenge
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		c, err := ParseChallenge(name)
+		if err != nil {
+			return nil, err
+		}
+		challenges = append(challenges, c)
+	}
+	return challenges, nil
+}
+
+// Validate returns an error if s is not a valid configuration.
+func (s Solver) Validate() error {
+	for _, c := range s.Challenges {
+		if _, err := ParseChallenge(string(c)); err != nil {
+			return err
+		}
+	}
+	if s.HTTPAddress != "" && s.usesWebroot() {
+		return fmt.Errorf("cannot bind an http address when using a webroot")
+	}
+	for _, addr := range []string{s.HTTPAddress, s.TLSAddress} {
+		if addr == "" {
+			continue
+		}
+		if err := validateAddress(addr); err != nil {
+			return err
+		}
+	}
+	if s.DNS != nil {
+		return s.DNS.Validate()
+	}
+	return nil
+}
+
+// validateAddress returns an error if addr is not
+// an interface and port to bind to, like ":5002".
+func validateAddress(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid bind address '%s': %v", addr, err)
+	}
+	return nil
+}
+
+// configure applies s to client.
+func (s Solver) configure(client *acme.Client) error {
+	if len(s.Challenges) > 0 {
+		allowed := make(map[acme.Challenge]bool)
+		for _, c := range s.Challenges {
+			allowed[c] = true
+		}
+		var excluded []acme.Challenge
+		for _, c := range allChallenges {
+			if !allowed[c] {
+				excluded = append(excluded, c)
+			}
+		}
+		client.ExcludeChallenges(excluded)
+	}
+	if s.usesWebroot() {
+		if err := client.SetChallengeProvider(acme.HTTP01, webrootProvider{solver: s}); err != nil {
+			return err
+		}
+	} else {
+		host, port, err := bindAddress(s.HTTPAddress, "80")
+		if err != nil {
+			return err
+		}
+		provider := exclusiveProvider{addr: net.JoinHostPort(host, port), provider: acme.NewHTTPProviderServer(host, port)}
+		if err := client.SetChallengeProvider(acme.HTTP01, provider); err != nil {
+			return err
+		}
+	}
+	host, port, err := bindAddress(s.TLSAddress, "443")
+	if err != nil {
+		return err
+	}
+	provider := exclusiveProvider{addr: net.JoinHostPort(host, port), provider: acme.NewTLSProviderServer(host, port)}
+	if err := client.SetChallengeProvider(acme.TLSSNI01, provider); err != nil {
+		return err
+	}
+	if s.DNS != nil {
+		provider, err := s.DNS.provider()
+		if err != nil {
+			return err
+		}
+		if err := client.SetChallengeProvider(acme.DNS01, provider); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindAddress splits addr, the interface and port to bind to
+// when solving a challenge, into its host and port. If addr is
+// empty, it is all interfaces and defaultPort.
+func bindAddress(addr, defaultPort string) (host, port string, err error) {
+	if addr == "" {
+		return "", defaultPort, nil
+	}
+	return net.SplitHostPort(addr)
+}
+
+// boundAddresses are locked while a challenge is being
+// solved by serving it on them; see exclusiveProvider.
+var boundAddresses nameLocks
+
+// exclusiveProvider wraps a provider that solves challenges by
+// binding addr, like the ACME client's own http-01 and tls-sni-01
+// servers, so that only one challenge at a time is served on addr
+// in the process. Otherwise, concurrent workers, or the API and
+// the renewal loop of certsd, would fail to bind it while another
+// is using it. addr is locked from Present until CleanUp.
+type exclusiveProvider struct {
+	addr     string
+	provider acme.ChallengeProvider
+}
+
+// Present locks the address and presents the challenge.
+func (p exclusiveProvider) Present(domain, token, keyAuth string) error {
+	boundAddresses.lock(p.addr)
+	err := p.provider.Present(domain, token, keyAuth)
+	if err != nil {
+		// CleanUp is not called if Present fails
+		boundAddresses.unlock(p.addr)
+	}
+	return err
+}
+
+// CleanUp cleans up the challenge and unlocks the address.
+func (p exclusiveProvider) CleanUp(domain, token, keyAuth string) error {
+	defer boundAddresses.unlock(p.addr)
+	return p.provider.CleanUp(domain, token, keyAuth)
+}
+
+// withDefaults returns s with the fields
+// that it leaves empty taken from defaults.
+func (s Solver) withDefaults(defaults Solver) Solver {
+	if len(s.Challenges) == 0 {
+		s.Challenges = defaults.Challenges
+	}
+	if s.HTTPAddress == "" && !s.usesWebroot() {
+		s.HTTPAddress = defaults.HTTPAddress
+		s.Webroot = defaults.Webroot
+		s.Webroots = defaults.Webroots
+	}
+	if s.TLSAddress == "" {
+		s.TLSAddress = defaults.TLSAddress
+	}
+	if s.DNS == nil {
+		s.DNS = defaults.DNS
+	}
+	return s
+}
+
+// clientKey returns a string that is the same for
+// all Solvers that configure a client the same way.
+func (s Solver) clientKey() string {
+	key, _ := json.Marshal(s)
+	return string(key)
+}
+
+// isZero returns true if s uses the client's defaults.
+func (s Solver) isZero() bool {
+	return s.clientKey() == Solver{}.clientKey()
+}
@@ -0,0 +1,76 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xenolf/lego/acme"
+)
+
+func TestParseChallenges(t *testing.T) {
+	for i, test := range []struct {
+		input     string
+		expected  []acme.Challenge
+		shouldErr bool
+	}{
+		{"", nil, false},
+		{"http-01", []acme.Challenge{acme.HTTP01}, false},
+		{"HTTP-01, dns-01,", []acme.Challenge{acme.HTTP01, acme.DNS01}, false},
+		{"tls-sni-01,http-01,dns-01", []acme.Challenge{acme.TLSSNI01, acme.HTTP01, acme.DNS01}, false},
+		{"http-01,tls-alpn-01", nil, true},
+		{"http", nil, true},
+	} {
+		actual, err := ParseChallenges(test.input)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got: %v", i, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestSolverWithDefaults(t *testing.T) {
+	defaults := Solver{Challenges: []acme.Challenge{acme.HTTP01}, HTTPAddress: ":5002", TLSAddress: ":5001", DNS: &DNSConfig{Provider: "exec", Exec: "update-dns"}}
+
+	if actual := (Solver{}).withDefaults(defaults); !reflect.DeepEqual(actual, defaults) {
+		t.Errorf("Expected empty solver to take the defaults, got %+v", actual)
+	}
+
+	own := Solver{Challenges: []acme.Challenge{acme.DNS01}, HTTPAddress: "127.0.0.1:80"}
+	expected := Solver{Challenges: []acme.Challenge{acme.DNS01}, HTTPAddress: "127.0.0.1:80", TLSAddress: ":5001", DNS: defaults.DNS}
+	if actual := own.withDefaults(defaults); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, actual)
+	}
+
+	if actual := own.withDefaults(Solver{}); !reflect.DeepEqual(actual, own) {
+		t.Errorf("Expected solver to be unchanged without defaults, got %+v", actual)
+	}
+
+	// the http-01 settings are taken together
+	webroot := Solver{Webroot: "/var/www", Webroots: map[string]string{"a.com": "/srv/a"}}
+	expected = Solver{Challenges: defaults.Challenges, Webroot: "/var/www", Webroots: webroot.Webroots, TLSAddress: ":5001", DNS: defaults.DNS}
+	if actual := webroot.withDefaults(defaults); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected webroot not to be mixed with the default http address, got %+v", actual)
+	}
+	if actual := (Solver{}).withDefaults(webroot); !reflect.DeepEqual(actual, webroot) {
+		t.Errorf("Expected empty solver to take the default webroots, got %+v", actual)
+	}
+}
@@ -15,58 +15,109 @@
 package issuance
 
 import (
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
 )
 
-// Workspace is where this program stores assets.
-var Workspace = Storage(DefaultWorkspace)
+// Workspace is where the default Manager stores assets.
+var Workspace Storage = FileStorage(DefaultWorkspace)
 
-// Storage is a root directory and facilitates forming file paths
-// derived from it.
-type Storage string
+// Storage stores the assets of a workspace. Assets are values
+// stored under keys, which are slash-separated paths such as
+// "sites/example.com/example.com.crt"; use the functions in this
+// file to form them.
+type Storage interface {
+	// Load returns the value stored under key. If there is
+	// none, the error satisfies os.IsNotExist.
+	Load(key string) ([]byte, error)
 
-// Sites gets the directory that stores site certificate and keys.
-func (s Storage) Sites() string {
-	return filepath.Join(string(s), "sites")
+	// Store stores value under key, replacing any value that
+	// was there. Values must be stored privately, since they
+	// may be private keys.
+	Store(key string, value []byte) error
+
+	// Delete deletes the value stored under key, as well as
+	// all values stored under keys that have key as a prefix
+	// directory. Deleting a key that does not exist is not
+	// an error.
+	Delete(key string) error
+
+	// Exists returns true if a value is stored under key.
+	Exists(key string) bool
+
+	// List returns all the keys, in lexical order, that are
+	// stored under the directory prefix, at any depth. An
+	// empty prefix lists all keys.
+	List(prefix string) ([]string, error)
+
+	// Lock acquires a lock named key, blocking until it is
+	// available. Locks are advisory; they are used to keep
+	// writers from clobbering each other, not readers.
+	Lock(key string) error
+
+	// Unlock releases the lock named key.
+	Unlock(key string) error
 }
 
-// Site returns the path to the folder containing assets for domain.
-func (s Storage) Site(domain string) string {
-	return filepath.Join(s.Sites(), strings.ToLower(domain))
+// SiteNames returns the names of all the sites in storage. A
+// site's name is the Common Name of its certificate.
+func SiteNames(s Storage) ([]string, error) {
+	keys, err := s.List(sitesKey)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		// only folders directly under sites are sites
+		parts := strings.Split(key, "/")
+		if len(parts) < 3 {
+			continue
+		}
+		if len(names) == 0 || names[len(names)-1] != parts[1] {
+			names = append(names, parts[1])
+		}
+	}
+	return names, nil
+}
+
+// SiteDir returns the key of the folder containing assets for domain.
+func SiteDir(domain string) string {
+	return path.Join(sitesKey, strings.ToLower(domain))
 }
 
-// SiteCertFile returns the path to the certificate file for domain.
-func (s Storage) SiteCertFile(domain string) string {
-	return filepath.Join(s.Site(domain), strings.ToLower(domain)+".crt")
+// SiteCertFile returns the key of the certificate file for domain.
+func SiteCertFile(domain string) string {
+	return path.Join(SiteDir(domain), strings.ToLower(domain)+".crt")
 }
 
-// SiteKeyFile returns the path to domain's private key file.
-func (s Storage) SiteKeyFile(domain string) string {
-	return filepath.Join(s.Site(domain), strings.ToLower(domain)+".key")
+// SiteKeyFile returns the key of domain's private key file.
+func SiteKeyFile(domain string) string {
+	return path.Join(SiteDir(domain), strings.ToLower(domain)+".key")
 }
 
-// SiteMetaFile returns the path to the domain's asset metadata file.
-func (s Storage) SiteMetaFile(domain string) string {
-	return filepath.Join(s.Site(domain), strings.ToLower(domain)+".json")
+// SiteCSRFile returns the key of the CSR file for domain, which
+// only exists if its certificate was obtained for a CSR.
+func SiteCSRFile(domain string) string {
+	return path.Join(SiteDir(domain), strings.ToLower(domain)+".csr")
 }
 
-// Users gets the directory that stores account folders.
-func (s Storage) Users() string {
-	return filepath.Join(string(s), "users")
+// SiteMetaFile returns the key of the domain's asset metadata file.
+func SiteMetaFile(domain string) string {
+	return path.Join(SiteDir(domain), strings.ToLower(domain)+".json")
 }
 
-// User gets the account folder for the user with email.
-func (s Storage) User(email string) string {
+// UserDir gets the key of the account folder for the user with email.
+func UserDir(email string) string {
 	if email == "" {
 		email = emptyEmail
 	}
-	return filepath.Join(s.Users(), strings.ToLower(email))
+	return path.Join(usersKey, strings.ToLower(email))
 }
 
-// UserRegFile gets the path to the registration file for
+// UserRegFile gets the key of the registration file for
 // the user with the given email address.
-func (s Storage) UserRegFile(email string) string {
+func UserRegFile(email string) string {
 	if email == "" {
 		email = emptyEmail
 	}
@@ -74,12 +125,12 @@ func (s Storage) UserRegFile(email string) string {
 	if fileName == "" {
 		fileName = "registration"
 	}
-	return filepath.Join(s.User(email), strings.ToLower(fileName)+".json")
+	return path.Join(UserDir(email), strings.ToLower(fileName)+".json")
 }
 
-// UserKeyFile gets the path to the private key file for
+// UserKeyFile gets the key of the private key file for
 // the user with the given email address.
-func (s Storage) UserKeyFile(email string) string {
+func UserKeyFile(email string) string {
 	if email == "" {
 		email = emptyEmail
 	}
@@ -87,7 +138,23 @@ func (s Storage) UserKeyFile(email string) string {
 	if fileName == "" {
 		fileName = "private"
 	}
-	return filepath.Join(s.User(email), strings.ToLower(fileName)+".key")
+	return path.Join(UserDir(email), strings.ToLower(fileName)+".key")
+}
+
+// JobDir returns the key of the folder of the job with id.
+func JobDir(id string) string {
+	return path.Join(jobsKey, id)
+}
+
+// JobFile returns the key of the journal of the job with id.
+func JobFile(id string) string {
+	return path.Join(JobDir(id), jobJournal)
+}
+
+// JobKeyFile returns the key of the supplied private key
+// of the bundle at index i in the job with id.
+func JobKeyFile(id string, i int) string {
+	return path.Join(JobDir(id), strconv.Itoa(i)+".key")
 }
 
 // emailUsername returns the username portion of an
@@ -103,6 +170,23 @@ func emailUsername(email string) string {
 	return email[:at]
 }
 
+const (
+	// The folder that stores site certificates and keys.
+	sitesKey = "sites"
+
+	// The folder that stores account folders.
+	usersKey = "users"
+
+	// The folder that stores job folders.
+	jobsKey = "jobs"
+
+	// The name of a job's journal file in its folder.
+	jobJournal = "job.json"
+)
+
+// IndexFile is the key of the workspace's index.
+const IndexFile = "index.json"
+
 // The name of the folder for accounts where the email
 // address was not provided.
 const emptyEmail = "default"
@@ -15,50 +15,185 @@
 package issuance
 
 import (
+	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
-func TestStorage(t *testing.T) {
-	Workspace = Storage("./certs_test")
+func TestStorageKeys(t *testing.T) {
+	for i, test := range []struct {
+		actual, expect string
+	}{
+		{actual: SiteDir("Test.com"), expect: "sites/test.com"},
+		{actual: SiteCertFile("Test.com"), expect: "sites/test.com/test.com.crt"},
+		{actual: SiteKeyFile("Test.com"), expect: "sites/test.com/test.com.key"},
+		{actual: SiteMetaFile("Test.com"), expect: "sites/test.com/test.com.json"},
+		{actual: UserDir("Me@example.com"), expect: "users/me@example.com"},
+		{actual: UserRegFile("Me@example.com"), expect: "users/me@example.com/me.json"},
+		{actual: UserKeyFile("Me@example.com"), expect: "users/me@example.com/me.key"},
 
-	if expected, actual := filepath.Join("certs_test", "sites"), Workspace.Sites(); actual != expected {
-		t.Errorf("Expected Sites() to return '%s' but got '%s'", expected, actual)
+		// Test with empty emails
+		{actual: UserDir(""), expect: "users/" + emptyEmail},
+		{actual: UserRegFile(""), expect: "users/" + emptyEmail + "/" + emptyEmail + ".json"},
+		{actual: UserKeyFile(""), expect: "users/" + emptyEmail + "/" + emptyEmail + ".key"},
+	} {
+		if test.actual != test.expect {
+			t.Errorf("Test %d: Expected key '%s' but got '%s'", i, test.expect, test.actual)
+		}
 	}
-	if expected, actual := filepath.Join("certs_test", "sites", "test.com"), Workspace.Site("Test.com"); actual != expected {
-		t.Errorf("Expected Site() to return '%s' but got '%s'", expected, actual)
+}
+
+func TestFileStoragePath(t *testing.T) {
+	storage := FileStorage("./certs_test")
+	if expected, actual := filepath.Join("certs_test", "sites", "test.com", "test.com.crt"), storage.Path(SiteCertFile("Test.com")); actual != expected {
+		t.Errorf("Expected Path() to return '%s' but got '%s'", expected, actual)
 	}
-	if expected, actual := filepath.Join("certs_test", "sites", "test.com", "test.com.crt"), Workspace.SiteCertFile("Test.com"); actual != expected {
-		t.Errorf("Expected SiteCertFile() to return '%s' but got '%s'", expected, actual)
+}
+
+func TestFileStorage(t *testing.T) {
+	storage := FileStorage("./certs_test_storage")
+	defer os.RemoveAll(string(storage))
+
+	testStorage(t, storage)
+
+	// it doesn't make sense to test file permission on windows
+	if runtime.GOOS != "windows" {
+		err := storage.Store("private/file", []byte("secret"))
+		if err != nil {
+			t.Fatalf("Expected no error storing, got: %v", err)
+		}
+		info, err := os.Stat(storage.Path("private/file"))
+		if err != nil {
+			t.Fatalf("Expected no error stating stored file, got: %v", err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("Expected stored file to have permission 0600, but it had %v", info.Mode().Perm())
+		}
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, new(MemoryStorage))
+}
+
+// testStorage exercises storage, which must be empty.
+func testStorage(t *testing.T, storage Storage) {
+	if _, err := storage.Load("a/b"); !os.IsNotExist(err) {
+		t.Errorf("Expected not-exist error loading missing key, got: %v", err)
 	}
-	if expected, actual := filepath.Join("certs_test", "sites", "test.com", "test.com.key"), Workspace.SiteKeyFile("Test.com"); actual != expected {
-		t.Errorf("Expected SiteKeyFile() to return '%s' but got '%s'", expected, actual)
+	if storage.Exists("a/b") {
+		t.Error("Expected missing key to not exist, but it did")
 	}
-	if expected, actual := filepath.Join("certs_test", "sites", "test.com", "test.com.json"), Workspace.SiteMetaFile("Test.com"); actual != expected {
-		t.Errorf("Expected SiteMetaFile() to return '%s' but got '%s'", expected, actual)
+	keys, err := storage.List("a")
+	if err != nil || len(keys) != 0 {
+		t.Errorf("Expected empty list and no error for missing prefix, got %v (%v)", keys, err)
 	}
-	if expected, actual := filepath.Join("certs_test", "users"), Workspace.Users(); actual != expected {
-		t.Errorf("Expected Users() to return '%s' but got '%s'", expected, actual)
+
+	for _, key := range []string{"a/b", "a/c/d", "ab/e"} {
+		if err := storage.Store(key, []byte("value of "+key)); err != nil {
+			t.Fatalf("Expected no error storing %s, got: %v", key, err)
+		}
+	}
+	if err := storage.Store("a/b", []byte("new value")); err != nil {
+		t.Fatalf("Expected no error replacing a/b, got: %v", err)
+	}
+
+	value, err := storage.Load("a/b")
+	if err != nil {
+		t.Fatalf("Expected no error loading, got: %v", err)
 	}
-	if expected, actual := filepath.Join("certs_test", "users", "me@example.com"), Workspace.User("Me@example.com"); actual != expected {
-		t.Errorf("Expected User() to return '%s' but got '%s'", expected, actual)
+	if string(value) != "new value" {
+		t.Errorf("Expected value 'new value', got '%s'", value)
 	}
-	if expected, actual := filepath.Join("certs_test", "users", "me@example.com", "me.json"), Workspace.UserRegFile("Me@example.com"); actual != expected {
-		t.Errorf("Expected UserRegFile() to return '%s' but got '%s'", expected, actual)
+	if !storage.Exists("a/c/d") {
+		t.Error("Expected a/c/d to exist, but it did not")
 	}
-	if expected, actual := filepath.Join("certs_test", "users", "me@example.com", "me.key"), Workspace.UserKeyFile("Me@example.com"); actual != expected {
-		t.Errorf("Expected UserKeyFile() to return '%s' but got '%s'", expected, actual)
+	if storage.Exists("a/c") {
+		t.Error("Expected folder a/c to not exist as a value, but it did")
 	}
 
-	// Test with empty emails
-	if expected, actual := filepath.Join("certs_test", "users", emptyEmail), Workspace.User(emptyEmail); actual != expected {
-		t.Errorf("Expected User(\"\") to return '%s' but got '%s'", expected, actual)
+	keys, err = storage.List("a")
+	if err != nil {
+		t.Fatalf("Expected no error listing, got: %v", err)
 	}
-	if expected, actual := filepath.Join("certs_test", "users", emptyEmail, emptyEmail+".json"), Workspace.UserRegFile(""); actual != expected {
-		t.Errorf("Expected UserRegFile(\"\") to return '%s' but got '%s'", expected, actual)
+	if expected := []string{"a/b", "a/c/d"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+	keys, err = storage.List("")
+	if err != nil {
+		t.Fatalf("Expected no error listing all keys, got: %v", err)
+	}
+	if expected := []string{"a/b", "a/c/d", "ab/e"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected all keys %v, got %v", expected, keys)
+	}
+
+	if err := storage.Lock("a/b"); err != nil {
+		t.Fatalf("Expected no error locking, got: %v", err)
+	}
+	locked := make(chan struct{})
+	go func() {
+		storage.Lock("a/b")
+		close(locked)
+		storage.Unlock("a/b")
+	}()
+	select {
+	case <-locked:
+		t.Error("Expected second lock to wait for first to be released, but it did not")
+	case <-time.After(50 * time.Millisecond):
+	}
+	keys, _ = storage.List("a")
+	if len(keys) != 2 {
+		t.Errorf("Expected locks to not be listed, got %v", keys)
+	}
+	if err := storage.Unlock("a/b"); err != nil {
+		t.Fatalf("Expected no error unlocking, got: %v", err)
+	}
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("Expected second lock to be acquired after release, but it was not")
+	}
+
+	if err := storage.Delete("a"); err != nil {
+		t.Fatalf("Expected no error deleting, got: %v", err)
+	}
+	if storage.Exists("a/b") || storage.Exists("a/c/d") {
+		t.Error("Expected keys under a to be deleted, but they were not")
+	}
+	if !storage.Exists("ab/e") {
+		t.Error("Expected ab/e to survive deleting a, but it did not")
+	}
+	if err := storage.Delete("nothing/here"); err != nil {
+		t.Errorf("Expected no error deleting missing key, got: %v", err)
+	}
+}
+
+func TestSiteNames(t *testing.T) {
+	storage := new(MemoryStorage)
+
+	names, err := SiteNames(storage)
+	if err != nil {
+		t.Fatalf("Expected no error without sites, got: %v", err)
+	}
+	if len(names) != 0 {
+		t.Errorf("Expected no sites, got %v", names)
+	}
+
+	for _, domain := range []string{"b.com", "a.com"} {
+		storage.Store(SiteCertFile(domain), []byte("cert"))
+		storage.Store(SiteKeyFile(domain), []byte("key"))
+	}
+	storage.Store("sites/stray.txt", []byte("not a site"))
+
+	names, err = SiteNames(storage)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
 	}
-	if expected, actual := filepath.Join("certs_test", "users", emptyEmail, emptyEmail+".key"), Workspace.UserKeyFile(""); actual != expected {
-		t.Errorf("Expected UserKeyFile(\"\") to return '%s' but got '%s'", expected, actual)
+	if expected := []string{"a.com", "b.com"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected sites %v, got %v", expected, names)
 	}
 }
 
@@ -0,0 +1,94 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Outcome is what became of a bundle in a bulk run.
+type Outcome string
+
+// The outcomes of a bundle.
+const (
+	// Obtained means a certificate was obtained and saved.
+	Obtained Outcome = "obtained"
+
+	// Skipped means there was nothing to do, because the
+	// bundle has no names or there is a certificate already.
+	Skipped Outcome = "skipped"
+
+	// Failed means the certificate could not be obtained.
+	Failed Outcome = "failed"
+)
+
+// BundleResult is the outcome of one bundle in a bulk run.
+type BundleResult struct {
+	Names   []string `json:"names"`
+	Outcome Outcome  `json:"outcome"`
+	Error   string   `json:"error,omitempty"`
+
+	// Dropped are names that were dropped from the
+	// bundle because they failed validation.
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// Summary describes the outcome of a bulk run.
+type Summary struct {
+	// Results has one entry for each bundle that was
+	// started, in the order the bundles were given.
+	Results []BundleResult `json:"results"`
+}
+
+// Count returns how many bundles had the outcome o.
+func (s Summary) Count(o Outcome) int {
+	var n int
+	for _, r := range s.Results {
+		if r.Outcome == o {
+			n++
+		}
+	}
+	return n
+}
+
+// Failures returns the results of the bundles that failed.
+func (s Summary) Failures() []BundleResult {
+	var failures []BundleResult
+	for _, r := range s.Results {
+		if r.Outcome == Failed {
+			failures = append(failures, r)
+		}
+	}
+	return failures
+}
+
+// String returns how many bundles had each outcome,
+// like "3 obtained, 1 skipped, 0 failed".
+func (s Summary) String() string {
+	var counts []string
+	for _, o := range []Outcome{Obtained, Skipped, Failed} {
+		counts = append(counts, fmt.Sprintf("%d %s", s.Count(o), o))
+	}
+	return strings.Join(counts, ", ")
+}
+
+// Err returns an error if any bundle failed.
+func (s Summary) Err() error {
+	if n := s.Count(Failed); n > 0 {
+		return fmt.Errorf("%d of %d certificates failed", n, len(s.Results))
+	}
+	return nil
+}
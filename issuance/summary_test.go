@@ -0,0 +1,77 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	s := Summary{Results: []BundleResult{
+		{Names: []string{"a.com"}, Outcome: Obtained},
+		{Names: []string{"b.com"}, Outcome: Failed, Error: "oops"},
+		{Names: []string{"c.com"}, Outcome: Skipped},
+		{Names: []string{"d.com"}, Outcome: Obtained},
+	}}
+
+	if expected, actual := "2 obtained, 1 skipped, 1 failed", s.String(); actual != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, actual)
+	}
+	if failures := s.Failures(); len(failures) != 1 || failures[0].Names[0] != "b.com" {
+		t.Errorf("Expected only b.com to have failed, got %v", failures)
+	}
+	if err := s.Err(); err == nil {
+		t.Error("Expected an error when a bundle failed, but got none")
+	}
+
+	s.Results[1].Outcome = Obtained
+	if err := s.Err(); err != nil {
+		t.Errorf("Expected no error when none failed, got: %v", err)
+	}
+}
+
+func TestObtainSummaryOrder(t *testing.T) {
+	m := &Manager{ServerURL: "https://ca.example.com/directory", Storage: new(MemoryStorage), Concurrency: 3}
+
+	// certificates that exist already are skipped without
+	// contacting the CA, so every bundle here is skipped
+	var bundles []Bundle
+	var expected []BundleResult
+	for i := 0; i < 10; i++ {
+		domain := fmt.Sprintf("site%d.example.com", i)
+		certPEM, keyPEM := selfSignedPEM(t, []string{domain}, time.Now().Add(24*time.Hour))
+		m.Storage.Store(SiteCertFile(domain), certPEM)
+		m.Storage.Store(SiteKeyFile(domain), keyPEM)
+		bundles = append(bundles, Bundle{Names: []string{domain}})
+		expected = append(expected, BundleResult{Names: []string{domain}, Outcome: Skipped})
+	}
+	bundles = append(bundles, Bundle{})
+	expected = append(expected, BundleResult{Outcome: Skipped})
+
+	user, err := m.GetUser("me@foobar.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := user.ObtainSummary(bundles)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(summary.Results, expected) {
+		t.Errorf("Expected results in order:\n%v\ngot:\n%v", expected, summary.Results)
+	}
+}
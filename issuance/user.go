@@ -15,14 +15,16 @@
 package issuance
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/xenolf/lego/acme"
 )
@@ -32,35 +34,42 @@ type User struct {
 	rateLimiter  `json:"-"`
 	Email        string
 	Registration *acme.RegistrationResource
-	key          *rsa.PrivateKey
+	key          crypto.PrivateKey
+	mgr          *Manager
+	sites        nameLocks
+}
+
+// GetUser loads the user with the given email from disk
+// using the default Manager. See Manager.GetUser.
+func GetUser(email string) (*User, error) {
+	return defaultManager().GetUser(email)
 }
 
 // GetUser loads the user with the given email from disk.
 // If the user does not exist, it will create a new one,
 // but it will NOT save new user to the disk or register
 // it via ACME.
-func GetUser(email string) (*User, error) {
-	var user User
+func (m *Manager) GetUser(email string) (*User, error) {
+	user := User{mgr: m}
 
-	// open user file
-	regFile, err := os.Open(Workspace.UserRegFile(email))
+	// load user file
+	regBytes, err := m.Storage.Load(UserRegFile(email))
 	if err != nil {
 		if os.IsNotExist(err) {
 			// create a new user
-			return newUser(email)
+			return m.newUser(email)
 		}
 		return nil, err
 	}
-	defer regFile.Close()
 
 	// load user information
-	err = json.NewDecoder(regFile).Decode(&user)
+	err = json.Unmarshal(regBytes, &user)
 	if err != nil {
 		return nil, err
 	}
 
 	// load their private key
-	user.key, err = loadRSAPrivateKey(Workspace.UserKeyFile(email))
+	user.key, err = loadPrivateKey(m.Storage, UserKeyFile(email))
 	if err != nil {
 		return nil, err
 	}
@@ -71,10 +80,10 @@ func GetUser(email string) (*User, error) {
 // newUser creates a new User for the given email address
 // with a new private key. This function will NOT save the
 // user to disk or register it via ACME. If you want to use
-// a user account that might already exist, call getUser
+// a user account that might already exist, call GetUser
 // instead.
-func newUser(email string) (*User, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeySize)
+func (m *Manager) newUser(email string) (*User, error) {
+	privateKey, err := m.keyType().generate()
 	if err != nil {
 		return nil, err
 	}
@@ -82,22 +91,23 @@ func newUser(email string) (*User, error) {
 	u := &User{
 		Email: email,
 		key:   privateKey,
+		mgr:   m,
 	}
 
 	return u, nil
 }
 
 // saveUser persists a user's key and account registration
-// to the file system. It does NOT register the user via ACME.
-func saveUser(user *User) error {
-	// make user account folder
-	err := os.MkdirAll(Workspace.User(user.Email), 0700)
+// to storage. It does NOT register the user via ACME.
+func (m *Manager) saveUser(user *User) error {
+	err := m.Storage.Lock(UserDir(user.Email))
 	if err != nil {
 		return err
 	}
+	defer m.Storage.Unlock(UserDir(user.Email))
 
 	// save private key file
-	err = saveRSAPrivateKey(user.key, Workspace.UserKeyFile(user.Email))
+	err = savePrivateKey(m.Storage, user.key, UserKeyFile(user.Email))
 	if err != nil {
 		return err
 	}
@@ -108,67 +118,478 @@ func saveUser(user *User) error {
 		return err
 	}
 
-	return ioutil.WriteFile(Workspace.UserRegFile(user.Email), jsonBytes, 0600)
+	return m.Storage.Store(UserRegFile(user.Email), jsonBytes)
+}
+
+// Bundle describes a certificate to obtain.
+type Bundle struct {
+	// Names are the domain names to put on the certificate.
+	// The first one is the Common Name, and all of them are
+	// SubjectAltNames. If CSR is set, Names may be empty,
+	// in which case they are taken from the CSR.
+	Names []string
+
+	// KeyType is the type of private key to generate for the
+	// certificate. If empty, the Manager's KeyType is used.
+	KeyType KeyType
+
+	// Key, if set, is the private key to use for the
+	// certificate instead of generating one. Renewals of
+	// the certificate will reuse it.
+	Key crypto.PrivateKey
+
+	// CSR, if set, is the certificate signing request to
+	// obtain the certificate for, in which case KeyType and
+	// Key are ignored. Renewals of the certificate will
+	// reuse it.
+	CSR *x509.CertificateRequest
+
+	// Solver configures how challenges are solved for the
+	// certificate. Fields left empty are taken from the
+	// Manager's Solver.
+	Solver Solver
+
+	// Output is where copies of the certificate and key
+	// are written after each issuance.
+	Output Output
+
+	// PostIssue are commands that are run with the shell
+	// after each issuance, once Output is written.
+	PostIssue []string
+
+	// dropped are the names that were dropped from Names
+	// because they failed validation.
+	dropped []string
+
+	// account is the email address of the account
+	// that the certificate was obtained with.
+	account string
+
+	// failFast is whether obtaining the certificate fails
+	// with a RateLimitError, or a SiteBusyError, instead of
+	// waiting; see TryObtain.
+	failFast bool
+}
+
+// Site returns the name of the site that the certificate for b
+// is stored as, which is its first name. If b has a CSR and no
+// Names, that is the first name in the CSR.
+func (b Bundle) Site() string {
+	names := b.Names
+	if b.CSR != nil && len(names) == 0 {
+		names = uniqueNames(b.CSR.Subject.CommonName, b.CSR.DNSNames)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.ToLower(names[0])
 }
 
 // ObtainCerts obtains certificates in bundles, where each slice in the slice
 // is a list of domains to put onto the certificate. This function is robust
 // in handling rate limiting and will retry until it succeeds.
 func (u *User) ObtainCerts(bundles [][]string) error {
-	if ServerURL == "" {
-		return fmt.Errorf("must set ServerURL before obtaining certificates")
+	var bs []Bundle
+	for _, domains := range bundles {
+		bs = append(bs, Bundle{Names: domains})
 	}
+	return u.ObtainBundles(bs)
+}
 
-	client, err := u.newClient()
+// ObtainBundles is like ObtainCerts, except each certificate is
+// described by a Bundle, which allows more control over it. See
+// ObtainSummary; ObtainBundles returns an error if any failed.
+func (u *User) ObtainBundles(bundles []Bundle) error {
+	summary, err := u.ObtainSummary(bundles)
 	if err != nil {
 		return err
 	}
+	return summary.Err()
+}
 
-	for _, domains := range bundles {
-		if len(domains) == 0 {
-			log.Println("[INFO] Skipping a bundle with no domains specified")
-			continue
+// TryObtain obtains and saves the certificate for bundle, unless
+// there already is one, like ObtainBundles does for each bundle,
+// except it never waits: if the account is rate limited, it fails
+// with a RateLimitError, and if another operation of u is working
+// on the bundle's site, it fails with a SiteBusyError.
+func (u *User) TryObtain(bundle Bundle) (Outcome, error) {
+	if u.manager().ServerURL == "" {
+		return Failed, fmt.Errorf("must set ServerURL before obtaining certificates")
+	}
+	bundle.failFast = true
+	clients := make(map[string]*acme.Client)
+	return u.obtainBundle(&bundle, func(solver Solver) (*acme.Client, error) {
+		return u.clientFor(clients, solver)
+	}, nil)
+}
+
+// ObtainSummary obtains certificates for bundles and returns the
+// outcome of each one. The Manager's Concurrency sets how many are
+// obtained at once. If one fails, no more are started, and the
+// first error is returned once those in progress are finished,
+// along with the summary so far. If the Manager is set to KeepGoing,
+// all the bundles are attempted instead, and failures are only
+// recorded in the summary.
+func (u *User) ObtainSummary(bundles []Bundle) (Summary, error) {
+	return u.obtainAll(bundles, nil)
+}
+
+// obtainAll is like ObtainSummary, except it calls track, if it
+// is not nil, each time the bundle at index i changes state. When
+// the bundle is done, result is its outcome.
+func (u *User) obtainAll(bundles []Bundle, track func(i int, state JobState, result BundleResult)) (Summary, error) {
+	m := u.manager()
+	if m.ServerURL == "" {
+		return Summary{}, fmt.Errorf("must set ServerURL before obtaining certificates")
+	}
+	if track == nil {
+		track = func(int, JobState, BundleResult) {}
+	}
+
+	// clients are shared by the workers; making one may
+	// register the user, so only one is made at a time
+	var clientsMu sync.Mutex
+	clients := make(map[string]*acme.Client)
+	clientFor := func(solver Solver) (*acme.Client, error) {
+		clientsMu.Lock()
+		defer clientsMu.Unlock()
+		return u.clientFor(clients, solver)
+	}
+
+	type task struct {
+		index  int
+		bundle Bundle
+	}
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   = make(chan struct{})
+		work     = make(chan task)
+		results  = make([]*BundleResult, len(bundles))
+	)
+	for i := 0; i < m.concurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				progress := func(state JobState) {
+					track(j.index, state, BundleResult{})
+				}
+				outcome, err := u.obtainBundle(&j.bundle, clientFor, progress)
+				result := BundleResult{Names: j.bundle.Names, Dropped: j.bundle.dropped, Outcome: outcome}
+				if err != nil {
+					result.Error = strings.TrimSpace(err.Error())
+					if m.KeepGoing {
+						log.Printf("[ERROR] %v: %v", j.bundle.Names, err)
+					} else {
+						errOnce.Do(func() {
+							firstErr = err
+							close(failed)
+						})
+					}
+				}
+				results[j.index] = &result
+				track(j.index, outcome.jobState(), result)
+			}
+		}()
+	}
+
+Feed:
+	for i, bundle := range bundles {
+		select {
+		case work <- task{i, bundle}:
+		case <-failed:
+			break Feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	var summary Summary
+	for _, result := range results {
+		if result != nil {
+			summary.Results = append(summary.Results, *result)
+		}
+	}
+	return summary, firstErr
+}
+
+// obtainBundle obtains and saves the certificate for bundle,
+// unless there already is one, using a client from clientFor.
+// If bundle has a CSR and no Names, its Names are set from the
+// CSR. The outcome is Failed if and only if err is not nil.
+// While the certificate is being obtained, progress is called
+// with its state; see obtain.
+func (u *User) obtainBundle(bundle *Bundle, clientFor func(Solver) (*acme.Client, error), progress func(JobState)) (Outcome, error) {
+	m := u.manager()
+
+	if bundle.CSR != nil && len(bundle.Names) == 0 {
+		bundle.Names = uniqueNames(bundle.CSR.Subject.CommonName, bundle.CSR.DNSNames)
+	}
+	domains := bundle.Names
+	if len(domains) == 0 {
+		log.Println("[INFO] Skipping a bundle with no domains specified")
+		return Skipped, nil
+	}
+
+	err := u.lockSite(domains[0], !bundle.failFast)
+	if err != nil {
+		return Failed, err
+	}
+	defer u.unlockSite(domains[0])
+
+	// don't bother generating a key if we would skip the bundle
+	if !m.Force && m.alreadyIssued(domains) {
+		log.Printf("[INFO] Existing certificate and key for %s. Skipping bundle: %v", domains[0], domains)
+		return Skipped, nil
+	}
+	if m.existingCertAndKey(domains[0]) {
+		log.Printf("[INFO] Replacing existing certificate for %s with one for %v", domains[0], domains)
+	}
+
+	client, err := clientFor(bundle.Solver)
+	if err != nil {
+		return Failed, err
+	}
+
+	source := KeyGenerated
+	switch {
+	case bundle.CSR != nil:
+		source = KeyFromCSR
+	case bundle.Key != nil:
+		source = KeySupplied
+	default:
+		keyType := bundle.KeyType
+		if keyType == "" {
+			keyType = m.keyType()
+		}
+		bundle.Key, err = keyType.generate()
+		if err != nil {
+			return Failed, fmt.Errorf("generating private key for %v: %v", domains, err)
+		}
+	}
+
+	certRes, skipped, err := u.obtain(client, bundle, !m.Force, progress)
+	if err != nil {
+		return Failed, err
+	}
+	if skipped {
+		log.Printf("[INFO] Existing certificate and key for %s. Skipping bundle: %v", domains[0], domains)
+		return Skipped, nil
+	}
+
+	// immediately save each certificate as we obtain it
+	err = m.saveObtained(certRes, *bundle, source)
+	if err != nil {
+		return Failed, err
+	}
+	return Obtained, nil
+}
+
+// obtain obtains a single certificate for bundle using client.
+// The bundle must have Names, and either a Key or a CSR. Like
+// ObtainCerts, it backs off and retries when rate limited. If
+// skipExisting is true and the certificate is already in
+// storage (see alreadyIssued), nothing is obtained and skipped
+// will be true. If the Manager is set to DropFailedNames, names
+// may be dropped from bundle; see obtainDropping. If bundle is
+// set to fail fast, it returns a RateLimitError instead of
+// waiting while the account is rate limited.
+//
+// If progress is not nil, it is called with JobInProgress before
+// each attempt and with JobDeferred when an attempt is rate limited.
+func (u *User) obtain(client *acme.Client, bundle *Bundle, skipExisting bool, progress func(JobState)) (certRes acme.CertificateResource, skipped bool, err error) {
+	if progress == nil {
+		progress = func(JobState) {}
+	}
+	bundle.account = u.Email
+	for {
+		// wait out any pause, which may have been
+		// caused by another worker of this account
+		var seen int
+		if bundle.failFast {
+			var d time.Duration
+			d, seen = u.pause()
+			if d > 0 {
+				return certRes, false, RateLimitError{RetryAfter: d}
+			}
+		} else {
+			seen = u.Wait()
 		}
 
-	Obtain:
 		// certificate and key could have appeared since we last checked, especially if waiting for rate limit
-		if existingCertAndKey(domains[0]) {
-			log.Printf("[INFO] Existing certificate and key for %s. Skipping bundle: %v", domains[0], domains)
+		if skipExisting && u.manager().alreadyIssued(bundle.Names) {
+			return certRes, true, nil
+		}
+
+		progress(JobInProgress)
+		certRes, err = obtainDropping(client, bundle, u.manager().DropFailedNames)
+		if rateLimited(err) {
+			progress(JobDeferred)
+			d := u.backOffOnce(seen)
+			if bundle.failFast {
+				return certRes, false, RateLimitError{RetryAfter: d, Err: err}
+			}
+			log.Printf("[WARNING] Rate limited: %v - backing off and retrying in %v", err, d)
 			continue
 		}
+		if err != nil {
+			return certRes, false, err
+		}
 
-		certRes, failures := client.ObtainCertificate(domains, true, nil)
-		if len(failures) > 0 {
-			for domain, err := range failures {
-				if strings.Contains(err.Error(), "rateLimited") {
-					u.BackOff()
-					log.Printf("[WARNING][%s] Rate limited: %v - backing off and retrying in %v", domain, err, u.interval)
-					u.Wait()
-					log.Printf("Retrying certificate for %v", domains)
-					goto Obtain
-				} else if _, ok := err.(acme.TOSError); ok {
-					log.Printf("[WARNING][%s] Updated legal terms: %v", domain, err)
-					err := client.AgreeToTOS()
-					if err != nil {
-						return fmt.Errorf("error agreeing to updated terms for %s: %v", domain, err)
-					}
-					goto Obtain
+		// open throttle if it wasn't already
+		u.resumeOnce(seen)
+
+		return certRes, false, nil
+	}
+}
+
+// obtainOnce makes one attempt to obtain a certificate for bundle,
+// which must have Names, and either a Key or a CSR. If the CA's
+// legal terms were updated, it agrees to them and tries again, but
+// it does not retry for any other reason. Failures are returned as
+// an ObtainError.
+func obtainOnce(client *acme.Client, bundle Bundle) (acme.CertificateResource, error) {
+	var certRes acme.CertificateResource
+	var failures map[string]error
+Obtain:
+	if bundle.CSR != nil {
+		certRes, failures = client.ObtainCertificateForCSR(*bundle.CSR, true)
+	} else {
+		certRes, failures = client.ObtainCertificate(bundle.Names, true, bundle.Key)
+	}
+	if len(failures) > 0 {
+		for domain, err := range failures {
+			if _, ok := err.(acme.TOSError); ok {
+				log.Printf("[WARNING][%s] Updated legal terms: %v", domain, err)
+				err := client.AgreeToTOS()
+				if err != nil {
+					return certRes, fmt.Errorf("error agreeing to updated terms for %s: %v", domain, err)
 				}
+				goto Obtain
 			}
-			return ObtainError(failures)
 		}
+		return certRes, ObtainError(failures)
+	}
+	if bundle.CSR != nil {
+		// the site is named after the first name,
+		// even if the CSR has no Common Name
+		certRes.Domain = bundle.Names[0]
+	}
+	return certRes, nil
+}
 
-		// immediately save each certificate as we obtain it
-		err := saveCertResource(certRes)
-		if err != nil {
-			return fmt.Errorf("error saving assets for %v: %v", domains, err)
+// obtainDropping is like obtainOnce, except if drop is true and
+// the only names that failed validation are SubjectAltNames, it
+// tries again without them (as long as the Common Name, which is
+// the first name, is not among them), adding them to the dropped
+// names of bundle. Bundles with a CSR are never changed.
+func obtainDropping(client *acme.Client, bundle *Bundle, drop bool) (acme.CertificateResource, error) {
+	for {
+		certRes, err := obtainOnce(client, *bundle)
+		if !drop || bundle.CSR != nil {
+			return certRes, err
 		}
+		failed := failedSANs(err, bundle.Names)
+		if len(failed) == 0 {
+			return certRes, err
+		}
+		log.Printf("[WARNING] Dropping %v from %v and retrying: %v", failed, bundle.Names, strings.TrimSpace(err.Error()))
+		bundle.Names = withoutNames(bundle.Names, failed)
+		bundle.dropped = append(bundle.dropped, failed...)
+	}
+}
 
-		// open throttle if it wasn't already
-		u.Resume()
+// failedSANs returns the names that failed in err if all of
+// them are SubjectAltNames in names; that is, they are in names
+// but are not the first one. Otherwise, it returns nil.
+func failedSANs(err error, names []string) []string {
+	failures, ok := err.(ObtainError)
+	if !ok || rateLimited(err) || len(names) == 0 {
+		return nil
+	}
+	var failed []string
+	for domain := range failures {
+		domain = strings.ToLower(domain)
+		if domain == strings.ToLower(names[0]) || !containsName(names[1:], domain) {
+			return nil
+		}
+		failed = append(failed, domain)
 	}
+	sort.Strings(failed)
+	return failed
+}
 
-	return nil
+// withoutNames returns names without any that are in drop.
+func withoutNames(names, drop []string) []string {
+	var kept []string
+	for _, name := range names {
+		if !containsName(drop, name) {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// containsName returns true if name is in names, ignoring case.
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimited returns true if err is an ObtainError
+// for which the CA said we were rate limited.
+func rateLimited(err error) bool {
+	failures, ok := err.(ObtainError)
+	if !ok {
+		return false
+	}
+	for _, err := range failures {
+		if strings.Contains(err.Error(), "rateLimited") {
+			return true
+		}
+	}
+	return false
+}
+
+// Register registers u with the CA, agrees to the CA's terms and
+// saves u to storage, all without obtaining any certificates. It
+// requires the Manager to Agree. If u is already registered, it
+// does nothing.
+func (u *User) Register() error {
+	if u.manager().ServerURL == "" {
+		return fmt.Errorf("must set ServerURL before registering")
+	}
+	if u.Registration != nil {
+		return nil
+	}
+	_, err := u.newClient()
+	return err
+}
+
+// clientFor returns a client for u that is configured with
+// solver, on top of the Manager's Solver, reusing the one in
+// clients if there is one already.
+func (u *User) clientFor(clients map[string]*acme.Client, solver Solver) (*acme.Client, error) {
+	solver = solver.withDefaults(u.manager().Solver)
+	if client, ok := clients[solver.clientKey()]; ok {
+		return client, nil
+	}
+	client, err := u.newClient()
+	if err != nil {
+		return nil, err
+	}
+	err = solver.configure(client)
+	if err != nil {
+		return nil, fmt.Errorf("configuring challenges: %v", err)
+	}
+	clients[solver.clientKey()] = client
+	return client, nil
 }
 
 // newClient makes a new ACME client for the user u, including
@@ -176,15 +597,15 @@ func (u *User) ObtainCerts(bundles [][]string) error {
 // data to storage if the user was not already registered. The
 // returned acme.Client is ready to use.
 func (u *User) newClient() (*acme.Client, error) {
-	client, err := acme.NewClient(ServerURL, u, rsaKeySize)
+	m := u.manager()
+
+	client, err := acme.NewClient(m.ServerURL, u, m.keyType().acmeKeyType())
 	if err != nil {
 		return nil, fmt.Errorf("creating ACME client: %v", err)
 	}
 
-	// TODO: Customize ports and challenges
-
 	if u.Registration == nil {
-		if !Agree {
+		if !m.Agree {
 			return nil, fmt.Errorf("cannot register user '%s' without --agree", u.Email)
 		}
 
@@ -199,7 +620,7 @@ func (u *User) newClient() (*acme.Client, error) {
 			return nil, fmt.Errorf("error agreeing to terms: %v", err)
 		}
 
-		err = saveUser(u)
+		err = m.saveUser(u)
 		if err != nil {
 			return nil, fmt.Errorf("could not save user: %v", err)
 		}
@@ -208,6 +629,19 @@ func (u *User) newClient() (*acme.Client, error) {
 	return client, nil
 }
 
+// Manager returns the Manager of u, which is the
+// default Manager if u was not made by one.
+func (u *User) Manager() *Manager {
+	return u.manager()
+}
+
+func (u *User) manager() *Manager {
+	if u.mgr == nil {
+		return defaultManager()
+	}
+	return u.mgr
+}
+
 // GetEmail gets u's email.
 func (u *User) GetEmail() string {
 	return u.Email
@@ -219,7 +653,7 @@ func (u *User) GetRegistration() *acme.RegistrationResource {
 }
 
 // GetPrivateKey gets u's private key.
-func (u *User) GetPrivateKey() *rsa.PrivateKey {
+func (u *User) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
@@ -17,9 +17,15 @@ package issuance
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/mholt/certs/issuance/issuancetest"
 	"github.com/xenolf/lego/acme"
 )
 
@@ -46,8 +52,9 @@ func TestUser(t *testing.T) {
 }
 
 func TestNewUser(t *testing.T) {
+	m := new(Manager)
 	email := "me@foobar.com"
-	user, err := newUser(email)
+	user, err := m.newUser(email)
 	if err != nil {
 		t.Fatalf("Error creating user: %v", err)
 	}
@@ -63,34 +70,34 @@ func TestNewUser(t *testing.T) {
 }
 
 func TestSaveUser(t *testing.T) {
-	Workspace = Storage("./testdata")
-	defer os.RemoveAll(string(Workspace))
+	storage := FileStorage("./testdata")
+	m := &Manager{Storage: storage}
+	defer os.RemoveAll(string(storage))
 
 	email := "me@foobar.com"
-	user, err := newUser(email)
+	user, err := m.newUser(email)
 	if err != nil {
 		t.Fatalf("Error creating user: %v", err)
 	}
 
-	err = saveUser(user)
+	err = m.saveUser(user)
 	if err != nil {
 		t.Fatalf("Error saving user: %v", err)
 	}
-	_, err = os.Stat(Workspace.UserRegFile(email))
+	_, err = os.Stat(storage.Path(UserRegFile(email)))
 	if err != nil {
 		t.Errorf("Cannot access user registration file, error: %v", err)
 	}
-	_, err = os.Stat(Workspace.UserKeyFile(email))
+	_, err = os.Stat(storage.Path(UserKeyFile(email)))
 	if err != nil {
 		t.Errorf("Cannot access user private key file, error: %v", err)
 	}
 }
 
 func TestGetUserDoesNotAlreadyExist(t *testing.T) {
-	Workspace = Storage("./testdata")
-	defer os.RemoveAll(string(Workspace))
+	m := &Manager{Storage: new(MemoryStorage)}
 
-	user, err := GetUser("user_does_not_exist@foobar.com")
+	user, err := m.GetUser("user_does_not_exist@foobar.com")
 	if err != nil {
 		t.Fatalf("Error getting user: %v", err)
 	}
@@ -101,29 +108,28 @@ func TestGetUserDoesNotAlreadyExist(t *testing.T) {
 }
 
 func TestGetUserAlreadyExists(t *testing.T) {
-	Workspace = Storage("./testdata")
-	defer os.RemoveAll(string(Workspace))
+	m := &Manager{Storage: new(MemoryStorage)}
 
 	email := "me@foobar.com"
 
 	// Set up test
-	user, err := newUser(email)
+	user, err := m.newUser(email)
 	if err != nil {
 		t.Fatalf("Error creating user: %v", err)
 	}
-	err = saveUser(user)
+	err = m.saveUser(user)
 	if err != nil {
 		t.Fatalf("Error saving user: %v", err)
 	}
 
 	// Expect to load user from disk
-	user2, err := GetUser(email)
+	user2, err := m.GetUser(email)
 	if err != nil {
 		t.Fatalf("Error getting user: %v", err)
 	}
 
 	// Assert keys are the same
-	if !rsaPrivateKeysSame(user.key, user2.key) {
+	if !privateKeysSame(user.key, user2.key) {
 		t.Error("Expected private key to be the same after loading, but it wasn't")
 	}
 
@@ -132,3 +138,230 @@ func TestGetUserAlreadyExists(t *testing.T) {
 		t.Errorf("Expected emails to be equal, but was '%s' before and '%s' after loading", user.Email, user2.Email)
 	}
 }
+
+func TestRegisterAlreadyRegistered(t *testing.T) {
+	m := new(Manager)
+	user := &User{Email: "me@foobar.com", Registration: new(acme.RegistrationResource), mgr: m}
+	if err := user.Register(); err == nil {
+		t.Error("Expected an error without ServerURL, but got none")
+	}
+
+	m.ServerURL = "https://ca.example.com/directory"
+	if err := user.Register(); err != nil {
+		t.Errorf("Expected no error for registered user, got: %v", err)
+	}
+}
+
+func TestManagersAreIndependent(t *testing.T) {
+	m1 := &Manager{ServerURL: "https://ca1.example.com/directory", Storage: new(MemoryStorage)}
+	m2 := &Manager{ServerURL: "https://ca2.example.com/directory", Storage: new(MemoryStorage)}
+
+	email := "me@foobar.com"
+	user1, err := m1.GetUser(email)
+	if err != nil {
+		t.Fatalf("Error getting user: %v", err)
+	}
+	if err := m1.saveUser(user1); err != nil {
+		t.Fatalf("Error saving user: %v", err)
+	}
+
+	if m2.Storage.Exists(UserRegFile(email)) {
+		t.Error("Expected user to be saved only in the first workspace, but it was in the second too")
+	}
+	user2, err := m2.GetUser(email)
+	if err != nil {
+		t.Fatalf("Error getting user: %v", err)
+	}
+	if privateKeysSame(user1.key, user2.key) {
+		t.Error("Expected different keys for users of different managers, but they were the same")
+	}
+	if user1.manager() != m1 || user2.manager() != m2 {
+		t.Error("Expected users to belong to the managers that loaded them")
+	}
+}
+
+func TestFailedSANs(t *testing.T) {
+	names := []string{"example.com", "www.example.com", "old.example.com"}
+	for i, test := range []struct {
+		err      error
+		expected []string
+	}{
+		{nil, nil},
+		{fmt.Errorf("not an ObtainError"), nil},
+		{ObtainError{"old.example.com": fmt.Errorf("unauthorized")}, []string{"old.example.com"}},
+		{ObtainError{"OLD.example.com": fmt.Errorf("unauthorized"), "www.example.com": fmt.Errorf("connection refused")},
+			[]string{"old.example.com", "www.example.com"}},
+		{ObtainError{"example.com": fmt.Errorf("unauthorized")}, nil},
+		{ObtainError{"example.com": fmt.Errorf("unauthorized"), "old.example.com": fmt.Errorf("unauthorized")}, nil},
+		{ObtainError{"other.com": fmt.Errorf("unauthorized")}, nil},
+		{ObtainError{"old.example.com": fmt.Errorf("urn:acme:error:rateLimited")}, nil},
+	} {
+		actual := failedSANs(test.err, names)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, actual)
+		}
+	}
+
+	if actual, expected := withoutNames(names, []string{"old.example.com"}), names[:2]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestObtainFromServer(t *testing.T) {
+	s := issuancetest.NewServer()
+	defer s.Close()
+
+	m := &Manager{ServerURL: s.DirectoryURL(), Storage: new(MemoryStorage), KeyType: P256, KeepGoing: true}
+	user, err := m.GetUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := Solver{Challenges: []acme.Challenge{acme.HTTP01}, HTTPAddress: "127.0.0.1:0"}
+	bundle := func(names ...string) Bundle {
+		return Bundle{Names: names, Solver: solver}
+	}
+
+	// registering needs agreement to the terms
+	if _, err := user.ObtainSummary([]Bundle{bundle("example.com")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Accounts()) != 0 || m.Storage.Exists(UserRegFile(user.Email)) {
+		t.Fatal("Expected no registration without agreeing to the terms")
+	}
+
+	m.Agree = true
+	s.FailValidation("bad.example.com", "Connection refused")
+	summary, err := user.ObtainSummary([]Bundle{bundle("example.com", "www.example.com"), bundle("bad.example.com")})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if summary.Count(Obtained) != 1 || summary.Count(Failed) != 1 || !strings.Contains(summary.Results[1].Error, "Connection refused") {
+		t.Errorf("Expected one obtained and one failed validation, got %+v", summary)
+	}
+	if contacts := s.Accounts(); len(contacts) != 1 || contacts[0] != "mailto:me@example.com" {
+		t.Errorf("Expected account for me@example.com, got %v", contacts)
+	}
+	if !m.Storage.Exists(UserRegFile(user.Email)) {
+		t.Error("Expected registration to be saved")
+	}
+	details, err := m.ShowSite("example.com")
+	if err != nil {
+		t.Fatalf("Expected certificate to be saved, got: %v", err)
+	}
+	if !details.KeyMatches || len(details.Chain) != 1 || !details.Chain[0].Equal(s.Root) {
+		t.Errorf("Expected certificate with matching key and chain to the root, got %+v", details)
+	}
+	if len(details.Certificate.DNSNames) != 2 || details.Meta.Account != user.Email {
+		t.Errorf("Expected certificate for both names by %s, got %v by %s", user.Email, details.Certificate.DNSNames, details.Meta.Account)
+	}
+
+	// updated terms are agreed to and the request is retried
+	s.ChangeTerms()
+	agreements := s.Requests(issuancetest.Reg)
+	summary, err = user.ObtainSummary([]Bundle{bundle("example.org")})
+	if err != nil || summary.Count(Obtained) != 1 {
+		t.Errorf("Expected certificate after updated terms, got %+v and error %v", summary, err)
+	}
+	if s.Requests(issuancetest.Reg) != agreements+1 {
+		t.Errorf("Expected to agree to the updated terms once, but agreed %d times", s.Requests(issuancetest.Reg)-agreements)
+	}
+
+	// failures of the CA are reported
+	s.FailNext(issuancetest.NewCert, issuancetest.ServerError, 1)
+	summary, err = user.ObtainSummary([]Bundle{bundle("example.net")})
+	if err != nil || summary.Count(Failed) != 1 || !strings.Contains(summary.Results[0].Error, "serverInternal") {
+		t.Errorf("Expected server error to fail the certificate, got %+v and error %v", summary, err)
+	}
+	if len(s.Issued()) != 2 {
+		t.Errorf("Expected 2 certificates to be issued, got %d", len(s.Issued()))
+	}
+
+	// bundles without their own solver use the Manager's
+	m.Solver = Solver{HTTPAddress: "no port"}
+	summary, err = user.ObtainSummary([]Bundle{{Names: []string{"example.info"}}})
+	if err != nil || summary.Count(Failed) != 1 || !strings.Contains(summary.Results[0].Error, "no port") {
+		t.Errorf("Expected the Manager's invalid solver to fail the certificate, got %+v and error %v", summary, err)
+	}
+	m.Solver = solver
+	summary, err = user.ObtainSummary([]Bundle{{Names: []string{"example.info"}}})
+	if err != nil || summary.Count(Obtained) != 1 {
+		t.Errorf("Expected certificate with the Manager's solver, got %+v and error %v", summary, err)
+	}
+	if meta, err := m.loadSiteMeta("example.info"); err != nil || meta.Solver != nil {
+		t.Errorf("Expected the Manager's solver not to be recorded with the site, got %+v and error %v", meta.Solver, err)
+	}
+
+	// http-01 can be solved through a webroot
+	dir, err := ioutil.TempDir("", "certs_webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	webroot := Solver{Challenges: []acme.Challenge{acme.HTTP01}, Webroots: map[string]string{"example.biz": dir}}
+	summary, err = user.ObtainSummary([]Bundle{{Names: []string{"example.biz"}, Solver: webroot}, {Names: []string{"www.example.biz"}, Solver: webroot}})
+	if err != nil || summary.Count(Obtained) != 1 || !strings.Contains(summary.Results[1].Error, "no webroot for www.example.biz") {
+		t.Errorf("Expected certificate only for the name with a webroot, got %+v and error %v", summary, err)
+	}
+
+	// dns-01 can be solved by a script
+	script, logFile := dnsScript(t, dir, "bad.example.biz")
+	dns := Solver{Challenges: []acme.Challenge{acme.DNS01}, DNS: &DNSConfig{Provider: "exec", Exec: script}}
+	summary, err = user.ObtainSummary([]Bundle{{Names: []string{"dns.example.biz"}, Solver: dns}, {Names: []string{"bad.example.biz"}, Solver: dns}})
+	if err != nil || summary.Count(Obtained) != 1 || !strings.Contains(summary.Results[1].Error, "zone not found") {
+		t.Errorf("Expected certificate only for the name the script can set records for, got %+v and error %v", summary, err)
+	}
+	if logged, err := ioutil.ReadFile(logFile); err != nil || !strings.Contains(string(logged), "cleanup _acme-challenge.dns.example.biz.") {
+		t.Errorf("Expected the script to clean up the record, got %s and error %v", logged, err)
+	}
+
+	// or with dynamic updates to a nameserver
+	ns := startNameserver(t, "example.biz", "", "")
+	defer ns.server.Shutdown()
+	rfc2136 := Solver{Challenges: []acme.Challenge{acme.DNS01}, DNS: &DNSConfig{Provider: "rfc2136", Nameserver: ns.addr}}
+	summary, err = user.ObtainSummary([]Bundle{{Names: []string{"rfc2136.example.biz"}, Solver: rfc2136}})
+	if err != nil || summary.Count(Obtained) != 1 {
+		t.Errorf("Expected certificate with dynamic DNS updates, got %+v and error %v", summary, err)
+	}
+	if records := ns.txt("_acme-challenge.rfc2136.example.biz."); len(records) != 0 {
+		t.Errorf("Expected the record to be removed, got %v", records)
+	}
+}
+
+func TestObtainConcurrentlyOnOnePort(t *testing.T) {
+	s := issuancetest.NewServer()
+	defer s.Close()
+
+	// a fixed port, which workers must take turns binding
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	m := &Manager{
+		ServerURL:   s.DirectoryURL(),
+		Agree:       true,
+		Storage:     new(MemoryStorage),
+		KeyType:     P256,
+		Concurrency: 2,
+		KeepGoing:   true,
+		Solver:      Solver{Challenges: []acme.Challenge{acme.HTTP01}, HTTPAddress: addr},
+	}
+	user, err := m.GetUser("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var bundles []Bundle
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		bundles = append(bundles, Bundle{Names: []string{name, "www." + name}})
+	}
+	summary, err := user.ObtainSummary(bundles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Count(Obtained) != len(bundles) {
+		t.Errorf("Expected all %d certificates to be obtained, got %+v", len(bundles), summary)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// webrootProvider solves the http-01 challenge by writing the
+// key authorization into the document root of a web server that
+// is already running, rather than serving it on its own.
+type webrootProvider struct {
+	solver Solver
+}
+
+// challengeFile returns the path of the file that must be
+// served for token at the webroot of domain.
+func (w webrootProvider) challengeFile(domain, token string) (string, error) {
+	root, err := w.solver.webrootFor(domain)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, ".well-known", "acme-challenge", token), nil
+}
+
+// Present writes the challenge file for token into the
+// webroot of domain.
+func (w webrootProvider) Present(domain, token, keyAuth string) error {
+	file, err := w.challengeFile(domain, token)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return fmt.Errorf("creating challenge folder: %v", err)
+	}
+	err = ioutil.WriteFile(file, []byte(keyAuth), 0644)
+	if err != nil {
+		return fmt.Errorf("writing challenge file: %v", err)
+	}
+	return nil
+}
+
+// CleanUp removes the challenge file for token from the
+// webroot of domain. The folders are left in place, since
+// the web server may have other files in them.
+func (w webrootProvider) CleanUp(domain, token, keyAuth string) error {
+	file, err := w.challengeFile(domain, token)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(file)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing challenge file: %v", err)
+	}
+	return nil
+}
+
+// webrootFor returns the webroot to solve the http-01
+// challenge for domain in, which is the one in s.Webroots
+// for domain if there is one, and s.Webroot otherwise.
+func (s Solver) webrootFor(domain string) (string, error) {
+	if root, ok := s.Webroots[strings.ToLower(domain)]; ok {
+		return root, nil
+	}
+	if s.Webroot == "" {
+		return "", fmt.Errorf("no webroot for %s", domain)
+	}
+	return s.Webroot, nil
+}
+
+// usesWebroot returns true if s solves the
+// http-01 challenge with a webroot.
+func (s Solver) usesWebroot() bool {
+	return s.Webroot != "" || len(s.Webroots) > 0
+}
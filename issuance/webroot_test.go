@@ -0,0 +1,66 @@
+// Copyright © 2016 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package issuance
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebrootProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs_webroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := webrootProvider{solver: Solver{
+		Webroot:  filepath.Join(dir, "default"),
+		Webroots: map[string]string{"static.example.com": filepath.Join(dir, "static")},
+	}}
+
+	for domain, root := range map[string]string{"example.com": "default", "Static.example.com": "static"} {
+		err := w.Present(domain, "token", "token.thumbprint")
+		if err != nil {
+			t.Fatalf("%s: Expected no error, got: %v", domain, err)
+		}
+		file := filepath.Join(dir, root, ".well-known", "acme-challenge", "token")
+		contents, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("%s: Expected challenge file in %s webroot, got: %v", domain, root, err)
+		}
+		if string(contents) != "token.thumbprint" {
+			t.Errorf("%s: Expected key authorization in challenge file, got '%s'", domain, contents)
+		}
+
+		err = w.CleanUp(domain, "token", "token.thumbprint")
+		if err != nil {
+			t.Fatalf("%s: Expected no error cleaning up, got: %v", domain, err)
+		}
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("%s: Expected challenge file to be removed, got: %v", domain, err)
+		}
+		if _, err := os.Stat(filepath.Dir(file)); err != nil {
+			t.Errorf("%s: Expected challenge folder to be left in place, got: %v", domain, err)
+		}
+	}
+
+	w = webrootProvider{solver: Solver{Webroots: map[string]string{"example.com": dir}}}
+	if err := w.Present("other.com", "token", "token.thumbprint"); err == nil {
+		t.Error("Expected an error for a name without a webroot, but didn't get one")
+	}
+}